@@ -17,10 +17,14 @@ func main() {
 		Output:     os.Stderr,
 		JSONFormat: true,
 	})
+	flyProvider := &p.FlyProvider{}
+	// Release the tsnet connection once the plugin is shut down
+	defer flyProvider.Close()
+
 	hc_plugin.Serve(&hc_plugin.ServeConfig{
 		HandshakeConfig: providermanager.ProviderHandshakeConfig,
 		Plugins: map[string]hc_plugin.Plugin{
-			"fly-provider": &provider.ProviderPlugin{Impl: &p.FlyProvider{}},
+			"fly-provider": &provider.ProviderPlugin{Impl: flyProvider},
 		},
 		Logger: logger,
 	})
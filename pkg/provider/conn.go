@@ -2,24 +2,57 @@ package provider
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
+	"os"
 	"path/filepath"
+	"strconv"
 	"time"
 
+	flyutil "github.com/daytonaio/daytona-provider-fly/pkg/provider/util"
+	"github.com/daytonaio/daytona-provider-fly/pkg/types"
 	"github.com/daytonaio/daytona/pkg/agent/ssh/config"
 	"github.com/daytonaio/daytona/pkg/docker"
+	"github.com/daytonaio/daytona/pkg/models"
+	"github.com/daytonaio/daytona/pkg/ssh"
 	"github.com/daytonaio/daytona/pkg/tailscale"
 	"github.com/docker/docker/client"
 	"github.com/google/uuid"
 	"tailscale.com/tsnet"
 )
 
+const (
+	dialRetryAttempts = 5
+	dialRetryBackoff  = 500 * time.Millisecond
+	// dockerProbeTimeout bounds the Docker daemon ping of getCheckedDockerClient.
+	dockerProbeTimeout = 10 * time.Second
+)
+
+var (
+	// errPortNeverOpened is returned when the target's SSH port could not be dialed in time.
+	errPortNeverOpened = errors.New("target ssh port never opened")
+	// errAgentUnhealthy is returned when the SSH port is open but the agent does not run commands.
+	errAgentUnhealthy = errors.New("target agent never became healthy")
+	// errDockerUnreachable is returned when the Docker daemon of the target does not answer a ping.
+	errDockerUnreachable = errors.New("docker daemon not reachable")
+)
+
+// getTsnetConnection creates the tsnet connection. It is a variable so tests can stub it.
+var getTsnetConnection = tailscale.GetConnection
+
+// getTsnetConn returns the provider's tsnet connection, creating it on first use.
+// It is safe for concurrent use and creates exactly one connection.
 func (p *FlyProvider) getTsnetConn() (*tsnet.Server, error) {
+	p.tsnetMu.Lock()
+	defer p.tsnetMu.Unlock()
+
 	if p.tsnetConn == nil {
-		tsnetConn, err := tailscale.GetConnection(&tailscale.TsnetConnConfig{
+		tsnetDir := filepath.Join(*p.BasePath, "tsnet", uuid.NewString())
+		tsnetConn, err := getTsnetConnection(&tailscale.TsnetConnConfig{
 			AuthKey:    *p.NetworkKey,
 			ControlURL: *p.ServerUrl,
-			Dir:        filepath.Join(*p.BasePath, "tsnet", uuid.NewString()),
+			Dir:        tsnetDir,
 			Logf:       func(format string, args ...any) {},
 			Hostname:   fmt.Sprintf("fly-provider-%s", uuid.NewString()),
 		})
@@ -27,42 +60,155 @@ func (p *FlyProvider) getTsnetConn() (*tsnet.Server, error) {
 			return nil, err
 		}
 		p.tsnetConn = tsnetConn
+		p.tsnetDir = tsnetDir
 	}
 
 	return p.tsnetConn, nil
 }
 
-func (p *FlyProvider) waitForDial(targetId string, dialTimeout time.Duration) error {
+// resetTsnetConn closes the tsnet connection if it is still the provider's connection and removes its working
+// directory, so the next call to getTsnetConn creates a new one. A connection already replaced by another
+// caller is left alone. Failures to close the stale connection are ignored.
+func (p *FlyProvider) resetTsnetConn(stale *tsnet.Server) {
+	p.tsnetMu.Lock()
+	defer p.tsnetMu.Unlock()
+
+	if p.tsnetConn != stale {
+		return
+	}
+	_ = p.closeTsnetConnLocked()
+}
+
+// Close stops the log tails, shuts down the provider's tsnet connection and removes its working directory.
+// It is safe to call multiple times and when no connection was ever created.
+func (p *FlyProvider) Close() error {
+	p.logPollers.stopAll()
+
+	p.tsnetMu.Lock()
+	defer p.tsnetMu.Unlock()
+
+	return p.closeTsnetConnLocked()
+}
+
+// closeTsnetConnLocked shuts down the tsnet connection and removes its working directory. p.tsnetMu must be held.
+func (p *FlyProvider) closeTsnetConnLocked() error {
+	var errs []error
+	if p.tsnetConn != nil {
+		if err := p.tsnetConn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			errs = append(errs, err)
+		}
+		p.tsnetConn = nil
+	}
+
+	if p.tsnetDir != "" {
+		if err := os.RemoveAll(p.tsnetDir); err != nil {
+			errs = append(errs, err)
+		}
+		p.tsnetDir = ""
+	}
+
+	return errors.Join(errs...)
+}
+
+func (p *FlyProvider) getSshClient(hostname string) (*ssh.Client, error) {
+	tsnetConn, err := p.getTsnetConn()
+	if err != nil {
+		return nil, err
+	}
+
+	return tailscale.NewSshClient(tsnetConn, p.getSshSessionConfig(hostname))
+}
+
+// getSshSessionConfig returns the SSH session config of the agent on the host.
+func (p *FlyProvider) getSshSessionConfig(hostname string) *ssh.SessionConfig {
+	return &ssh.SessionConfig{
+		Hostname: hostname,
+		Port:     p.getSshPort(),
+	}
+}
+
+// getSshPort returns the port the agents listen on for SSH, the SshPort of the provider or the daytona default.
+func (p *FlyProvider) getSshPort() int {
+	if p.SshPort != 0 {
+		return p.SshPort
+	}
+	return config.SSH_PORT
+}
+
+// getSshAddress returns the address of the agent SSH server on the host.
+func (p *FlyProvider) getSshAddress(host string) string {
+	return net.JoinHostPort(host, strconv.Itoa(p.getSshPort()))
+}
+
+// waitForDial dials the SSH port of the target machine until it is reachable.
+// Dialing stops once the context is cancelled.
+func (p *FlyProvider) waitForDial(ctx context.Context, host string, dialTimeout time.Duration) error {
 	tsnetConn, err := p.getTsnetConn()
 	if err != nil {
 		return err
 	}
 
+	return waitForHostDial(ctx, host, dialTimeout, func(host string) error {
+		dialConn, err := tsnetConn.Dial(ctx, "tcp", p.getSshAddress(host))
+		if err != nil {
+			return err
+		}
+		return dialConn.Close()
+	})
+}
+
+func waitForHostDial(ctx context.Context, host string, dialTimeout time.Duration, dial func(host string) error) error {
 	dialStartTime := time.Now()
 	for {
 		if time.Since(dialStartTime) > dialTimeout {
-			return fmt.Errorf("timeout: dialing timed out after %f minutes", dialTimeout.Minutes())
+			return fmt.Errorf("timeout: dialing %s timed out after %f minutes", host, dialTimeout.Minutes())
 		}
 
-		dialConn, err := tsnetConn.Dial(context.Background(), "tcp", fmt.Sprintf("%s:%d", targetId, config.SSH_PORT))
-		if err == nil {
-			dialConn.Close()
+		if err := dial(host); err == nil {
 			return nil
 		}
 
-		time.Sleep(time.Second)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
 	}
 }
 
-func (p *FlyProvider) getDockerClient(targetId string) (docker.IDockerClient, error) {
-	tsnetConn, err := p.getTsnetConn()
+func (p *FlyProvider) getDockerClient(target *models.Target) (docker.IDockerClient, error) {
+	cli, err := p.getDockerApiClient(target)
+	if err != nil {
+		return nil, err
+	}
+
+	return docker.NewDockerClient(docker.DockerClientConfig{
+		ApiClient: cli,
+	}), nil
+}
+
+// getCheckedDockerClient returns the Docker client of the target after checking that its daemon answers.
+// The ping adds a round trip, so it is only used where an unreachable daemon would otherwise fail
+// later with a vague Docker error.
+func (p *FlyProvider) getCheckedDockerClient(target *models.Target) (docker.IDockerClient, error) {
+	targetOptions, err := types.ParseTargetOptions(target.TargetConfig.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	cli, err := p.getDockerApiClient(target)
 	if err != nil {
 		return nil, err
 	}
 
-	remoteHost := fmt.Sprintf("tcp://%s:2375", targetId)
-	cli, err := client.NewClientWithOpts(client.WithDialContext(tsnetConn.Dial), client.WithHost(remoteHost), client.WithAPIVersionNegotiation())
+	ctx, cancel := context.WithTimeout(context.Background(), dockerProbeTimeout)
+	defer cancel()
+	err = probeDocker(ctx, target, targetOptions, func(ctx context.Context) error {
+		_, err := cli.Ping(ctx)
+		return err
+	})
 	if err != nil {
+		cli.Close()
 		return nil, err
 	}
 
@@ -70,3 +216,185 @@ func (p *FlyProvider) getDockerClient(targetId string) (docker.IDockerClient, er
 		ApiClient: cli,
 	}), nil
 }
+
+// probeDocker pings the Docker daemon of the target and describes the route to it if it does not answer.
+func probeDocker(ctx context.Context, target *models.Target, targetOptions *types.TargetOptions, ping func(ctx context.Context) error) error {
+	err := ping(ctx)
+	if err == nil {
+		return nil
+	}
+
+	route := "over the tailnet"
+	if targetOptions.DockerHost != "" {
+		route = "at " + targetOptions.DockerHost
+	} else if targetOptions.ConnectionMode == types.ConnectionModePrivate {
+		route = "over the fly private network"
+	}
+	return fmt.Errorf("%w: docker daemon of target %s not reachable %s: %w", errDockerUnreachable, target.Id, route, err)
+}
+
+func (p *FlyProvider) getDockerApiClient(target *models.Target) (*client.Client, error) {
+	targetOptions, err := types.ParseTargetOptions(target.TargetConfig.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	clientOpts := []client.Opt{client.WithHost(getDockerHost(target, targetOptions))}
+	if targetOptions.DockerApiVersion != "" {
+		clientOpts = append(clientOpts, client.WithVersion(targetOptions.DockerApiVersion))
+	} else {
+		clientOpts = append(clientOpts, client.WithAPIVersionNegotiation())
+	}
+
+	// External hosts and the private network are reachable directly, so the default dialer is used
+	if targetOptions.DockerHost == "" && targetOptions.ConnectionMode != types.ConnectionModePrivate {
+		clientOpts = append(clientOpts, client.WithDialContext(p.dialContext))
+	}
+
+	return client.NewClientWithOpts(clientOpts...)
+}
+
+// getDockerHost returns the Docker host of the target, the external Docker host if set
+// or the machine's daemon for the configured connection mode.
+func getDockerHost(target *models.Target, targetOptions *types.TargetOptions) string {
+	if targetOptions.DockerHost != "" {
+		return targetOptions.DockerHost
+	}
+
+	if targetOptions.ConnectionMode == types.ConnectionModePrivate {
+		return fmt.Sprintf("tcp://%s.internal:2375", flyutil.GetAppName(target, targetOptions))
+	}
+
+	return fmt.Sprintf("tcp://%s:2375", target.Id)
+}
+
+// dialContext dials the address over the tailnet, retrying with backoff on connection errors.
+// If the tsnet server has been closed, a new tsnet connection is established on the next attempt.
+func (p *FlyProvider) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return retryDial(ctx, dialRetryAttempts, dialRetryBackoff, func() (net.Conn, error) {
+		tsnetConn, err := p.getTsnetConn()
+		if err != nil {
+			return nil, err
+		}
+
+		conn, err := tsnetConn.Dial(ctx, network, address)
+		if errors.Is(err, net.ErrClosed) {
+			p.resetTsnetConn(tsnetConn)
+		}
+
+		return conn, err
+	})
+}
+
+// retryDial calls dial until it succeeds, the attempts are exhausted or the context is done.
+// The backoff between attempts doubles after each failed attempt.
+func retryDial(ctx context.Context, attempts int, backoff time.Duration, dial func() (net.Conn, error)) (net.Conn, error) {
+	var err error
+	for attempt := 1; ; attempt++ {
+		var conn net.Conn
+		conn, err = dial()
+		if err == nil {
+			return conn, nil
+		}
+
+		if attempt >= attempts {
+			return nil, fmt.Errorf("dialing failed after %d attempts: %w", attempts, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (p *FlyProvider) waitForDocker(target *models.Target, timeout time.Duration) error {
+	cli, err := p.getDockerApiClient(target)
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	startTime := time.Now()
+	for {
+		if time.Since(startTime) > timeout {
+			return fmt.Errorf("timeout: docker daemon did not respond after %f minutes", timeout.Minutes())
+		}
+
+		_, err := cli.Ping(context.Background())
+		if err == nil {
+			return nil
+		}
+
+		time.Sleep(time.Second)
+	}
+}
+
+// waitForAgent waits until the target agent's SSH server accepts a session and runs a command.
+func (p *FlyProvider) waitForAgent(ctx context.Context, targetId string, timeout time.Duration) error {
+	if _, err := p.getTsnetConn(); err != nil {
+		return err
+	}
+
+	return waitForAgentHealth(ctx, timeout, func() error {
+		return p.checkAgentHealth(targetId)
+	})
+}
+
+// checkAgentHealth runs a no-op command over SSH to confirm the agent is responsive.
+func (p *FlyProvider) checkAgentHealth(targetId string) error {
+	sshClient, err := p.getSshClient(targetId)
+	if err != nil {
+		return err
+	}
+	defer sshClient.Close()
+
+	session, err := sshClient.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	return session.Run("true")
+}
+
+// waitForAgentHealth retries the health check every second until it passes, the timeout is reached
+// or the context is cancelled.
+func waitForAgentHealth(ctx context.Context, timeout time.Duration, check func() error) error {
+	startTime := time.Now()
+	for {
+		err := check()
+		if err == nil {
+			return nil
+		}
+
+		if time.Since(startTime) > timeout {
+			return fmt.Errorf("%w: timeout after %f minutes: %w", errAgentUnhealthy, timeout.Minutes(), err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// waitForReadiness runs the readiness checks in order up to and including the provided readiness level.
+func waitForReadiness(readiness string, checks map[string]func() error) error {
+	for _, level := range types.StartReadinessLevels {
+		if check, ok := checks[level]; ok {
+			if err := check(); err != nil {
+				return err
+			}
+		}
+
+		if level == readiness {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown start readiness %q", readiness)
+}
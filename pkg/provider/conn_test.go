@@ -0,0 +1,455 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/daytonaio/daytona-provider-fly/pkg/types"
+	"github.com/daytonaio/daytona/pkg/agent/ssh/config"
+	"github.com/daytonaio/daytona/pkg/models"
+	"github.com/daytonaio/daytona/pkg/provider"
+	"github.com/daytonaio/daytona/pkg/tailscale"
+	"tailscale.com/tsnet"
+)
+
+func TestWaitForReadiness(t *testing.T) {
+	cases := []struct {
+		readiness      string
+		expectedChecks []string
+	}{
+		{
+			readiness:      types.StartReadinessDial,
+			expectedChecks: []string{types.StartReadinessDial},
+		},
+		{
+			readiness:      types.StartReadinessDocker,
+			expectedChecks: []string{types.StartReadinessDial, types.StartReadinessDocker},
+		},
+		{
+			readiness:      types.StartReadinessAgent,
+			expectedChecks: []string{types.StartReadinessDial, types.StartReadinessDocker, types.StartReadinessAgent},
+		},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.readiness, func(t *testing.T) {
+			var checked []string
+			checks := map[string]func() error{}
+			for _, level := range types.StartReadinessLevels {
+				checks[level] = func() error {
+					checked = append(checked, level)
+					return nil
+				}
+			}
+
+			err := waitForReadiness(testCase.readiness, checks)
+			if err != nil {
+				t.Fatalf("Expected readiness checks to pass but got error: %s", err)
+			}
+
+			if !slices.Equal(checked, testCase.expectedChecks) {
+				t.Errorf("Expected checks %v but got %v", testCase.expectedChecks, checked)
+			}
+		})
+	}
+}
+
+func TestWaitForReadinessStopsOnFailure(t *testing.T) {
+	dockerErr := errors.New("docker unreachable")
+	agentChecked := false
+
+	err := waitForReadiness(types.StartReadinessAgent, map[string]func() error{
+		types.StartReadinessDial:   func() error { return nil },
+		types.StartReadinessDocker: func() error { return dockerErr },
+		types.StartReadinessAgent: func() error {
+			agentChecked = true
+			return nil
+		},
+	})
+	if !errors.Is(err, dockerErr) {
+		t.Errorf("Expected docker error but got: %v", err)
+	}
+	if agentChecked {
+		t.Errorf("Expected agent check to be skipped after docker check failed")
+	}
+}
+
+func TestWaitForReadinessUnknownLevel(t *testing.T) {
+	err := waitForReadiness("unknown", map[string]func() error{})
+	if err == nil {
+		t.Errorf("Expected error for unknown readiness level but got none")
+	}
+}
+
+func TestRetryDial(t *testing.T) {
+	attempts := 0
+	conn, err := retryDial(context.Background(), 3, time.Millisecond, func() (net.Conn, error) {
+		attempts++
+		if attempts == 1 {
+			return nil, errors.New("connection refused")
+		}
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	})
+	if err != nil {
+		t.Fatalf("Expected dial to succeed after a retry but got error: %s", err)
+	}
+	conn.Close()
+
+	if attempts != 2 {
+		t.Errorf("Expected 2 dial attempts but got %d", attempts)
+	}
+}
+
+func TestRetryDialExhausted(t *testing.T) {
+	dialErr := errors.New("connection refused")
+	attempts := 0
+	_, err := retryDial(context.Background(), 3, time.Millisecond, func() (net.Conn, error) {
+		attempts++
+		return nil, dialErr
+	})
+	if !errors.Is(err, dialErr) {
+		t.Errorf("Expected dial error but got: %v", err)
+	}
+	if attempts != 3 {
+		t.Errorf("Expected 3 dial attempts but got %d", attempts)
+	}
+}
+
+func TestRetryDialContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := retryDial(ctx, 3, time.Minute, func() (net.Conn, error) {
+		return nil, errors.New("connection refused")
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context cancelled error but got: %v", err)
+	}
+}
+
+func TestWaitForHostDialUnreachable(t *testing.T) {
+	err := waitForHostDial(context.Background(), "down", time.Millisecond, func(host string) error {
+		return errors.New("connection refused")
+	})
+	if err == nil {
+		t.Errorf("Expected error when the host cannot be reached but got none")
+	}
+}
+
+func TestGetTsnetConnConcurrent(t *testing.T) {
+	var connections atomic.Int32
+	defaultGetTsnetConnection := getTsnetConnection
+	getTsnetConnection = func(config *tailscale.TsnetConnConfig) (*tsnet.Server, error) {
+		connections.Add(1)
+		time.Sleep(10 * time.Millisecond)
+		return &tsnet.Server{}, nil
+	}
+	t.Cleanup(func() { getTsnetConnection = defaultGetTsnetConnection })
+
+	p := &FlyProvider{}
+	_, err := p.Initialize(provider.InitializeProviderRequest{BasePath: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Error initializing provider: %s", err)
+	}
+
+	var wg sync.WaitGroup
+	servers := make([]*tsnet.Server, 50)
+	for i := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			servers[i], _ = p.getTsnetConn()
+		}()
+	}
+	wg.Wait()
+
+	if connections.Load() != 1 {
+		t.Errorf("Expected a single tsnet connection to be created but got %d", connections.Load())
+	}
+	for _, server := range servers {
+		if server != servers[0] {
+			t.Fatalf("Expected all callers to share the same tsnet connection")
+		}
+	}
+}
+
+func TestCloseWithoutConnection(t *testing.T) {
+	p := &FlyProvider{}
+	if err := p.Close(); err != nil {
+		t.Errorf("Expected closing an unused provider to succeed but got error: %s", err)
+	}
+}
+
+func TestCloseRemovesTsnetDir(t *testing.T) {
+	defaultGetTsnetConnection := getTsnetConnection
+	getTsnetConnection = func(config *tailscale.TsnetConnConfig) (*tsnet.Server, error) {
+		return &tsnet.Server{}, os.MkdirAll(config.Dir, 0755)
+	}
+	t.Cleanup(func() { getTsnetConnection = defaultGetTsnetConnection })
+
+	p := &FlyProvider{}
+	_, err := p.Initialize(provider.InitializeProviderRequest{BasePath: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Error initializing provider: %s", err)
+	}
+
+	if _, err := p.getTsnetConn(); err != nil {
+		t.Fatalf("Error getting tsnet connection: %s", err)
+	}
+	tsnetDir := p.tsnetDir
+
+	for i := 0; i < 2; i++ {
+		if err := p.Close(); err != nil {
+			t.Errorf("Expected close %d to succeed but got error: %s", i+1, err)
+		}
+	}
+
+	if _, err := os.Stat(tsnetDir); !os.IsNotExist(err) {
+		t.Errorf("Expected tsnet dir %s to be removed", tsnetDir)
+	}
+}
+
+func TestResetTsnetConnRemovesTsnetDir(t *testing.T) {
+	defaultGetTsnetConnection := getTsnetConnection
+	getTsnetConnection = func(config *tailscale.TsnetConnConfig) (*tsnet.Server, error) {
+		return &tsnet.Server{}, os.MkdirAll(config.Dir, 0755)
+	}
+	t.Cleanup(func() { getTsnetConnection = defaultGetTsnetConnection })
+
+	p := &FlyProvider{}
+	_, err := p.Initialize(provider.InitializeProviderRequest{BasePath: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Error initializing provider: %s", err)
+	}
+	t.Cleanup(func() { p.Close() })
+
+	stale, err := p.getTsnetConn()
+	if err != nil {
+		t.Fatalf("Error getting tsnet connection: %s", err)
+	}
+	staleDir := p.tsnetDir
+
+	p.resetTsnetConn(stale)
+	if _, err := os.Stat(staleDir); !os.IsNotExist(err) {
+		t.Errorf("Expected tsnet dir %s of the stale connection to be removed", staleDir)
+	}
+
+	current, err := p.getTsnetConn()
+	if err != nil {
+		t.Fatalf("Error getting tsnet connection: %s", err)
+	}
+	if current == stale {
+		t.Fatalf("Expected a new tsnet connection after the reset")
+	}
+
+	// A caller still holding the stale connection does not reset the new one
+	p.resetTsnetConn(stale)
+	if p.tsnetConn != current {
+		t.Errorf("Expected the new tsnet connection to be kept")
+	}
+	if _, err := os.Stat(p.tsnetDir); err != nil {
+		t.Errorf("Expected tsnet dir of the new connection to be kept but got %v", err)
+	}
+}
+
+func TestWaitForAgentHealth(t *testing.T) {
+	checks := 0
+	err := waitForAgentHealth(context.Background(), 5*time.Second, func() error {
+		checks++
+		if checks < 2 {
+			return errors.New("session refused")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Expected agent to become healthy but got error: %s", err)
+	}
+	if checks != 2 {
+		t.Errorf("Expected 2 health checks but got %d", checks)
+	}
+
+	err = waitForAgentHealth(context.Background(), 0, func() error {
+		return errors.New("session refused")
+	})
+	if !errors.Is(err, errAgentUnhealthy) {
+		t.Errorf("Expected agent unhealthy error but got: %v", err)
+	}
+	if errors.Is(err, errPortNeverOpened) {
+		t.Errorf("Expected agent unhealthy error to be distinct from port never opened")
+	}
+}
+
+func TestWaitsStopOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	var dials atomic.Int32
+	start := time.Now()
+	err := waitForHostDial(ctx, "a", time.Minute, func(host string) error {
+		dials.Add(1)
+		return errors.New("connection refused")
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected dialing to stop with context.Canceled but got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected dialing to stop right after the cancel but it took %s", elapsed)
+	}
+
+	// No dial goroutine keeps retrying once the wait returned
+	dialsAfterReturn := dials.Load()
+	time.Sleep(1200 * time.Millisecond)
+	if dials.Load() != dialsAfterReturn {
+		t.Errorf("Expected no dials after the wait returned but got %d", dials.Load()-dialsAfterReturn)
+	}
+
+	err = waitForAgentHealth(ctx, time.Minute, func() error {
+		return errors.New("session refused")
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the agent health wait to stop with context.Canceled but got: %v", err)
+	}
+}
+
+func TestProbeDocker(t *testing.T) {
+	target := &models.Target{Id: "123"}
+
+	err := probeDocker(context.Background(), target, &types.TargetOptions{}, func(ctx context.Context) error {
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Expected a reachable docker daemon but got error: %s", err)
+	}
+
+	cases := []struct {
+		name     string
+		opts     *types.TargetOptions
+		expected string
+	}{
+		{"Tailnet", &types.TargetOptions{}, "docker daemon of target 123 not reachable over the tailnet"},
+		{"Private", &types.TargetOptions{ConnectionMode: types.ConnectionModePrivate}, "not reachable over the fly private network"},
+		{"External docker host", &types.TargetOptions{DockerHost: "tcp://docker.internal:2375"}, "not reachable at tcp://docker.internal:2375"},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			err := probeDocker(context.Background(), target, testCase.opts, func(ctx context.Context) error {
+				return errors.New("connection refused")
+			})
+			if !errors.Is(err, errDockerUnreachable) {
+				t.Fatalf("Expected errDockerUnreachable but got: %v", err)
+			}
+			if !strings.Contains(err.Error(), testCase.expected) || !strings.Contains(err.Error(), "connection refused") {
+				t.Errorf("Expected error to contain %q and the ping error but got: %s", testCase.expected, err)
+			}
+		})
+	}
+}
+
+func TestGetDockerHost(t *testing.T) {
+	target := &models.Target{Id: "123"}
+
+	cases := []struct {
+		name       string
+		mode       string
+		dockerHost string
+		expected   string
+	}{
+		{"Tailnet", types.ConnectionModeTailnet, "", "tcp://123:2375"},
+		{"Private", types.ConnectionModePrivate, "", "tcp://daytona-123.internal:2375"},
+		{"External docker host", types.ConnectionModeTailnet, "tcp://docker.internal:2376", "tcp://docker.internal:2376"},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			host := getDockerHost(target, &types.TargetOptions{ConnectionMode: testCase.mode, DockerHost: testCase.dockerHost})
+			if host != testCase.expected {
+				t.Errorf("Expected docker host %s but got %s", testCase.expected, host)
+			}
+		})
+	}
+}
+
+func TestGetDockerApiClientPinnedVersion(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	}))
+	t.Cleanup(server.Close)
+
+	target := &models.Target{
+		Id: "123",
+		TargetConfig: models.TargetConfig{
+			Options: `{"Org Slug":"org","Auth Token":"token","Docker Host":"tcp://` + server.Listener.Addr().String() + `","Docker Api Version":"1.45","No Persistent Disk":true}`,
+		},
+	}
+
+	cli, err := (&FlyProvider{}).getDockerApiClient(target)
+	if err != nil {
+		t.Fatalf("Expected a docker client but got error: %v", err)
+	}
+	defer cli.Close()
+
+	if version := cli.ClientVersion(); version != "1.45" {
+		t.Errorf("Expected the pinned version 1.45 but got %s", version)
+	}
+
+	_, err = cli.Info(context.Background())
+	if err != nil {
+		t.Fatalf("Expected the info request to succeed but got error: %v", err)
+	}
+	// A pinned version skips the negotiation ping
+	if len(paths) != 1 || paths[0] != "/v1.45/info" {
+		t.Errorf("Expected a single request to /v1.45/info but got %v", paths)
+	}
+}
+
+func TestGetSshSessionConfig(t *testing.T) {
+	cases := []struct {
+		name            string
+		sshPort         int
+		expectedPort    int
+		expectedAddress string
+	}{
+		{"Default port", 0, config.SSH_PORT, net.JoinHostPort("target", strconv.Itoa(config.SSH_PORT))},
+		{"Overridden port", 2222, 2222, "target:2222"},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			p := &FlyProvider{SshPort: testCase.sshPort}
+
+			sessionConfig := p.getSshSessionConfig("target")
+			if sessionConfig.Hostname != "target" || sessionConfig.Port != testCase.expectedPort {
+				t.Errorf("Expected session config for target:%d but got %s:%d", testCase.expectedPort, sessionConfig.Hostname, sessionConfig.Port)
+			}
+			if address := p.getSshAddress("target"); address != testCase.expectedAddress {
+				t.Errorf("Expected dial address %s but got %s", testCase.expectedAddress, address)
+			}
+		})
+	}
+}
+
+func TestInitializeInvalidSshPort(t *testing.T) {
+	p := &FlyProvider{SshPort: 70000}
+
+	_, err := p.Initialize(provider.InitializeProviderRequest{})
+	if err == nil {
+		t.Errorf("Expected an invalid ssh port to be rejected")
+	}
+}
@@ -0,0 +1,145 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	flyutil "github.com/daytonaio/daytona-provider-fly/pkg/provider/util"
+	"github.com/daytonaio/daytona-provider-fly/pkg/types"
+	"github.com/daytonaio/daytona/pkg/provider"
+	"github.com/superfly/fly-go"
+)
+
+// healthCheckTimeout bounds each probe of GetTargetHealth.
+const healthCheckTimeout = 5 * time.Second
+
+// healthProbe is a named check of a target's health.
+type healthProbe struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// GetTargetHealth probes the machine state, the tailnet dial, the Docker daemon and the agent of the target,
+// so a status indicator can be shown without fetching the full provider metadata.
+// Each probe is bounded by its own timeout and reported separately. Errors of the probes are part of the
+// result; only invalid target options are returned as an error.
+func (p *FlyProvider) GetTargetHealth(targetReq *provider.TargetRequest) (*types.TargetHealth, error) {
+	target := targetReq.Target
+	targetOptions, err := types.ParseTargetOptions(target.TargetConfig.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	var machineStateMu sync.Mutex
+	var machineState string
+	machineProbe := healthProbe{name: "machine", check: func(ctx context.Context) error {
+		machine, err := flyutil.GetMachine(target, targetOptions)
+		if err != nil {
+			return err
+		}
+
+		machineStateMu.Lock()
+		machineState = machine.State
+		machineStateMu.Unlock()
+
+		if machine.State != fly.MachineStateStarted {
+			return fmt.Errorf("machine is %s", machine.State)
+		}
+		return nil
+	}}
+
+	probes := []healthProbe{
+		{name: "dial", check: func(ctx context.Context) error {
+			tsnetConn, err := p.getTsnetConn()
+			if err != nil {
+				return err
+			}
+			conn, err := tsnetConn.Dial(ctx, "tcp", p.getSshAddress(target.Id))
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		}},
+		{name: "docker", check: func(ctx context.Context) error {
+			cli, err := p.getDockerApiClient(target)
+			if err != nil {
+				return err
+			}
+			defer cli.Close()
+			_, err = cli.Ping(ctx)
+			return err
+		}},
+		{name: "agent", check: func(ctx context.Context) error {
+			return p.checkAgentHealth(target.Id)
+		}},
+	}
+
+	health := checkTargetHealth(healthCheckTimeout, machineProbe, probes)
+
+	machineStateMu.Lock()
+	health.MachineState = machineState
+	machineStateMu.Unlock()
+
+	return &health, nil
+}
+
+// checkTargetHealth runs the machine probe and then the other probes in parallel. The other probes are
+// skipped if the machine probe fails, as nothing on the machine can answer.
+func checkTargetHealth(timeout time.Duration, machineProbe healthProbe, probes []healthProbe) types.TargetHealth {
+	machineCheck := runHealthProbe(timeout, machineProbe)
+	health := types.TargetHealth{Checks: []types.HealthCheck{machineCheck}}
+
+	if machineCheck.Status != types.HealthCheckOk {
+		for _, probe := range probes {
+			health.Checks = append(health.Checks, types.HealthCheck{Name: probe.name, Status: types.HealthCheckSkipped, Error: "machine is not running"})
+		}
+		health.Status = types.HealthRed
+		return health
+	}
+
+	checks := make([]types.HealthCheck, len(probes))
+	var wg sync.WaitGroup
+	for i, probe := range probes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checks[i] = runHealthProbe(timeout, probe)
+		}()
+	}
+	wg.Wait()
+
+	health.Checks = append(health.Checks, checks...)
+	health.Status = types.HealthGreen
+	for _, check := range checks {
+		if check.Status != types.HealthCheckOk {
+			health.Status = types.HealthYellow
+		}
+	}
+	return health
+}
+
+// runHealthProbe runs the probe and reports it as failed if it does not finish within the timeout.
+// Probes that don't observe the context finish in the background after the timeout.
+func runHealthProbe(timeout time.Duration, probe healthProbe) types.HealthCheck {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- probe.check(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-errCh:
+	case <-ctx.Done():
+		err = fmt.Errorf("timeout after %s", timeout)
+	}
+
+	if err != nil {
+		return types.HealthCheck{Name: probe.name, Status: types.HealthCheckFailed, Error: err.Error()}
+	}
+	return types.HealthCheck{Name: probe.name, Status: types.HealthCheckOk}
+}
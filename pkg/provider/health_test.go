@@ -0,0 +1,93 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/daytonaio/daytona-provider-fly/pkg/types"
+)
+
+func TestCheckTargetHealth(t *testing.T) {
+	ok := func(ctx context.Context) error { return nil }
+	fail := func(ctx context.Context) error { return errors.New("connection refused") }
+
+	// hang ignores the context, so the probe can only end through the timeout
+	release := make(chan struct{})
+	defer close(release)
+	hang := func(ctx context.Context) error {
+		<-release
+		return nil
+	}
+
+	cases := []struct {
+		name             string
+		machine          func(ctx context.Context) error
+		dial             func(ctx context.Context) error
+		docker           func(ctx context.Context) error
+		agent            func(ctx context.Context) error
+		expectedStatus   string
+		expectedStatuses []string
+	}{
+		{
+			name:             "All checks pass",
+			machine:          ok,
+			dial:             ok,
+			docker:           ok,
+			agent:            ok,
+			expectedStatus:   types.HealthGreen,
+			expectedStatuses: []string{types.HealthCheckOk, types.HealthCheckOk, types.HealthCheckOk, types.HealthCheckOk},
+		},
+		{
+			name:             "Docker fails and agent hangs",
+			machine:          ok,
+			dial:             ok,
+			docker:           fail,
+			agent:            hang,
+			expectedStatus:   types.HealthYellow,
+			expectedStatuses: []string{types.HealthCheckOk, types.HealthCheckOk, types.HealthCheckFailed, types.HealthCheckFailed},
+		},
+		{
+			name:             "Machine not running",
+			machine:          fail,
+			dial:             hang,
+			docker:           hang,
+			agent:            hang,
+			expectedStatus:   types.HealthRed,
+			expectedStatuses: []string{types.HealthCheckFailed, types.HealthCheckSkipped, types.HealthCheckSkipped, types.HealthCheckSkipped},
+		},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			probes := []healthProbe{
+				{name: "dial", check: testCase.dial},
+				{name: "docker", check: testCase.docker},
+				{name: "agent", check: testCase.agent},
+			}
+
+			start := time.Now()
+			health := checkTargetHealth(50*time.Millisecond, healthProbe{name: "machine", check: testCase.machine}, probes)
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("Expected the probes to be bounded by their timeout but took %s", elapsed)
+			}
+
+			if health.Status != testCase.expectedStatus {
+				t.Errorf("Expected status %s but got %s", testCase.expectedStatus, health.Status)
+			}
+
+			if len(health.Checks) != len(testCase.expectedStatuses) {
+				t.Fatalf("Expected %d checks but got %+v", len(testCase.expectedStatuses), health.Checks)
+			}
+			for i, check := range health.Checks {
+				if check.Status != testCase.expectedStatuses[i] {
+					t.Errorf("Expected check %s to be %s but got %s", check.Name, testCase.expectedStatuses[i], check.Status)
+				}
+				if check.Status != types.HealthCheckOk && check.Error == "" {
+					t.Errorf("Expected check %s to report an error", check.Name)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package provider
+
+import "sync"
+
+// targetLocks serializes operations on the same target, while operations on different targets run in parallel.
+// The zero value is ready to use.
+type targetLocks struct {
+	mu    sync.Mutex
+	locks map[string]*targetLock
+}
+
+type targetLock struct {
+	mu sync.Mutex
+	// refs is the number of callers holding or waiting for the lock, guarded by targetLocks.mu
+	refs int
+}
+
+// lock blocks until the lock of the target is acquired and returns the function releasing it.
+func (l *targetLocks) lock(targetId string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = map[string]*targetLock{}
+	}
+	lock, ok := l.locks[targetId]
+	if !ok {
+		lock = &targetLock{}
+		l.locks[targetId] = lock
+	}
+	lock.refs++
+	l.mu.Unlock()
+
+	lock.mu.Lock()
+
+	return func() {
+		lock.mu.Unlock()
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(l.locks, targetId)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package provider
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTargetLocks(t *testing.T) {
+	var locks targetLocks
+
+	// Operations on the same target never overlap
+	var active atomic.Int32
+	var overlapped atomic.Bool
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := locks.lock("target-1")
+			defer unlock()
+
+			if active.Add(1) > 1 {
+				overlapped.Store(true)
+			}
+			time.Sleep(10 * time.Millisecond)
+			active.Add(-1)
+		}()
+	}
+	wg.Wait()
+
+	if overlapped.Load() {
+		t.Errorf("Expected operations on the same target to be serialized")
+	}
+
+	// Operations on another target proceed while a target is locked
+	unlock := locks.lock("target-1")
+	acquired := make(chan struct{})
+	go func() {
+		unlockOther := locks.lock("target-2")
+		defer unlockOther()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Errorf("Expected the lock of another target to be acquired while target-1 is locked")
+	}
+	unlock()
+
+	locks.mu.Lock()
+	defer locks.mu.Unlock()
+	if len(locks.locks) != 0 {
+		t.Errorf("Expected released locks to be removed but got %d", len(locks.locks))
+	}
+}
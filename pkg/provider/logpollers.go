@@ -0,0 +1,87 @@
+package provider
+
+import (
+	"context"
+	"sync"
+)
+
+// logPollers tracks the running log pollers by target id, so they can be stopped when the target is
+// destroyed or on demand. Each target has at most one poller. The zero value is ready to use.
+type logPollers struct {
+	mu      sync.Mutex
+	pollers map[string]*logPoller
+}
+
+type logPoller struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// start runs poll in the background until it returns, the context is cancelled or the poller is stopped.
+// A poller already running for the target is stopped first. The returned function stops this poller
+// and waits for it to exit.
+func (l *logPollers) start(ctx context.Context, targetId string, poll func(ctx context.Context)) func() {
+	l.stop(targetId)
+
+	pollCtx, cancel := context.WithCancel(ctx)
+	poller := &logPoller{cancel: cancel, done: make(chan struct{})}
+
+	l.mu.Lock()
+	if l.pollers == nil {
+		l.pollers = map[string]*logPoller{}
+	}
+	l.pollers[targetId] = poller
+	l.mu.Unlock()
+
+	go func() {
+		defer close(poller.done)
+		poll(pollCtx)
+	}()
+
+	return func() {
+		l.mu.Lock()
+		if l.pollers[targetId] == poller {
+			delete(l.pollers, targetId)
+		}
+		l.mu.Unlock()
+
+		poller.stop()
+	}
+}
+
+// stop stops the poller of the target and waits for it to exit. It does nothing if none is running.
+func (l *logPollers) stop(targetId string) {
+	l.mu.Lock()
+	poller, ok := l.pollers[targetId]
+	delete(l.pollers, targetId)
+	l.mu.Unlock()
+
+	if ok {
+		poller.stop()
+	}
+}
+
+// stopAll stops all running pollers and waits for them to exit.
+func (l *logPollers) stopAll() {
+	l.mu.Lock()
+	pollers := l.pollers
+	l.pollers = nil
+	l.mu.Unlock()
+
+	for _, poller := range pollers {
+		poller.stop()
+	}
+}
+
+// running reports whether a poller is running for the target.
+func (l *logPollers) running(targetId string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.pollers[targetId]
+	return ok
+}
+
+func (p *logPoller) stop() {
+	p.cancel()
+	<-p.done
+}
@@ -0,0 +1,58 @@
+package provider
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLogPollers(t *testing.T) {
+	var pollers logPollers
+
+	// poll blocks until its context is cancelled and reports when it has terminated
+	startPoller := func(targetId string) (func(), <-chan struct{}) {
+		terminated := make(chan struct{})
+		stop := pollers.start(context.Background(), targetId, func(ctx context.Context) {
+			defer close(terminated)
+			<-ctx.Done()
+		})
+		return stop, terminated
+	}
+	assertTerminated := func(name string, terminated <-chan struct{}) {
+		t.Helper()
+		select {
+		case <-terminated:
+		case <-time.After(time.Second):
+			t.Errorf("Expected the %s poller to terminate", name)
+		}
+	}
+
+	stop, terminated := startPoller("target-1")
+	if !pollers.running("target-1") {
+		t.Fatalf("Expected a poller to be running for target-1")
+	}
+
+	stop()
+	assertTerminated("stopped", terminated)
+	if pollers.running("target-1") {
+		t.Errorf("Expected no poller to be running for target-1 after it was stopped")
+	}
+
+	// Starting a poller for a target replaces the running one
+	_, replaced := startPoller("target-1")
+	stopOther, other := startPoller("target-2")
+	_, current := startPoller("target-1")
+	assertTerminated("replaced", replaced)
+
+	// Stopping by target id only stops the poller of that target
+	pollers.stop("target-1")
+	assertTerminated("current", current)
+	if !pollers.running("target-2") {
+		t.Errorf("Expected the poller of target-2 to keep running")
+	}
+
+	pollers.stopAll()
+	assertTerminated("remaining", other)
+	// The stop function of a poller that was already stopped does nothing
+	stopOther()
+}
@@ -1,25 +1,28 @@
 package provider
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"path"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/daytonaio/daytona-provider-fly/internal"
 	logwriters "github.com/daytonaio/daytona-provider-fly/internal/log"
 	flyutil "github.com/daytonaio/daytona-provider-fly/pkg/provider/util"
 	"github.com/daytonaio/daytona-provider-fly/pkg/types"
-	"github.com/daytonaio/daytona/pkg/agent/ssh/config"
 	"github.com/daytonaio/daytona/pkg/docker"
 	"github.com/daytonaio/daytona/pkg/logs"
 	"github.com/daytonaio/daytona/pkg/models"
 	"github.com/daytonaio/daytona/pkg/provider"
 	"github.com/daytonaio/daytona/pkg/provider/util"
 	"github.com/daytonaio/daytona/pkg/ssh"
-	"github.com/daytonaio/daytona/pkg/tailscale"
+	"github.com/google/uuid"
 	"github.com/superfly/fly-go"
 	"tailscale.com/tsnet"
 )
@@ -36,7 +39,24 @@ type FlyProvider struct {
 	ServerPort         *uint32
 	TargetLogsDir      *string
 	WorkspaceLogsDir   *string
-	tsnetConn          *tsnet.Server
+	// ManifestNegotiator tailors the target config manifest to the Daytona server version.
+	// The full manifest is returned if it is nil.
+	ManifestNegotiator types.ManifestNegotiator
+	// ProgressFunc is called as each phase of CreateTarget and CreateWorkspace completes, see the
+	// phase names of the util package. It may be nil.
+	ProgressFunc flyutil.ProgressFunc
+	// SshPort is the port the agents of the targets listen on for SSH. The daytona default is used if it is 0.
+	SshPort   int
+	tsnetConn *tsnet.Server
+	tsnetDir  string
+	tsnetMu   sync.Mutex
+	// workspaceLocks serializes the setup of a target by its workspace operations, see lockTarget.
+	workspaceLocks targetLocks
+	// logPollers holds the log tails of the targets, see StartTargetLogTail.
+	logPollers logPollers
+	// createdTargetMetadata holds the metadata JSON of the targets created by this provider by target id,
+	// see storeTargetMetadata.
+	createdTargetMetadata sync.Map
 }
 
 // Initialize initializes the provider with the given configuration.
@@ -53,6 +73,10 @@ func (p *FlyProvider) Initialize(req provider.InitializeProviderRequest) (*util.
 	p.TargetLogsDir = &req.TargetLogsDir
 	p.WorkspaceLogsDir = &req.WorkspaceLogsDir
 
+	if p.SshPort < 0 || p.SshPort > 65535 {
+		return nil, fmt.Errorf("invalid ssh port %d, must be between 1 and 65535", p.SshPort)
+	}
+
 	return new(util.Empty), nil
 }
 
@@ -64,15 +88,38 @@ func (p *FlyProvider) GetInfo() (models.ProviderInfo, error) {
 		Label:                &label,
 		Name:                 "fly-provider",
 		Version:              internal.Version,
-		TargetConfigManifest: *types.GetTargetConfigManifest(),
+		TargetConfigManifest: *p.getTargetConfigManifest(),
 	}, nil
 }
 
+// getTargetConfigManifest returns the target config manifest negotiated for the version of the Daytona
+// server that initialized the provider. GetInfo may be called before Initialize, in which case the
+// version is unknown.
+func (p *FlyProvider) getTargetConfigManifest() *models.TargetConfigManifest {
+	negotiator := p.ManifestNegotiator
+	if negotiator == nil {
+		negotiator = types.FullManifest{}
+	}
+
+	var serverVersion string
+	if p.DaytonaVersion != nil {
+		serverVersion = *p.DaytonaVersion
+	}
+	return negotiator.Manifest(serverVersion)
+}
+
 func (p *FlyProvider) GetPresetTargetConfigs() (*[]provider.TargetConfig, error) {
-	return new([]provider.TargetConfig), nil
+	presets := types.GetPresetTargetConfigs()
+	return &presets, nil
 }
 
 func (p *FlyProvider) CreateTarget(targetReq *provider.TargetRequest) (*util.Empty, error) {
+	return p.CreateTargetContext(context.Background(), targetReq)
+}
+
+// CreateTargetContext creates the target like CreateTarget and aborts once the context is cancelled.
+// On abort the partially created app is deleted on a best-effort basis.
+func (p *FlyProvider) CreateTargetContext(ctx context.Context, targetReq *provider.TargetRequest) (_ *util.Empty, err error) {
 	if p.DaytonaDownloadUrl == nil {
 		return nil, errors.New("DaytonaDownloadUrl not set. Did you forget to call Initialize")
 	}
@@ -84,51 +131,152 @@ func (p *FlyProvider) CreateTarget(targetReq *provider.TargetRequest) (*util.Emp
 		logWriter.Write([]byte("Failed to parse target options: " + err.Error() + "\n"))
 		return nil, err
 	}
+	types.WarnIfUnprefixedToken(targetOptions.AuthToken)
 
-	initScript := fmt.Sprintf(`apk add --no-cache curl bash && \ 
-	curl -sfL -H "Authorization: Bearer %s" %s | bash`,
+	initScript := fmt.Sprintf(`curl -sfL -H "Authorization: Bearer %s" %s | bash`,
 		targetReq.Target.ApiKey,
-		*p.DaytonaDownloadUrl,
+		p.getDaytonaDownloadUrl(targetOptions),
 	)
 
-	machine, err := flyutil.CreateTarget(targetReq.Target, targetOptions, initScript)
+	if targetOptions.Region == "" {
+		region, err := flyutil.NearestRegion(targetOptions)
+		if err != nil {
+			logWriter.Write([]byte("Failed to resolve nearest region: " + err.Error() + "\n"))
+			return nil, err
+		}
+		targetOptions.Region = region
+		logWriter.Write([]byte("Region not set, using nearest region " + region + "\n"))
+	}
+
+	err = flyutil.ValidateSizeRegion(targetOptions)
+	if errors.Is(err, flyutil.ErrSizeNotAvailable) {
+		logWriter.Write([]byte(err.Error() + "\n"))
+		return nil, err
+	}
+	if err != nil {
+		// The launch reports unavailable sizes as well, so a failed check does not block the create
+		logWriter.Write([]byte("Failed to check the availability of the machine size: " + err.Error() + "\n"))
+	}
+
+	estimate, err := flyutil.EstimateCost(targetOptions)
+	if err == nil {
+		logWriter.Write([]byte(estimate.String() + "\n"))
+	}
+
+	if targetOptions.DryRun {
+		logWriter.Write([]byte(flyutil.PlanTarget(targetReq.Target, targetOptions, initScript)))
+		return new(util.Empty), nil
+	}
+
+	timings := flyutil.NewPhaseTimings(logWriter)
+	timings.SetProgressFunc(p.ProgressFunc)
+	createStart := time.Now()
+	defer func() {
+		logWriter.Write([]byte(fmt.Sprintf("CreateTarget timings: %s total=%s\n", timings, time.Since(createStart).Round(time.Millisecond))))
+	}()
+
+	machine, err := flyutil.CreateTarget(ctx, targetReq.Target, targetOptions, initScript, timings)
 	if err != nil {
 		logWriter.Write([]byte("Failed to create target: " + err.Error() + "\n"))
 		return nil, err
 	}
 
-	go func() {
-		if err := flyutil.GetTargetLogs(targetReq.Target, targetOptions, machine.ID, logWriter); err != nil {
-			logWriter.Write([]byte(err.Error()))
-			defer cleanupFunc()
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			logWriter.Write([]byte("Target creation cancelled, deleting the target app\n"))
+			if deleteErr := flyutil.DeleteTarget(targetReq.Target, targetOptions); deleteErr != nil {
+				logWriter.Write([]byte("Failed to delete the target app: " + deleteErr.Error() + "\n"))
+			}
 		}
 	}()
 
-	err = p.waitForDial(targetReq.Target.Id, 5*time.Minute)
+	// The machine logs are streamed until the target is created, so they never outlive the log writer
+	stopLogs := p.logPollers.start(ctx, targetReq.Target.Id, func(ctx context.Context) {
+		if err := flyutil.StreamTargetLogs(ctx, targetReq.Target, targetOptions, machine.ID, logWriter); err != nil {
+			logWriter.Write([]byte(err.Error() + "\n"))
+		}
+	})
+	defer stopLogs()
+
+	waitForDialDone := timings.Track(flyutil.PhaseWaitForDial)
+	err = p.waitForDial(ctx, targetReq.Target.Id, 5*time.Minute)
 	if err != nil {
+		err = fmt.Errorf("%w: %w", errPortNeverOpened, err)
+		// The agent never starts when the machine script gives up waiting for Docker, which the machine logs tell apart
+		if timedOut, logsErr := flyutil.DockerStartTimedOut(ctx, targetReq.Target, targetOptions, machine.ID, createStart); logsErr == nil && timedOut {
+			err = fmt.Errorf("%w, see the machine logs: %w", flyutil.ErrDockerNotReady, err)
+		}
 		logWriter.Write([]byte("Failed to dial: " + err.Error() + "\n"))
 		return nil, err
 	}
+
+	err = p.waitForAgent(ctx, targetReq.Target.Id, time.Minute)
+	if err != nil {
+		logWriter.Write([]byte("Agent health check failed: " + err.Error() + "\n"))
+		return nil, err
+	}
+	waitForDialDone()
 	logWriter.Write([]byte("target agent started.\n"))
 
-	client, err := p.getDockerClient(targetReq.Target.Id)
+	if targetOptions.ReadyWebhookUrl != "" {
+		correlationId := uuid.NewString()
+		err = notifyReadyWebhook(targetOptions.ReadyWebhookUrl, readyWebhookPayload{
+			TargetId:      targetReq.Target.Id,
+			MachineId:     machine.ID,
+			Region:        machine.Region,
+			CorrelationId: correlationId,
+		})
+		if err != nil {
+			// The webhook is informational, a failure must not fail the target creation
+			logWriter.Write([]byte("Failed to notify ready webhook: " + err.Error() + "\n"))
+		} else {
+			logWriter.Write([]byte("Ready webhook notified with correlation id " + correlationId + "\n"))
+		}
+	}
+
+	client, err := p.getDockerClient(targetReq.Target)
 	if err != nil {
 		logWriter.Write([]byte("Failed to get client: " + err.Error() + "\n"))
 		return nil, err
 	}
 
 	targetDir := p.getTargetDir(targetReq.Target.Id)
-	sshClient, err := tailscale.NewSshClient(p.tsnetConn, &ssh.SessionConfig{
-		Hostname: targetReq.Target.Id,
-		Port:     config.SSH_PORT,
-	})
+	sshClient, err := p.getSshClient(targetReq.Target.Id)
 	if err != nil {
 		logWriter.Write([]byte("Failed to create ssh client: " + err.Error() + "\n"))
 		return new(util.Empty), err
 	}
 	defer sshClient.Close()
 
-	return new(util.Empty), client.CreateTarget(targetReq.Target, targetDir, logWriter, sshClient)
+	dockerTargetCreateDone := timings.Track(flyutil.PhaseDockerTargetCreate)
+	err = client.CreateTarget(targetReq.Target, targetDir, logWriter, sshClient)
+	if err != nil {
+		return new(util.Empty), err
+	}
+	dockerTargetCreateDone()
+
+	err = p.storeTargetMetadata(targetReq.Target, machine)
+	if err != nil {
+		logWriter.Write([]byte("Failed to store target metadata: " + err.Error() + "\n"))
+		return new(util.Empty), err
+	}
+
+	return new(util.Empty), nil
+}
+
+// storeTargetMetadata sets the provider metadata of the target from the machine returned by the launch.
+// Fly lists a new machine with a delay, so GetTargetProviderMetadata returns the stored metadata until the
+// machine is listed and callers can read the metadata right after the create.
+func (p *FlyProvider) storeTargetMetadata(target *models.Target, machine *fly.Machine) error {
+	jsonMetadata, err := json.Marshal(getTargetMetadata(machine, nil))
+	if err != nil {
+		return err
+	}
+
+	metadata := string(jsonMetadata)
+	p.createdTargetMetadata.Store(target.Id, metadata)
+	target.ProviderMetadata = &metadata
+	return nil
 }
 
 func (p *FlyProvider) StartTarget(targetReq *provider.TargetRequest) (*util.Empty, error) {
@@ -141,9 +289,37 @@ func (p *FlyProvider) StartTarget(targetReq *provider.TargetRequest) (*util.Empt
 		return nil, err
 	}
 
-	return new(util.Empty), flyutil.StartTarget(targetReq.Target, targetOptions)
+	err = flyutil.StartTarget(targetReq.Target, targetOptions)
+	if err != nil {
+		logWriter.Write([]byte("Failed to start target: " + err.Error() + "\n"))
+		return nil, err
+	}
+
+	err = waitForReadiness(targetOptions.StartReadiness, map[string]func() error{
+		types.StartReadinessDial: func() error {
+			err := p.waitForDial(context.Background(), targetReq.Target.Id, 5*time.Minute)
+			if err != nil {
+				return fmt.Errorf("%w: %w", errPortNeverOpened, err)
+			}
+			return nil
+		},
+		types.StartReadinessDocker: func() error {
+			return p.waitForDocker(targetReq.Target, time.Minute)
+		},
+		types.StartReadinessAgent: func() error {
+			return p.waitForAgent(context.Background(), targetReq.Target.Id, time.Minute)
+		},
+	})
+	if err != nil {
+		logWriter.Write([]byte("Target did not become ready: " + err.Error() + "\n"))
+		return nil, err
+	}
+
+	return new(util.Empty), nil
 }
 
+// StopTarget stops the machine of the target after giving its Docker containers the stop timeout of the
+// options to stop cleanly.
 func (p *FlyProvider) StopTarget(targetReq *provider.TargetRequest) (*util.Empty, error) {
 	logWriter, cleanupFunc := p.getTargetLogWriter(targetReq.Target.Id, targetReq.Target.Name)
 	defer cleanupFunc()
@@ -154,9 +330,25 @@ func (p *FlyProvider) StopTarget(targetReq *provider.TargetRequest) (*util.Empty
 		return nil, err
 	}
 
-	return new(util.Empty), flyutil.StopTarget(targetReq.Target, targetOptions)
+	stop := func() error {
+		return flyutil.StopTarget(targetReq.Target, targetOptions)
+	}
+
+	// Containers on an external Docker host keep running when the machine stops, and a machine that is not
+	// running has no daemon to drain
+	machine, err := flyutil.GetMachine(targetReq.Target, targetOptions)
+	if targetOptions.DockerHost != "" || err != nil || machine.State != fly.MachineStateStarted {
+		return new(util.Empty), stop()
+	}
+
+	grace := getStopGracePeriod(targetOptions)
+	drain := func(ctx context.Context) error {
+		return p.drainDocker(ctx, targetReq.Target, grace)
+	}
+	return new(util.Empty), stopGracefully(grace, drain, stop, logWriter)
 }
 
+// DestroyTarget deletes the fly app of the target, together with its machine and data volume.
 func (p *FlyProvider) DestroyTarget(targetReq *provider.TargetRequest) (*util.Empty, error) {
 	logWriter, cleanupFunc := p.getTargetLogWriter(targetReq.Target.Id, targetReq.Target.Name)
 	defer cleanupFunc()
@@ -167,6 +359,8 @@ func (p *FlyProvider) DestroyTarget(targetReq *provider.TargetRequest) (*util.Em
 		return nil, err
 	}
 
+	p.createdTargetMetadata.Delete(targetReq.Target.Id)
+	p.logPollers.stop(targetReq.Target.Id)
 	return new(util.Empty), flyutil.DeleteTarget(targetReq.Target, targetOptions)
 }
 
@@ -182,18 +376,26 @@ func (p *FlyProvider) GetTargetProviderMetadata(targetReq *provider.TargetReques
 
 	machine, err := flyutil.GetMachine(targetReq.Target, targetOptions)
 	if err != nil {
+		if metadata, ok := p.createdTargetMetadata.Load(targetReq.Target.Id); ok && errors.Is(err, flyutil.ErrMachineNotFound) {
+			return metadata.(string), nil
+		}
 		logWriter.Write([]byte("Failed to get machine: " + err.Error() + "\n"))
 		return "", err
 
 	}
-
-	metadata := types.TargetMetadata{
-		MachineId: machine.ID,
-		VolumeId:  machine.Config.Mounts[0].Volume,
-		IsRunning: machine.State == fly.MachineStateStarted,
-		Created:   machine.CreatedAt,
+	p.createdTargetMetadata.Delete(targetReq.Target.Id)
+
+	var volume *fly.Volume
+	if len(machine.Config.Mounts) > 0 {
+		volume, err = flyutil.GetVolume(targetReq.Target, targetOptions, machine.Config.Mounts[0].Volume)
+		if err != nil {
+			// Placement is informational only, report the rest of the metadata without it
+			logWriter.Write([]byte("Failed to get volume: " + err.Error() + "\n"))
+		}
 	}
 
+	metadata := getTargetMetadata(machine, volume)
+
 	jsonMetadata, err := json.Marshal(metadata)
 	if err != nil {
 		return "", err
@@ -202,27 +404,93 @@ func (p *FlyProvider) GetTargetProviderMetadata(targetReq *provider.TargetReques
 	return string(jsonMetadata), nil
 }
 
+// StartTargetLogTail streams the logs of the target machine to out in the background, replacing any log
+// tail of the target that is already running. The returned stop function ends the tail and waits for it
+// to finish, as does StopTargetLogTail and destroying the target.
+func (p *FlyProvider) StartTargetLogTail(targetReq *provider.TargetRequest, out io.Writer) (func(), error) {
+	targetOptions, err := types.ParseTargetOptions(targetReq.Target.TargetConfig.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	machine, err := flyutil.GetMachine(targetReq.Target, targetOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.logPollers.start(context.Background(), targetReq.Target.Id, func(ctx context.Context) {
+		if err := flyutil.StreamTargetLogs(ctx, targetReq.Target, targetOptions, machine.ID, out); err != nil {
+			out.Write([]byte("Failed to stream target logs: " + err.Error() + "\n"))
+		}
+	}), nil
+}
+
+// StopTargetLogTail stops the log tail of the target and waits for it to finish.
+// It does nothing if no log tail is running for the target.
+func (p *FlyProvider) StopTargetLogTail(targetId string) {
+	p.logPollers.stop(targetId)
+}
+
+// getTargetMetadata builds the target metadata from the machine and its volume.
+// The volume may be nil, in which case the placement zone and encryption are left empty.
+func getTargetMetadata(machine *fly.Machine, volume *fly.Volume) types.TargetMetadata {
+	metadata := types.TargetMetadata{
+		MachineId:      machine.ID,
+		Region:         machine.Region,
+		HostStatus:     machine.HostStatus,
+		PrivateIP:      machine.PrivateIP,
+		ImageDigest:    machine.ImageRef.Digest,
+		IsRunning:      machine.State == fly.MachineStateStarted,
+		Created:        machine.CreatedAt,
+		ConfigChecksum: machine.Config.Metadata[flyutil.ConfigChecksumMetadataKey],
+		ConfigDrift:    flyutil.HasConfigDrift(machine),
+	}
+
+	if len(machine.Config.Mounts) > 0 {
+		metadata.VolumeId = machine.Config.Mounts[0].Volume
+	}
+
+	if machine.ImageRef.Repository != "" {
+		metadata.Image = machine.FullImageRef()
+	}
+
+	if volume != nil {
+		metadata.Zone = volume.Zone
+		metadata.VolumeEncrypted = &volume.Encrypted
+	}
+
+	return metadata
+}
+
 func (p *FlyProvider) CreateWorkspace(workspaceReq *provider.WorkspaceRequest) (*util.Empty, error) {
 	logWriter, cleanupFunc := p.getWorkspaceLogWriter(workspaceReq.Workspace.Id, workspaceReq.Workspace.Name)
 	defer cleanupFunc()
 
-	dockerClient, err := p.getDockerClient(workspaceReq.Workspace.TargetId)
+	targetOptions, err := types.ParseTargetOptions(workspaceReq.Workspace.Target.TargetConfig.Options)
 	if err != nil {
-		logWriter.Write([]byte("Failed to get docker client: " + err.Error() + "\n"))
+		logWriter.Write([]byte("Failed to parse target options: " + err.Error() + "\n"))
 		return nil, err
 	}
 
-	sshClient, err := tailscale.NewSshClient(p.tsnetConn, &ssh.SessionConfig{
-		Hostname: workspaceReq.Workspace.TargetId,
-		Port:     config.SSH_PORT,
-	})
+	resources, err := targetOptions.WorkspaceResources(workspaceReq.Workspace.Labels)
+	if err != nil {
+		logWriter.Write([]byte("Invalid workspace resources: " + err.Error() + "\n"))
+		return nil, err
+	}
+
+	timings := flyutil.NewPhaseTimings(nil)
+	timings.SetProgressFunc(p.ProgressFunc)
+
+	dockerConnectDone := timings.Track(flyutil.PhaseDockerConnect)
+	dockerClient, sshClient, err := p.prepareWorkspaceTarget(workspaceReq, logWriter)
 	if err != nil {
-		logWriter.Write([]byte("Failed to create ssh client: " + err.Error() + "\n"))
 		return new(util.Empty), err
 	}
 	defer sshClient.Close()
+	dockerConnectDone()
 
-	return new(util.Empty), dockerClient.CreateWorkspace(&docker.CreateWorkspaceOptions{
+	workspaceCreateDone := timings.Track(flyutil.PhaseWorkspaceCreate)
+	err = dockerClient.CreateWorkspace(&docker.CreateWorkspaceOptions{
 		Workspace:           workspaceReq.Workspace,
 		WorkspaceDir:        p.getWorkspaceDir(workspaceReq),
 		ContainerRegistries: workspaceReq.ContainerRegistries,
@@ -231,6 +499,19 @@ func (p *FlyProvider) CreateWorkspace(workspaceReq *provider.WorkspaceRequest) (
 		Gpc:                 workspaceReq.GitProviderConfig,
 		SshClient:           sshClient,
 	})
+	if err != nil {
+		return new(util.Empty), err
+	}
+	workspaceCreateDone()
+
+	workspaceResourcesDone := timings.Track(flyutil.PhaseWorkspaceResources)
+	err = p.limitWorkspaceContainer(workspaceReq.Workspace, resources)
+	if err != nil {
+		return new(util.Empty), err
+	}
+	workspaceResourcesDone()
+
+	return new(util.Empty), nil
 }
 
 func (p *FlyProvider) StartWorkspace(workspaceReq *provider.WorkspaceRequest) (*util.Empty, error) {
@@ -240,18 +521,14 @@ func (p *FlyProvider) StartWorkspace(workspaceReq *provider.WorkspaceRequest) (*
 	logWriter, cleanupFunc := p.getWorkspaceLogWriter(workspaceReq.Workspace.Id, workspaceReq.Workspace.Name)
 	defer cleanupFunc()
 
-	dockerClient, err := p.getDockerClient(workspaceReq.Workspace.TargetId)
+	targetOptions, err := types.ParseTargetOptions(workspaceReq.Workspace.Target.TargetConfig.Options)
 	if err != nil {
-		logWriter.Write([]byte("Failed to get docker client: " + err.Error() + "\n"))
+		logWriter.Write([]byte("Failed to parse target options: " + err.Error() + "\n"))
 		return nil, err
 	}
 
-	sshClient, err := tailscale.NewSshClient(p.tsnetConn, &ssh.SessionConfig{
-		Hostname: workspaceReq.Workspace.TargetId,
-		Port:     config.SSH_PORT,
-	})
+	dockerClient, sshClient, err := p.prepareWorkspaceTarget(workspaceReq, logWriter)
 	if err != nil {
-		logWriter.Write([]byte("Failed to create ssh client: " + err.Error() + "\n"))
 		return new(util.Empty), err
 	}
 	defer sshClient.Close()
@@ -264,14 +541,59 @@ func (p *FlyProvider) StartWorkspace(workspaceReq *provider.WorkspaceRequest) (*
 		LogWriter:           logWriter,
 		Gpc:                 workspaceReq.GitProviderConfig,
 		SshClient:           sshClient,
-	}, *p.DaytonaDownloadUrl)
+	}, p.getDaytonaDownloadUrl(targetOptions))
+}
+
+// lockTarget blocks until no other workspace operation sets up the target and returns the function releasing it.
+// Operations on different targets run in parallel.
+func (p *FlyProvider) lockTarget(targetId string) func() {
+	return p.workspaceLocks.lock(targetId)
+}
+
+// prepareWorkspaceTarget connects to the Docker daemon and agent of the workspace target and creates the
+// target directory shared by its workspaces, holding the target lock so concurrent workspace operations
+// don't set up the target at the same time. Cloning, building and running the workspace happen after the
+// lock is released, so workspaces of the same target are created in parallel.
+func (p *FlyProvider) prepareWorkspaceTarget(workspaceReq *provider.WorkspaceRequest, logWriter io.Writer) (docker.IDockerClient, *ssh.Client, error) {
+	defer p.lockTarget(workspaceReq.Workspace.TargetId)()
+
+	dockerClient, err := p.getCheckedDockerClient(&workspaceReq.Workspace.Target)
+	if err != nil {
+		logWriter.Write([]byte("Failed to get docker client: " + err.Error() + "\n"))
+		return nil, nil, err
+	}
+
+	sshClient, err := p.getSshClient(workspaceReq.Workspace.TargetId)
+	if err != nil {
+		logWriter.Write([]byte("Failed to create ssh client: " + err.Error() + "\n"))
+		return nil, nil, err
+	}
+
+	err = sshClient.Exec(fmt.Sprintf("mkdir -p %s", p.getTargetDir(workspaceReq.Workspace.TargetId)), nil)
+	if err != nil {
+		sshClient.Close()
+		logWriter.Write([]byte("Failed to create target directory: " + err.Error() + "\n"))
+		return nil, nil, err
+	}
+
+	return dockerClient, sshClient, nil
+}
+
+// getDaytonaDownloadUrl returns the download URL of the daytona agent, preferring the target's override
+// to the URL of the Daytona server.
+func (p *FlyProvider) getDaytonaDownloadUrl(targetOptions *types.TargetOptions) string {
+	if targetOptions.DaytonaDownloadUrl != "" {
+		return targetOptions.DaytonaDownloadUrl
+	}
+
+	return *p.DaytonaDownloadUrl
 }
 
 func (p *FlyProvider) StopWorkspace(workspaceReq *provider.WorkspaceRequest) (*util.Empty, error) {
 	logWriter, cleanupFunc := p.getWorkspaceLogWriter(workspaceReq.Workspace.Id, workspaceReq.Workspace.Name)
 	defer cleanupFunc()
 
-	dockerClient, err := p.getDockerClient(workspaceReq.Workspace.TargetId)
+	dockerClient, err := p.getDockerClient(&workspaceReq.Workspace.Target)
 	if err != nil {
 		logWriter.Write([]byte("Failed to get docker client: " + err.Error() + "\n"))
 		return nil, err
@@ -280,20 +602,19 @@ func (p *FlyProvider) StopWorkspace(workspaceReq *provider.WorkspaceRequest) (*u
 	return new(util.Empty), dockerClient.StopWorkspace(workspaceReq.Workspace, logWriter)
 }
 
+// DestroyWorkspace removes the workspace container and directory from the target machine.
+// The target's data volume is shared by all of its workspaces and is never deleted here.
 func (p *FlyProvider) DestroyWorkspace(workspaceReq *provider.WorkspaceRequest) (*util.Empty, error) {
 	logWriter, cleanupFunc := p.getWorkspaceLogWriter(workspaceReq.Workspace.Id, workspaceReq.Workspace.Name)
 	defer cleanupFunc()
 
-	dockerClient, err := p.getDockerClient(workspaceReq.Workspace.TargetId)
+	dockerClient, err := p.getDockerClient(&workspaceReq.Workspace.Target)
 	if err != nil {
 		logWriter.Write([]byte("Failed to get docker client: " + err.Error() + "\n"))
 		return nil, err
 	}
 
-	sshClient, err := tailscale.NewSshClient(p.tsnetConn, &ssh.SessionConfig{
-		Hostname: workspaceReq.Workspace.TargetId,
-		Port:     config.SSH_PORT,
-	})
+	sshClient, err := p.getSshClient(workspaceReq.Workspace.TargetId)
 	if err != nil {
 		logWriter.Write([]byte("Failed to create ssh client: " + err.Error() + "\n"))
 		return new(util.Empty), err
@@ -307,13 +628,56 @@ func (p *FlyProvider) GetWorkspaceProviderMetadata(workspaceReq *provider.Worksp
 	logWriter, cleanupFunc := p.getWorkspaceLogWriter(workspaceReq.Workspace.Id, workspaceReq.Workspace.Name)
 	defer cleanupFunc()
 
-	dockerClient, err := p.getDockerClient(workspaceReq.Workspace.Target.Id)
+	dockerClient, err := p.getDockerClient(&workspaceReq.Workspace.Target)
 	if err != nil {
 		logWriter.Write([]byte("Failed to get docker client: " + err.Error() + "\n"))
 		return "", err
 	}
 
-	return dockerClient.GetWorkspaceProviderMetadata(workspaceReq.Workspace)
+	dockerMetadata, err := dockerClient.GetWorkspaceProviderMetadata(workspaceReq.Workspace)
+	if err != nil {
+		return "", err
+	}
+
+	// The fly placement is informational only, fall back to the docker metadata when it can't be fetched
+	target := &workspaceReq.Workspace.Target
+	targetOptions, err := types.ParseTargetOptions(target.TargetConfig.Options)
+	if err != nil {
+		logWriter.Write([]byte("Failed to parse target options: " + err.Error() + "\n"))
+		return dockerMetadata, nil
+	}
+
+	machine, err := flyutil.GetMachine(target, targetOptions)
+	if err != nil {
+		logWriter.Write([]byte("Failed to get machine: " + err.Error() + "\n"))
+		return dockerMetadata, nil
+	}
+
+	return mergeWorkspaceMetadata(dockerMetadata, types.WorkspaceFlyMetadata{
+		MachineId: machine.ID,
+		AppName:   flyutil.GetAppName(target, targetOptions),
+		Region:    machine.Region,
+	})
+}
+
+// mergeWorkspaceMetadata nests the fly placement under the fly key of the docker workspace metadata,
+// leaving the docker fields at the top level.
+func mergeWorkspaceMetadata(dockerMetadata string, flyMetadata types.WorkspaceFlyMetadata) (string, error) {
+	metadata := map[string]any{}
+	if dockerMetadata != "" {
+		err := json.Unmarshal([]byte(dockerMetadata), &metadata)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse docker workspace metadata: %w", err)
+		}
+	}
+	metadata["fly"] = flyMetadata
+
+	jsonMetadata, err := json.Marshal(metadata)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jsonMetadata), nil
 }
 
 func (p *FlyProvider) getTargetLogWriter(targetId, targetName string) (io.Writer, func()) {
@@ -371,5 +735,35 @@ func (p *FlyProvider) getWorkspaceDir(workspaceReq *provider.WorkspaceRequest) s
 
 func (a *FlyProvider) CheckRequirements() (*[]provider.RequirementStatus, error) {
 	results := []provider.RequirementStatus{}
+
+	// Tokens set in the target options are only known per target, so only the env token can be checked here
+	token, ok := os.LookupEnv("FLY_ACCESS_TOKEN")
+	if ok && strings.TrimSpace(token) != "" {
+		status := provider.RequirementStatus{Name: "Fly auth token", Met: true}
+		types.WarnIfUnprefixedToken(strings.TrimSpace(token))
+
+		err := flyutil.ValidateToken(&types.TargetOptions{AuthToken: strings.TrimSpace(token)})
+		if err != nil {
+			status.Met = false
+			status.Reason = "your Fly token looks invalid: " + err.Error()
+			if !errors.Is(err, flyutil.ErrInvalidAuth) {
+				status.Reason = "failed to validate the Fly token: " + err.Error()
+			}
+		}
+		results = append(results, status)
+
+		// The org is only known per target as well, unless it is set for fly tooling in the env
+		orgSlug := strings.TrimSpace(os.Getenv("FLY_ORG"))
+		if status.Met && orgSlug != "" {
+			status := provider.RequirementStatus{Name: "Fly org access", Met: true}
+			err := flyutil.ValidateOrg(&types.TargetOptions{OrgSlug: orgSlug, AuthToken: strings.TrimSpace(token)})
+			if err != nil {
+				status.Met = false
+				status.Reason = err.Error()
+			}
+			results = append(results, status)
+		}
+	}
+
 	return &results, nil
 }
@@ -1,14 +1,21 @@
 package provider
 
 import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
-	"time"
 
 	flyutil "github.com/daytonaio/daytona-provider-fly/pkg/provider/util"
 	"github.com/daytonaio/daytona-provider-fly/pkg/types"
 	"github.com/daytonaio/daytona/pkg/models"
 	"github.com/daytonaio/daytona/pkg/provider"
+	"github.com/daytonaio/daytona/pkg/tailscale"
+	"github.com/superfly/fly-go"
+	"tailscale.com/tsnet"
 )
 
 var (
@@ -37,11 +44,11 @@ func TestCreatetarget(t *testing.T) {
 }
 
 func TestDestroytarget(t *testing.T) {
+	// DestroyTarget only returns once the machine is gone, so no delay is needed before checking
 	_, err := flyProvider.DestroyTarget(targetReq)
 	if err != nil {
 		t.Fatalf("Error destroying target: %s", err)
 	}
-	time.Sleep(3 * time.Second)
 
 	_, err = flyutil.GetMachine(targetReq.Target, targetOptions)
 	if err == nil {
@@ -49,6 +56,275 @@ func TestDestroytarget(t *testing.T) {
 	}
 }
 
+func TestGetTargetMetadataPlacement(t *testing.T) {
+	machine := &fly.Machine{
+		ID:         "machine_1",
+		Region:     "lax",
+		State:      fly.MachineStateStarted,
+		HostStatus: "ok",
+		PrivateIP:  "fdaa:0:1:a7b:1::2",
+		Config: &fly.MachineConfig{
+			Mounts: []fly.MachineMount{{Volume: "vol_1"}},
+		},
+	}
+
+	testCases := []struct {
+		name              string
+		volume            *fly.Volume
+		expectedZone      string
+		expectedEncrypted *bool
+	}{
+		{"Volume with zone", &fly.Volume{ID: "vol_1", Zone: "a1b2", Encrypted: true}, "a1b2", fly.Pointer(true)},
+		{"Unencrypted volume", &fly.Volume{ID: "vol_1", Zone: "a1b2"}, "a1b2", fly.Pointer(false)},
+		{"Volume unavailable", nil, "", nil},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			metadata := getTargetMetadata(machine, testCase.volume)
+
+			jsonMetadata, err := json.Marshal(metadata)
+			if err != nil {
+				t.Fatalf("Failed to marshal metadata: %v", err)
+			}
+
+			var parsed types.TargetMetadata
+			if err := json.Unmarshal(jsonMetadata, &parsed); err != nil {
+				t.Fatalf("Failed to unmarshal metadata: %v", err)
+			}
+
+			if parsed.Zone != testCase.expectedZone {
+				t.Errorf("Expected zone %q but got %q", testCase.expectedZone, parsed.Zone)
+			}
+			if (parsed.VolumeEncrypted == nil) != (testCase.expectedEncrypted == nil) ||
+				(parsed.VolumeEncrypted != nil && *parsed.VolumeEncrypted != *testCase.expectedEncrypted) {
+				t.Errorf("Expected volume encrypted %v but got %v", testCase.expectedEncrypted, parsed.VolumeEncrypted)
+			}
+			if parsed.HostStatus != "ok" {
+				t.Errorf("Expected host status ok but got %q", parsed.HostStatus)
+			}
+			if parsed.PrivateIP != "fdaa:0:1:a7b:1::2" {
+				t.Errorf("Expected private IP fdaa:0:1:a7b:1::2 but got %q", parsed.PrivateIP)
+			}
+			if parsed.Region != "lax" || parsed.VolumeId != "vol_1" {
+				t.Errorf("Expected region lax and volume vol_1 but got %q and %q", parsed.Region, parsed.VolumeId)
+			}
+		})
+	}
+}
+
+func TestGetTargetMetadataImage(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	machine := &fly.Machine{
+		ID: "machine_1",
+		ImageRef: fly.MachineImageRef{
+			Registry:   "docker-hub-mirror.fly.io",
+			Repository: "library/docker",
+			Tag:        "dind",
+			Digest:     digest,
+		},
+		Config: &fly.MachineConfig{},
+	}
+
+	metadata := getTargetMetadata(machine, nil)
+
+	if metadata.ImageDigest != digest {
+		t.Errorf("Expected image digest %s but got %s", digest, metadata.ImageDigest)
+	}
+	if expected := "docker-hub-mirror.fly.io/library/docker:dind@" + digest; metadata.Image != expected {
+		t.Errorf("Expected image %s but got %s", expected, metadata.Image)
+	}
+}
+
+func TestGetTargetMetadataNoVolume(t *testing.T) {
+	machine := &fly.Machine{ID: "machine_1", Region: "lax", Config: &fly.MachineConfig{}}
+
+	metadata := getTargetMetadata(machine, nil)
+
+	if metadata.VolumeId != "" || metadata.Zone != "" {
+		t.Errorf("Expected no volume and zone but got %q and %q", metadata.VolumeId, metadata.Zone)
+	}
+
+	// The private IP is omitted until fly has assigned it
+	jsonMetadata, err := json.Marshal(metadata)
+	if err != nil {
+		t.Fatalf("Failed to marshal metadata: %v", err)
+	}
+	if strings.Contains(string(jsonMetadata), "PrivateIP") {
+		t.Errorf("Expected no private IP in the metadata but got %s", jsonMetadata)
+	}
+}
+
+func TestGetDaytonaDownloadUrl(t *testing.T) {
+	serverUrl := "https://daytona.example.com/get-server"
+	p := &FlyProvider{DaytonaDownloadUrl: &serverUrl}
+
+	if url := p.getDaytonaDownloadUrl(&types.TargetOptions{}); url != serverUrl {
+		t.Errorf("Expected the server download url %s but got %s", serverUrl, url)
+	}
+
+	mirrorUrl := "https://mirror.corp/daytona/get-server"
+	if url := p.getDaytonaDownloadUrl(&types.TargetOptions{DaytonaDownloadUrl: mirrorUrl}); url != mirrorUrl {
+		t.Errorf("Expected the target download url %s but got %s", mirrorUrl, url)
+	}
+}
+
+func TestMergeWorkspaceMetadata(t *testing.T) {
+	flyMetadata := types.WorkspaceFlyMetadata{MachineId: "machine_1", AppName: "daytona-123", Region: "lax"}
+
+	testCases := []struct {
+		name           string
+		dockerMetadata string
+		isValid        bool
+	}{
+		{"Docker metadata", `{"TargetId":"123","Running":true}`, true},
+		{"No docker metadata", "", true},
+		{"Invalid docker metadata", "not json", false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			merged, err := mergeWorkspaceMetadata(testCase.dockerMetadata, flyMetadata)
+			if !testCase.isValid {
+				if err == nil {
+					t.Errorf("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to merge metadata: %v", err)
+			}
+
+			var parsed struct {
+				TargetId string
+				Fly      types.WorkspaceFlyMetadata `json:"fly"`
+			}
+			if err := json.Unmarshal([]byte(merged), &parsed); err != nil {
+				t.Fatalf("Failed to unmarshal metadata: %v", err)
+			}
+
+			if parsed.Fly != flyMetadata {
+				t.Errorf("Expected fly metadata %+v but got %+v", flyMetadata, parsed.Fly)
+			}
+			if testCase.dockerMetadata != "" && parsed.TargetId != "123" {
+				t.Errorf("Expected docker metadata to stay at the top level but got %s", merged)
+			}
+		})
+	}
+}
+
+func TestGetContainerResources(t *testing.T) {
+	resources := getContainerResources(types.WorkspaceResources{Cpus: 2, MemoryMb: 512})
+	if resources.NanoCPUs != 2e9 {
+		t.Errorf("Expected 2e9 nano CPUs but got %d", resources.NanoCPUs)
+	}
+	if resources.Memory != 512*1024*1024 || resources.MemorySwap != resources.Memory {
+		t.Errorf("Expected memory and swap of 512MB but got %d and %d", resources.Memory, resources.MemorySwap)
+	}
+
+	unlimited := getContainerResources(types.WorkspaceResources{Cpus: 1})
+	if unlimited.Memory != 0 || unlimited.MemorySwap != 0 {
+		t.Errorf("Expected no memory limit but got %d", unlimited.Memory)
+	}
+}
+
+func TestGetTargetConfigManifestNegotiated(t *testing.T) {
+	serverVersion := "v0.20.0"
+	p := &FlyProvider{DaytonaVersion: &serverVersion}
+
+	if manifest := *p.getTargetConfigManifest(); len(manifest["Region"].Suggestions) == 0 {
+		t.Errorf("Expected the full manifest by default")
+	}
+
+	p.ManifestNegotiator = types.SuggestionsMinVersion("v0.30.0")
+	if manifest := *p.getTargetConfigManifest(); manifest["Region"].Suggestions != nil {
+		t.Errorf("Expected the suggestions to be omitted for server %s", serverVersion)
+	}
+}
+
+func TestGetTargetProviderMetadataAfterCreate(t *testing.T) {
+	// The machine is not listed yet right after the create
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("[]"))
+	}))
+	t.Cleanup(server.Close)
+	t.Setenv("FLY_FLAPS_BASE_URL", server.URL)
+
+	target := &models.Target{
+		Id:           "123",
+		TargetConfig: models.TargetConfig{Options: `{"Org Slug":"org","Auth Token":"token","Region":"lax"}`},
+	}
+	machine := &fly.Machine{
+		ID:     "machine_1",
+		Region: "lax",
+		Config: &fly.MachineConfig{Mounts: []fly.MachineMount{{Volume: "vol_1"}}},
+	}
+
+	p := &FlyProvider{}
+	if err := p.storeTargetMetadata(target, machine); err != nil {
+		t.Fatalf("Failed to store metadata: %v", err)
+	}
+	if target.ProviderMetadata == nil {
+		t.Fatalf("Expected the provider metadata to be set on the target")
+	}
+
+	jsonMetadata, err := p.GetTargetProviderMetadata(&provider.TargetRequest{Target: target})
+	if err != nil {
+		t.Fatalf("Expected the metadata of the created machine but got error: %v", err)
+	}
+
+	var metadata types.TargetMetadata
+	if err := json.Unmarshal([]byte(jsonMetadata), &metadata); err != nil {
+		t.Fatalf("Failed to unmarshal metadata: %v", err)
+	}
+	if metadata.MachineId != "machine_1" || metadata.Region != "lax" || metadata.VolumeId != "vol_1" {
+		t.Errorf("Expected machine machine_1 in lax with volume vol_1 but got %+v", metadata)
+	}
+}
+
+func TestDestroyWorkspaceKeepsVolume(t *testing.T) {
+	// The volume is shared by the workspaces of the target, so destroying one must not call the fly API
+	var flyRequests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flyRequests = append(flyRequests, r.Method+" "+r.URL.Path)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(server.Close)
+	t.Setenv("FLY_FLAPS_BASE_URL", server.URL)
+
+	defaultGetTsnetConnection := getTsnetConnection
+	getTsnetConnection = func(config *tailscale.TsnetConnConfig) (*tsnet.Server, error) {
+		return nil, errors.New("tailnet unreachable")
+	}
+	t.Cleanup(func() { getTsnetConnection = defaultGetTsnetConnection })
+
+	p := &FlyProvider{}
+	_, err := p.Initialize(provider.InitializeProviderRequest{BasePath: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Error initializing provider: %s", err)
+	}
+	p.WorkspaceLogsDir = nil
+
+	workspace := &models.Workspace{
+		Id:       "workspace_1",
+		Name:     "workspace",
+		TargetId: "123",
+		Target: models.Target{
+			Id:           "123",
+			TargetConfig: models.TargetConfig{Options: `{"Org Slug":"org","Auth Token":"token","Region":"lax"}`},
+		},
+	}
+	_, err = p.DestroyWorkspace(&provider.WorkspaceRequest{Workspace: workspace})
+	if err == nil || !strings.Contains(err.Error(), "tailnet unreachable") {
+		t.Errorf("Expected the workspace destroy to fail on the tailnet but got %v", err)
+	}
+
+	if len(flyRequests) != 0 {
+		t.Errorf("Expected no fly API requests but got %v", flyRequests)
+	}
+}
+
 func init() {
 	_, err := flyProvider.Initialize(provider.InitializeProviderRequest{
 		BasePath:           "/tmp/targets",
@@ -0,0 +1,64 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/daytonaio/daytona-provider-fly/pkg/types"
+	"github.com/daytonaio/daytona/pkg/models"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// limitWorkspaceContainer applies the resource limits to the containers of the workspace.
+// The daytona docker client creates the containers without limits, so they are updated afterwards.
+func (p *FlyProvider) limitWorkspaceContainer(workspace *models.Workspace, resources types.WorkspaceResources) error {
+	if !resources.IsLimited() {
+		return nil
+	}
+
+	cli, err := p.getDockerApiClient(&workspace.Target)
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	ctx := context.Background()
+	containers, err := cli.ContainerList(ctx, container.ListOptions{
+		Filters: filters.NewArgs(
+			filters.Arg("label", fmt.Sprintf("daytona.target.id=%s", workspace.TargetId)),
+			filters.Arg("label", fmt.Sprintf("daytona.workspace.id=%s", workspace.Id)),
+		),
+		All: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(containers) == 0 {
+		return fmt.Errorf("no container found for workspace %s", workspace.Name)
+	}
+
+	for _, c := range containers {
+		_, err = cli.ContainerUpdate(ctx, c.ID, container.UpdateConfig{Resources: getContainerResources(resources)})
+		if err != nil {
+			return fmt.Errorf("failed to limit resources of workspace %s: %w", workspace.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// getContainerResources returns the Docker resources for the limits. Swap is set to the memory
+// limit, so a limited workspace can't exceed it by swapping.
+func getContainerResources(resources types.WorkspaceResources) container.Resources {
+	var result container.Resources
+	if resources.Cpus > 0 {
+		result.NanoCPUs = int64(resources.Cpus) * 1e9
+	}
+	if resources.MemoryMb > 0 {
+		result.Memory = int64(resources.MemoryMb) * 1024 * 1024
+		result.MemorySwap = result.Memory
+	}
+	return result
+}
@@ -0,0 +1,70 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/daytonaio/daytona-provider-fly/pkg/types"
+	"github.com/daytonaio/daytona/pkg/models"
+	"github.com/docker/docker/api/types/container"
+	"golang.org/x/sync/errgroup"
+)
+
+// getStopGracePeriod returns the time the containers of the target get to stop before its machine is stopped.
+func getStopGracePeriod(targetOptions *types.TargetOptions) time.Duration {
+	timeout := types.DefaultStopTimeout
+	if targetOptions.StopTimeout > 0 {
+		timeout = targetOptions.StopTimeout
+	}
+	return time.Duration(timeout) * time.Second
+}
+
+// drainDocker stops the running containers of the target's Docker daemon through the Docker API, so
+// dockerd finishes in-flight operations and writes before the machine is stopped. Docker kills the
+// containers that don't stop within the grace period.
+func (p *FlyProvider) drainDocker(ctx context.Context, target *models.Target, grace time.Duration) error {
+	cli, err := p.getDockerApiClient(target)
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	containers, err := cli.ContainerList(ctx, container.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	timeout := int(grace.Seconds())
+	group, groupCtx := errgroup.WithContext(ctx)
+	for _, c := range containers {
+		group.Go(func() error {
+			return cli.ContainerStop(groupCtx, c.ID, container.StopOptions{Timeout: &timeout})
+		})
+	}
+	return group.Wait()
+}
+
+// stopGracefully drains the Docker daemon and then stops the machine. The machine is stopped once the
+// drain finishes, fails or does not finish within the grace period, so a hung daemon can't block the stop.
+func stopGracefully(grace time.Duration, drain func(ctx context.Context) error, stop func() error, logWriter io.Writer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- drain(ctx)
+	}()
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			logWriter.Write([]byte("Failed to stop the docker containers cleanly, stopping the machine: " + err.Error() + "\n"))
+		}
+	case <-ctx.Done():
+		logWriter.Write([]byte(fmt.Sprintf("Docker containers did not stop within %s, stopping the machine\n", grace)))
+	}
+
+	return stop()
+}
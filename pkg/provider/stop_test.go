@@ -0,0 +1,83 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStopGracefully(t *testing.T) {
+	grace := 50 * time.Millisecond
+
+	cases := []struct {
+		name          string
+		drain         func(ctx context.Context) error
+		expectedCalls []string
+		minElapsed    time.Duration
+	}{
+		{
+			name:          "Drained before the machine is stopped",
+			drain:         func(ctx context.Context) error { return nil },
+			expectedCalls: []string{"drain", "stop"},
+		},
+		{
+			name:          "Drain fails",
+			drain:         func(ctx context.Context) error { return errors.New("docker daemon not reachable") },
+			expectedCalls: []string{"drain", "stop"},
+		},
+		{
+			name: "Drain exceeds the grace period",
+			drain: func(ctx context.Context) error {
+				<-ctx.Done()
+				time.Sleep(grace)
+				return ctx.Err()
+			},
+			expectedCalls: []string{"stop", "drain"},
+			minElapsed:    grace,
+		},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var calls []string
+			record := func(call string) {
+				mu.Lock()
+				defer mu.Unlock()
+				calls = append(calls, call)
+			}
+
+			drainDone := make(chan struct{})
+			drain := func(ctx context.Context) error {
+				defer close(drainDone)
+				err := testCase.drain(ctx)
+				record("drain")
+				return err
+			}
+			stop := func() error {
+				record("stop")
+				return nil
+			}
+
+			start := time.Now()
+			err := stopGracefully(grace, drain, stop, io.Discard)
+			if err != nil {
+				t.Fatalf("Expected the machine to be stopped but got error: %s", err)
+			}
+			if elapsed := time.Since(start); elapsed < testCase.minElapsed {
+				t.Errorf("Expected the stop to wait for the grace period but it took %s", elapsed)
+			}
+			<-drainDone
+
+			mu.Lock()
+			defer mu.Unlock()
+			if !slices.Equal(calls, testCase.expectedCalls) {
+				t.Errorf("Expected calls %v but got %v", testCase.expectedCalls, calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package util
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/daytonaio/daytona-provider-fly/pkg/types"
+	log "github.com/sirupsen/logrus"
+	"github.com/superfly/fly-go"
+	"github.com/superfly/fly-go/flaps"
+	"github.com/superfly/fly-go/tokens"
+)
+
+// flapsAPI is the part of the fly machines API client used by the fly utilities.
+// It is implemented by *flaps.Client.
+type flapsAPI interface {
+	NewRequest(ctx context.Context, method, path string, in interface{}, headers map[string][]string) (*http.Request, error)
+
+	CreateApp(ctx context.Context, name string, org string) error
+	WaitForApp(ctx context.Context, name string) error
+
+	Launch(ctx context.Context, builder fly.LaunchMachineInput) (*fly.Machine, error)
+	Update(ctx context.Context, builder fly.LaunchMachineInput, nonce string) (*fly.Machine, error)
+	Start(ctx context.Context, machineID string, nonce string) (*fly.MachineStartResponse, error)
+	Stop(ctx context.Context, in fly.StopMachineInput, nonce string) error
+	Destroy(ctx context.Context, input fly.RemoveMachineInput, nonce string) error
+	Restart(ctx context.Context, in fly.RestartMachineInput, nonce string) error
+	Wait(ctx context.Context, machine *fly.Machine, state string, timeout time.Duration) error
+	Get(ctx context.Context, machineID string) (*fly.Machine, error)
+	List(ctx context.Context, state string) ([]*fly.Machine, error)
+
+	CreateVolume(ctx context.Context, req fly.CreateVolumeRequest) (*fly.Volume, error)
+	GetVolume(ctx context.Context, volumeId string) (*fly.Volume, error)
+	GetVolumes(ctx context.Context) ([]fly.Volume, error)
+	GetVolumeSnapshots(ctx context.Context, volumeId string) ([]fly.VolumeSnapshot, error)
+	ExtendVolume(ctx context.Context, volumeId string, sizeGb int) (*fly.Volume, bool, error)
+	DeleteVolume(ctx context.Context, volumeId string) (*fly.Volume, error)
+}
+
+// flapsClientFactory creates the flaps clients of the fly utilities. Tests replace it to run the utilities
+// against a fake client.
+var flapsClientFactory = newFlapsClient
+
+// createFlapsClient creates a new flaps client for the app.
+func createFlapsClient(appName string, opts *types.TargetOptions) (flapsAPI, error) {
+	return flapsClientFactory(appName, opts)
+}
+
+// newFlapsClient creates a flaps client talking to the fly machines API.
+func newFlapsClient(appName string, opts *types.TargetOptions) (flapsAPI, error) {
+	transport, err := getFlapsTransport(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := flaps.NewWithOptions(context.Background(), flaps.NewClientOpts{
+		AppName:   appName,
+		Tokens:    tokens.Parse(opts.AuthToken),
+		Logger:    log.New(),
+		Transport: transport,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
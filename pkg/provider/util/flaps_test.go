@@ -0,0 +1,155 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/daytonaio/daytona-provider-fly/pkg/types"
+	"github.com/superfly/fly-go"
+)
+
+var _ flapsAPI = (*fakeFlapsClient)(nil)
+
+// fakeFlapsClient is an in-memory flapsAPI. Machines change state as soon as they are started or stopped.
+// The methods the fake does not implement panic through the nil embedded interface.
+type fakeFlapsClient struct {
+	flapsAPI
+	machines []*fly.Machine
+	calls    []string
+}
+
+// useFakeFlapsClient makes the fly utilities use the fake client for the duration of the test.
+func useFakeFlapsClient(t *testing.T, client *fakeFlapsClient) {
+	defaultFactory := flapsClientFactory
+	flapsClientFactory = func(appName string, opts *types.TargetOptions) (flapsAPI, error) {
+		return client, nil
+	}
+	t.Cleanup(func() { flapsClientFactory = defaultFactory })
+}
+
+func (f *fakeFlapsClient) WaitForApp(ctx context.Context, name string) error {
+	f.calls = append(f.calls, "wait_for_app")
+	return nil
+}
+
+func (f *fakeFlapsClient) List(ctx context.Context, state string) ([]*fly.Machine, error) {
+	f.calls = append(f.calls, "list")
+	return f.machines, nil
+}
+
+func (f *fakeFlapsClient) Start(ctx context.Context, machineID string, nonce string) (*fly.MachineStartResponse, error) {
+	f.calls = append(f.calls, "start")
+	machine, err := f.machine(machineID)
+	if err != nil {
+		return nil, err
+	}
+	machine.State = fly.MachineStateStarted
+	return &fly.MachineStartResponse{}, nil
+}
+
+func (f *fakeFlapsClient) Stop(ctx context.Context, in fly.StopMachineInput, nonce string) error {
+	f.calls = append(f.calls, "stop")
+	machine, err := f.machine(in.ID)
+	if err != nil {
+		return err
+	}
+	machine.State = fly.MachineStateStopped
+	return nil
+}
+
+// Wait completes transitional states right away and fails if the machine ends up in another state.
+func (f *fakeFlapsClient) Wait(ctx context.Context, machine *fly.Machine, state string, timeout time.Duration) error {
+	f.calls = append(f.calls, "wait_"+state)
+	current, err := f.machine(machine.ID)
+	if err != nil {
+		return err
+	}
+
+	switch current.State {
+	case machineStateStarting, machineStateReplacing, fly.MachineStateCreated:
+		current.State = fly.MachineStateStarted
+	case machineStateStopping:
+		current.State = fly.MachineStateStopped
+	}
+
+	if current.State != state {
+		return fmt.Errorf("machine %s is %s instead of %s", machine.ID, current.State, state)
+	}
+	return nil
+}
+
+func (f *fakeFlapsClient) machine(id string) (*fly.Machine, error) {
+	for _, machine := range f.machines {
+		if machine.ID == id {
+			return machine, nil
+		}
+	}
+	return nil, fmt.Errorf("machine %s not found", id)
+}
+
+func TestStartTargetFakeFlapsClient(t *testing.T) {
+	cases := []struct {
+		name          string
+		state         string
+		expectedCalls []string
+	}{
+		{"Stopped machine", fly.MachineStateStopped, []string{"wait_for_app", "list", "start", "wait_started"}},
+		{"Started machine", fly.MachineStateStarted, []string{"wait_for_app", "list"}},
+		{"Stopping machine", machineStateStopping, []string{"wait_for_app", "list", "wait_stopped", "start", "wait_started"}},
+		{"Starting machine", machineStateStarting, []string{"wait_for_app", "list", "wait_started"}},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			client := &fakeFlapsClient{machines: []*fly.Machine{{ID: "m1", Name: getResourceName(testTarget.Id, testTargetOptions), State: testCase.state}}}
+			useFakeFlapsClient(t, client)
+
+			err := StartTarget(testTarget, testTargetOptions)
+			if err != nil {
+				t.Fatalf("Expected the target to be started but got error: %s", err)
+			}
+
+			if client.machines[0].State != fly.MachineStateStarted {
+				t.Errorf("Expected the machine to be started but it is %s", client.machines[0].State)
+			}
+			if !slices.Equal(client.calls, testCase.expectedCalls) {
+				t.Errorf("Expected calls %v but got %v", testCase.expectedCalls, client.calls)
+			}
+		})
+	}
+}
+
+func TestStopTargetFakeFlapsClient(t *testing.T) {
+	cases := []struct {
+		name          string
+		state         string
+		expectedCalls []string
+	}{
+		{"Started machine", fly.MachineStateStarted, []string{"list", "stop", "wait_stopped"}},
+		{"Stopped machine", fly.MachineStateStopped, []string{"list"}},
+		{"Starting machine", machineStateStarting, []string{"list", "wait_started", "stop", "wait_stopped"}},
+		{"Stopping machine", machineStateStopping, []string{"list", "wait_stopped"}},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			client := &fakeFlapsClient{machines: []*fly.Machine{{ID: "m1", Name: getResourceName(testTarget.Id, testTargetOptions), State: testCase.state}}}
+			useFakeFlapsClient(t, client)
+
+			err := StopTarget(testTarget, testTargetOptions)
+			if err != nil {
+				t.Fatalf("Expected the target to be stopped but got error: %s", err)
+			}
+
+			if client.machines[0].State != fly.MachineStateStopped {
+				t.Errorf("Expected the machine to be stopped but it is %s", client.machines[0].State)
+			}
+			if !slices.Equal(client.calls, testCase.expectedCalls) {
+				t.Errorf("Expected calls %v but got %v", testCase.expectedCalls, client.calls)
+			}
+		})
+	}
+}
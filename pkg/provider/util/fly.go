@@ -2,10 +2,18 @@ package util
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net/http"
+	"net/url"
 	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/daytonaio/daytona-provider-fly/internal"
@@ -15,273 +23,2300 @@ import (
 	"github.com/superfly/fly-go"
 	"github.com/superfly/fly-go/flaps"
 	"github.com/superfly/fly-go/tokens"
+	"golang.org/x/sync/errgroup"
 )
 
+// flyApiBaseUrl is the base url of the fly api.
+var flyApiBaseUrl = "https://api.fly.io"
+
+// ConfigChecksumMetadataKey is the machine metadata key holding the config checksum computed at create time.
+const ConfigChecksumMetadataKey = "daytona_config_checksum"
+
+// MachineSizeMetadataKey is the machine metadata key holding the size the machine was resized to with
+// UpdateMachineSize. ReconcileTarget keeps this size instead of the size of the target options.
+const MachineSizeMetadataKey = "daytona_machine_size"
+
+// Errors returned by the fly utilities so callers can tell failures apart with errors.Is.
+var (
+	// ErrMachineNotFound is returned when the app has no machine for the target.
+	ErrMachineNotFound = errors.New("machine not found")
+	// ErrAppHasNoMachines is returned when the app exists but all of its machines were destroyed.
+	// It wraps ErrMachineNotFound, so callers that only check for a missing machine keep working.
+	ErrAppHasNoMachines = fmt.Errorf("%w: app has no machines", ErrMachineNotFound)
+	// ErrAppNotFound is returned when the fly app of the target does not exist.
+	ErrAppNotFound = errors.New("app not found")
+	// ErrInvalidAuth is returned when the fly API rejects the auth token.
+	ErrInvalidAuth = errors.New("invalid fly auth token")
+	// ErrSnapshotNotFound is returned when the volume snapshot to restore from does not exist.
+	ErrSnapshotNotFound = errors.New("volume snapshot not found")
+	// ErrVolumeNotFound is returned when the existing volume set as the Volume Id of the target does not exist.
+	ErrVolumeNotFound = errors.New("volume not found")
+	// ErrVolumeRegionMismatch is returned when the volume of the target is in another region than the machine,
+	// which fly can't attach it to.
+	ErrVolumeRegionMismatch = errors.New("volume region does not match the machine region")
+	// ErrInsufficientScope is returned when the auth token is valid but may not act on the org, e.g. an app
+	// scoped deploy token or a token of another org.
+	ErrInsufficientScope = errors.New("fly auth token scope is insufficient")
+	// ErrSizeNotAvailable is returned when the machine size can't be placed in any region of the target.
+	ErrSizeNotAvailable = errors.New("machine size not available")
+	// ErrBillingRequired is returned when fly refuses to create apps or machines because the org has no
+	// payment method or is blocked.
+	ErrBillingRequired = errors.New("your Fly org requires a payment method before creating machines")
+	// ErrMultipleMachines is returned when the app runs more than one machine for the target. Targets have
+	// exactly one machine, so operations are refused rather than applied to an arbitrary one.
+	ErrMultipleMachines = errors.New("multiple machines found for the target")
+	// ErrDockerNotReady is returned when the machine script gave up waiting for Docker, so the agent was
+	// never started.
+	ErrDockerNotReady = errors.New("docker did not become ready on the machine")
+)
+
+// Transitional machine states that are not exposed by the fly sdk.
+const (
+	machineStateStarting  = "starting"
+	machineStateStopping  = "stopping"
+	machineStateReplacing = "replacing"
+)
+
+const (
+	// machineStartTimeout is the maximum time to wait for a machine to start.
+	machineStartTimeout = time.Minute
+	// machineStopTimeout is the maximum time to wait for a machine to stop.
+	machineStopTimeout = time.Minute
+	// bytesPerGb is the number of bytes per GB of fly volume sizes.
+	bytesPerGb = 1 << 30
+	// maxAppNameLength is the maximum length of a Fly app name.
+	maxAppNameLength = 63
+	// appNameHashLength is the number of hex characters of the hash keeping shortened app names unique.
+	appNameHashLength = 8
+	// maxVolumeNameLength is the maximum length of a Fly volume name.
+	maxVolumeNameLength = 30
+	// volumeNameHashLength is the number of hex characters of the hash keeping shortened volume names unique.
+	volumeNameHashLength = 8
+	// packageInstallTimeout is the number of seconds the machine script waits for package installation.
+	packageInstallTimeout = 300
+)
+
+// dockerStartTimeoutMessage is logged by the machine script when Docker does not become ready within the
+// docker start timeout.
+const dockerStartTimeoutMessage = "Timed out waiting for Docker to start"
+
+// logPollInterval is the delay before polling logs again once all log entries have been fetched.
+const logPollInterval = 10 * time.Second
+
+// logRateLimitRetries is the number of times a rate limited request of getAppLogsBetween is retried.
+const logRateLimitRetries = 5
+
+// createRetryBackoff is the delay between CreateTarget attempts.
+var createRetryBackoff = 5 * time.Second
+
+// volumeCreateAttempts is the number of attempts at creating the data volume on transient failures.
+const volumeCreateAttempts = 3
+
+// volumeCreateBackoff is the delay between volume create attempts.
+var volumeCreateBackoff = 2 * time.Second
+
+// appDeleteTimeout is the maximum time to wait for an app to be deleted before retrying a create.
+const appDeleteTimeout = time.Minute
+
+// machineDeleteTimeout is the maximum time to wait for the machine to be gone after deleting a target.
+const machineDeleteTimeout = time.Minute
+
+// volumeDeleteTimeout is the maximum time to wait for the data volume to be gone after deleting a target.
+const volumeDeleteTimeout = time.Minute
+
+// deletePollInterval is the delay between checks that the machine and data volume of a deleted target are gone.
+var deletePollInterval = 2 * time.Second
+
+// appNameRegex matches the app names fly accepts, lowercase letters, numbers and dashes
+// starting and ending with a letter or number.
+var appNameRegex = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// invalidAppNameCharsRegex matches the characters fly does not accept in app names.
+var invalidAppNameCharsRegex = regexp.MustCompile(`[^a-z0-9-]`)
+
 // Createtarget creates a new fly.io app for the provided target.
-func CreateTarget(target *models.Target, opts *types.TargetOptions, initScript string) (*fly.Machine, error) {
-	appName := getResourceName(target.Id)
-	flapsClient, err := createFlapsClient(appName, opts.AuthToken)
+// Retriable failures tear down the partially created app and retry up to opts.CreateMaxAttempts times.
+// If the context is cancelled, the partially created app is deleted on a best-effort basis.
+func CreateTarget(ctx context.Context, target *models.Target, opts *types.TargetOptions, initScript string, timings *PhaseTimings) (*fly.Machine, error) {
+	attempts := max(opts.CreateMaxAttempts, 1)
+
+	if opts.ForceRecreate {
+		err := cleanupPartialTarget(target, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to delete the existing app of target %s before recreating it: %w", target.Id, err)
+		}
+	} else {
+		// A retried create after a partial success continues with the machine that is already running
+		machine, err := findProvisionedMachine(target, opts)
+		if err != nil {
+			return nil, err
+		}
+		if machine != nil {
+			log.Infof("Target %s already runs machine %s, skipping its creation", target.Id, machine.ID)
+			return machine, nil
+		}
+	}
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		var machine *fly.Machine
+		machine, err = createTarget(ctx, target, opts, initScript, timings)
+		if err == nil {
+			return machine, nil
+		}
+
+		if ctx.Err() != nil {
+			return nil, abortCreateTarget(ctx, target, opts)
+		}
+
+		if attempt == attempts || !isRetriableCreateError(err) {
+			break
+		}
+
+		log.Warnf("Creating target %s failed (attempt %d/%d), retrying: %s", target.Id, attempt, attempts, err)
+		cleanupErr := cleanupPartialTarget(target, opts)
+		if cleanupErr != nil {
+			return nil, fmt.Errorf("%w (cleanup before retry failed: %s)", err, cleanupErr)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, abortCreateTarget(ctx, target, opts)
+		case <-time.After(createRetryBackoff):
+		}
+	}
+
+	return nil, err
+}
+
+// findProvisionedMachine returns the started machine of the target, or nil if the target app or its
+// machine do not exist yet or the machine is not running.
+func findProvisionedMachine(target *models.Target, opts *types.TargetOptions) (*fly.Machine, error) {
+	flapsClient, err := createFlapsClient(getAppName(target.Id, opts), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	machine, err := findMachine(flapsClient, getResourceName(target.Id, opts))
+	if errors.Is(err, ErrAppNotFound) || errors.Is(err, ErrMachineNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if machine.State != fly.MachineStateStarted {
+		return nil, nil
+	}
+
+	return machine, nil
+}
+
+// abortCreateTarget deletes what was created of the target after the create was cancelled
+// and returns the cancellation error. Cleanup failures are only logged.
+func abortCreateTarget(ctx context.Context, target *models.Target, opts *types.TargetOptions) error {
+	log.Warnf("Creating target %s was cancelled, deleting the partially created app", target.Id)
+	cleanupErr := cleanupPartialTarget(target, opts)
+	if cleanupErr != nil {
+		log.Warnf("Failed to delete the partially created app of target %s: %s", target.Id, cleanupErr)
+	}
+
+	return fmt.Errorf("creating target %s was cancelled: %w", target.Id, ctx.Err())
+}
+
+// isRetriableCreateError reports whether a CreateTarget failure is transient, e.g. missing capacity
+// or an unavailable API. Errors such as an invalid token or region are not retriable.
+func isRetriableCreateError(err error) bool {
+	if errors.Is(err, ErrBillingRequired) {
+		return false
+	}
+
+	var flapsErr *flaps.FlapsError
+	if errors.As(err, &flapsErr) {
+		code := flapsErr.ResponseStatusCode
+		if code == http.StatusRequestTimeout || code == http.StatusTooManyRequests || code >= http.StatusInternalServerError {
+			return true
+		}
+
+		return isCapacityError(err)
+	}
+
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+// isCapacityError reports whether the fly API rejected the request because the region is out of capacity.
+func isCapacityError(err error) bool {
+	var flapsErr *flaps.FlapsError
+	if !errors.As(err, &flapsErr) {
+		return false
+	}
+
+	body := strings.ToLower(string(flapsErr.ResponseBody))
+	return strings.Contains(body, "insufficient resources") || strings.Contains(body, "capacity")
+}
+
+// cleanupPartialTarget deletes the target app, including any volume and machine created so far,
+// and waits for the deletion so the app name can be reused.
+func cleanupPartialTarget(target *models.Target, opts *types.TargetOptions) error {
+	appName := getAppName(target.Id, opts)
+	flapsClient, err := createFlapsClient(appName, opts)
+	if err != nil {
+		return err
+	}
+
+	exists, err := appExists(flapsClient, appName, opts)
+	if err != nil || !exists {
+		return err
+	}
+
+	err = DeleteTarget(target, opts)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(appDeleteTimeout)
+	for time.Now().Before(deadline) {
+		exists, err = appExists(flapsClient, appName, opts)
+		if err != nil || !exists {
+			return err
+		}
+		time.Sleep(time.Second)
+	}
+
+	return fmt.Errorf("timeout: app %s was not deleted after %f minutes", appName, appDeleteTimeout.Minutes())
+}
+
+// appExists reports whether the fly app exists.
+func appExists(flapsClient flapsAPI, appName string, opts *types.TargetOptions) (bool, error) {
+	path := fmt.Sprintf("/apps/%s", appName)
+	req, err := flapsClient.NewRequest(context.Background(), http.MethodGet, path, nil, nil)
+	if err != nil {
+		return false, err
+	}
+
+	httpClient, err := createFlapsHttpClient(opts)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return false, fmt.Errorf("%w: status code %d while getting app %s", ErrInvalidAuth, resp.StatusCode, appName)
+	default:
+		return false, fmt.Errorf("unexpected error while getting the app status code: %d", resp.StatusCode)
+	}
+}
+
+// createTarget runs a single attempt at creating the app, volume and machine for the provided target.
+func createTarget(ctx context.Context, target *models.Target, opts *types.TargetOptions, initScript string, timings *PhaseTimings) (*fly.Machine, error) {
+	appName := getAppName(target.Id, opts)
+	flapsClient, err := createFlapsClient(appName, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateAppName(appName)
+	if err != nil {
+		return nil, err
+	}
+
+	appCreateDone := timings.Track(PhaseAppCreate)
+	err = createApp(ctx, flapsClient, appName, opts)
+	if err != nil {
+		if isBillingError(err) {
+			return nil, billingError(opts.OrgSlug, err)
+		}
+		if !opts.ReuseExistingApp || !isAppAlreadyExistsError(err) {
+			return nil, classifyScopeError(opts.OrgSlug, err)
+		}
+
+		err = checkAppReusable(flapsClient, target, opts)
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("App %s already exists and has no daytona machine, reusing it", appName)
+	}
+
+	// The volume only needs the app to exist, so it is created while waiting for the app to be ready
+	var volume *fly.Volume
+	var volumeCreated bool
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.Go(func() error {
+		err := waitForApp(groupCtx, flapsClient, appName, opts)
+		if err == nil {
+			appCreateDone()
+		}
+		return err
+	})
+	group.Go(func() error {
+		if opts.NoPersistentDisk {
+			return nil
+		}
+
+		var err error
+		volume, volumeCreated, err = createVolume(groupCtx, flapsClient, target, opts, timings)
+		if err != nil && isCapacityError(err) && len(opts.RegionFallback) > 0 {
+			// createMachine tries the machine region again before falling back to the other regions
+			log.Warnf("Creating the data volume in region %s failed due to missing capacity: %s", opts.Region, err)
+			return nil
+		}
+		return err
+	})
+
+	err = group.Wait()
+	if err != nil {
+		if volume != nil && volumeCreated {
+			_, deleteErr := flapsClient.DeleteVolume(context.Background(), volume.ID)
+			if deleteErr != nil {
+				log.Warnf("Failed to delete volume %s after failed app wait: %s", volume.ID, deleteErr)
+			}
+		}
+		return nil, err
+	}
+
+	if !opts.PublicIPEnabled() {
+		err = releasePublicIPs(appName, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(opts.Services) > 0 {
+		err = allocateServiceIPs(appName, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	machine, err := createMachine(ctx, target, opts, initScript, volume, volumeCreated, timings)
+	if err != nil {
+		return nil, err
+	}
+
+	machineStartDone := timings.Track(PhaseMachineStart)
+	err = flapsClient.Wait(ctx, machine, fly.MachineStateStarted, time.Minute*5)
 	if err != nil {
 		return nil, err
 	}
+	machineStartDone()
+
+	if timings != nil {
+		recordImagePull(ctx, flapsClient, machine.ID, timings)
+	}
+
+	return machine, nil
+}
+
+// recordImagePull records how long fly took from launching the machine to starting it. The image is pulled
+// by fly in between, so it is only visible in the machine events. Failures to get them are only logged.
+func recordImagePull(ctx context.Context, flapsClient flapsAPI, machineID string, timings *PhaseTimings) {
+	machine, err := flapsClient.Get(ctx, machineID)
+	if err != nil {
+		log.Debugf("Failed to get the events of machine %s: %s", machineID, err)
+		return
+	}
+
+	duration, ok := imagePullDuration(machine)
+	if !ok {
+		log.Debugf("Machine %s has no launch and start events", machineID)
+		return
+	}
+	timings.Record(PhaseImagePull, duration)
+}
+
+// imagePullDuration returns the time between the launch event of the machine and its first start after it.
+func imagePullDuration(machine *fly.Machine) (time.Duration, bool) {
+	launch := machine.GetLatestEventOfType("launch")
+	if launch == nil {
+		return 0, false
+	}
+
+	// Events are ordered newest first, so the first start after the launch is the last one before it in the list
+	var start *fly.MachineEvent
+	for _, event := range machine.Events {
+		if event == launch {
+			break
+		}
+		if event.Type == "start" {
+			start = event
+		}
+	}
+	if start == nil || start.Timestamp < launch.Timestamp {
+		return 0, false
+	}
+
+	return start.Time().Sub(launch.Time()), true
+}
+
+// Starttarget starts the machine for the provided target.
+func StartTarget(target *models.Target, opts *types.TargetOptions) error {
+	appName := getAppName(target.Id, opts)
+	flapsClient, err := createFlapsClient(appName, opts)
+	if err != nil {
+		return err
+	}
+
+	err = waitForApp(context.Background(), flapsClient, appName, opts)
+	if err != nil {
+		return fmt.Errorf("there was an issue waiting for the app: %w", err)
+	}
+
+	machineName := getResourceName(target.Id, opts)
+	machine, err := findMachine(flapsClient, machineName)
+	if err != nil {
+		return err
+	}
+
+	switch machine.State {
+	case fly.MachineStateStarted:
+		return nil
+	case machineStateStarting, machineStateReplacing, fly.MachineStateCreated:
+		// The machine is already on its way up
+		return waitForMachineState(flapsClient, machine, fly.MachineStateStarted, machineStartTimeout)
+	case machineStateStopping:
+		// The machine can only be started once it has fully stopped
+		err = waitForMachineState(flapsClient, machine, fly.MachineStateStopped, machineStopTimeout)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = flapsClient.Start(context.Background(), machine.ID, "")
+	if err != nil {
+		return err
+	}
+
+	return waitForMachineState(flapsClient, machine, fly.MachineStateStarted, machineStartTimeout)
+}
+
+// Stoptarget stops the machine for the provided target.
+func StopTarget(target *models.Target, opts *types.TargetOptions) error {
+	appName := getAppName(target.Id, opts)
+	flapsClient, err := createFlapsClient(appName, opts)
+	if err != nil {
+		return err
+	}
+
+	machineName := getResourceName(target.Id, opts)
+	machine, err := findMachine(flapsClient, machineName)
+	if err != nil {
+		return err
+	}
+
+	switch machine.State {
+	case fly.MachineStateStopped:
+		return nil
+	case machineStateStopping:
+		// The machine is already on its way down
+		return waitForMachineState(flapsClient, machine, fly.MachineStateStopped, machineStopTimeout)
+	case machineStateStarting, machineStateReplacing, fly.MachineStateCreated:
+		// The machine can only be stopped once it has fully started
+		err = waitForMachineState(flapsClient, machine, fly.MachineStateStarted, machineStartTimeout)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = flapsClient.Stop(context.Background(), fly.StopMachineInput{ID: machine.ID}, "")
+	if err != nil {
+		return err
+	}
+
+	return waitForMachineState(flapsClient, machine, fly.MachineStateStopped, machineStopTimeout)
+}
+
+// UpdateMachineSize changes the size of the machine for the provided target in place, so the Docker data on
+// its volume is kept. The machine is stopped, updated to the new size and started again. The size is recorded
+// in the machine metadata, so ReconcileTarget does not set it back to the size of the options.
+func UpdateMachineSize(target *models.Target, opts *types.TargetOptions, newSize string) error {
+	err := opts.ValidateSize(newSize)
+	if err != nil {
+		return err
+	}
+	resized := *opts
+	resized.Size = newSize
+	size := resized.MachineSize()
+
+	appName := getAppName(target.Id, opts)
+	flapsClient, err := createFlapsClient(appName, opts)
+	if err != nil {
+		return err
+	}
+
+	machine, err := findMachine(flapsClient, getResourceName(target.Id, opts))
+	if err != nil {
+		return err
+	}
+	if machine.Config == nil {
+		return fmt.Errorf("machine %s has no config", machine.ID)
+	}
+
+	err = StopTarget(target, opts)
+	if err != nil {
+		return fmt.Errorf("failed to stop machine %s for resizing: %w", machine.ID, err)
+	}
+
+	guest := &fly.MachineGuest{}
+	err = guest.SetSize(size)
+	if err != nil {
+		return err
+	}
+	config := *machine.Config
+	config.Guest = guest
+	config.VMSize = size
+	config.Metadata = maps.Clone(config.Metadata)
+	if config.Metadata == nil {
+		config.Metadata = map[string]string{}
+	}
+	config.Metadata[MachineSizeMetadataKey] = size
+
+	log.Infof("Resizing machine %s from %s to %s", machine.ID, describeGuest(machine.Config.Guest), size)
+	updated, err := updateMachineConfig(flapsClient, machine, &config, true)
+	if err != nil {
+		return err
+	}
+
+	// The mounts are sent unchanged, but a machine coming back without its volume would lose its Docker data
+	for _, mount := range machine.Config.Mounts {
+		if updated.Config == nil || !slices.ContainsFunc(updated.Config.Mounts, func(m fly.MachineMount) bool { return m.Volume == mount.Volume }) {
+			return fmt.Errorf("volume %s is no longer attached to machine %s after resizing", mount.Volume, machine.ID)
+		}
+	}
+
+	return StartTarget(target, opts)
+}
+
+// Deletetarget deletes the app associated with the provided target. All volumes of the app are removed with it,
+// including an existing volume attached through opts.VolumeId.
+// The data volume is deleted explicitly beforehand instead of relying on fly removing it with the app,
+// so a volume left behind does not keep being billed. It is deleted while the app still exists, since
+// once the app is gone every volume lookup is a not found error and the deletion can't be confirmed.
+func DeleteTarget(target *models.Target, opts *types.TargetOptions) error {
+	appName := getAppName(target.Id, opts)
+	flapsClient, err := createFlapsClient(appName, opts)
+	if err != nil {
+		return err
+	}
+
+	var volumeId string
+	volumeName := getVolumeName(target.Id, opts)
+	volumes, err := flapsClient.GetVolumes(context.Background())
+	if err != nil {
+		log.Warnf("Failed to list volumes of app %s, volume deletion will not be confirmed: %s", appName, err)
+	}
+	for _, volume := range volumes {
+		if volume.Name == volumeName {
+			volumeId = volume.ID
+			break
+		}
+	}
+
+	if volumeId != "" {
+		// An attached volume can't be deleted, so the machine is destroyed first
+		err = destroyMachine(flapsClient, getResourceName(target.Id, opts))
+		if err != nil {
+			return err
+		}
+
+		err = deleteVolumeAndWait(flapsClient, volumeId)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Infof("Deleting app %s", appName)
+	err = deleteApp(appName, opts)
+	if err != nil {
+		return err
+	}
+
+	return waitForMachineGone(flapsClient, getResourceName(target.Id, opts))
+}
+
+// destroyMachine destroys the machine with the name and waits until it is gone.
+// A machine that does not exist or is already destroyed is not an error.
+func destroyMachine(flapsClient flapsAPI, machineName string) error {
+	machine, err := findMachineForDeletion(flapsClient, machineName)
+	if errors.Is(err, ErrAppNotFound) || errors.Is(err, ErrMachineNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if machine.State == fly.MachineStateDestroyed {
+		return nil
+	}
+
+	log.Infof("Destroying machine %s", machine.ID)
+	err = flapsClient.Destroy(context.Background(), fly.RemoveMachineInput{ID: machine.ID, Kill: true}, "")
+	if err != nil && !isNotFoundError(err) {
+		return fmt.Errorf("failed to destroy machine %s: %w", machine.ID, err)
+	}
+
+	return waitForMachineGone(flapsClient, machineName)
+}
+
+// waitForMachineGone waits until the machine is destroyed or its app is gone.
+func waitForMachineGone(flapsClient flapsAPI, machineName string) error {
+	deadline := time.Now().Add(machineDeleteTimeout)
+	for {
+		machine, err := findMachineForDeletion(flapsClient, machineName)
+		if errors.Is(err, ErrAppNotFound) || errors.Is(err, ErrAppHasNoMachines) || errors.Is(err, ErrMachineNotFound) ||
+			(err == nil && machine.State == fly.MachineStateDestroyed) {
+			log.Infof("Machine %s deleted", machineName)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to confirm deletion of machine %s: %w", machineName, err)
+		}
+
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("timeout: machine %s still exists in state %s after %s", machineName, machine.State, machineDeleteTimeout)
+		}
+		log.Infof("Waiting for machine %s to be deleted, state: %s", machineName, machine.State)
+		time.Sleep(deletePollInterval)
+	}
+}
+
+// deleteVolumeAndWait deletes the volume and waits until it is gone. It must be called while the app still
+// exists, a not found error is taken as the volume being gone. A volume that is already deleted is not an error.
+func deleteVolumeAndWait(flapsClient flapsAPI, volumeId string) error {
+	log.Infof("Deleting volume %s", volumeId)
+	_, err := flapsClient.DeleteVolume(context.Background(), volumeId)
+	if err != nil && !isNotFoundError(err) {
+		return fmt.Errorf("failed to delete volume %s: %w", volumeId, err)
+	}
+
+	deadline := time.Now().Add(volumeDeleteTimeout)
+	for {
+		volume, err := flapsClient.GetVolume(context.Background(), volumeId)
+		if isNotFoundError(err) || (err == nil && volume.State == "destroyed") {
+			log.Infof("Volume %s deleted", volumeId)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to confirm deletion of volume %s: %w", volumeId, err)
+		}
+
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("timeout: volume %s was not deleted after %s", volumeId, volumeDeleteTimeout)
+		}
+		log.Infof("Waiting for volume %s to be deleted, state: %s", volumeId, volume.State)
+		time.Sleep(deletePollInterval)
+	}
+}
+
+// isNotFoundError reports whether err is a flaps error for a missing resource.
+func isNotFoundError(err error) bool {
+	var flapsErr *flaps.FlapsError
+	return errors.As(err, &flapsErr) && flapsErr.ResponseStatusCode == http.StatusNotFound
+}
+
+// deleteApp deletes the fly app including its machines and volumes.
+func deleteApp(appName string, opts *types.TargetOptions) error {
+	flapsClient, err := createFlapsClient(appName, opts)
+	if err != nil {
+		return err
+	}
+
+	// TODO: use delete method from flaps client when implemented in sdk
+	path := fmt.Sprintf("/apps/%s", appName)
+	req, err := flapsClient.NewRequest(context.Background(), http.MethodDelete, path, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	httpClient, err := createFlapsHttpClient(opts)
+	if err != nil {
+		return err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("unexpected error while deleting the app status code: %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// PlanTarget returns a human-readable summary of the app, volume and machine that CreateTarget
+// would create for the provided target. No create endpoints are called.
+func PlanTarget(target *models.Target, opts *types.TargetOptions, initScript string) string {
+	appName := getAppName(target.Id, opts)
+	volumeRequest := getVolumeRequest(target, opts)
+	var volume *fly.Volume
+	if !opts.NoPersistentDisk {
+		volume = &fly.Volume{Name: volumeRequest.Name}
+	}
+	launchInput := getLaunchInput(target, opts, initScript, volume)
+
+	region := launchInput.Region
+	if region == "" {
+		region = "nearest region"
+	}
+
+	envKeys := slices.Sorted(maps.Keys(launchInput.Config.Env))
+
+	var plan strings.Builder
+	plan.WriteString("Dry run: the following resources would be created\n")
+	fmt.Fprintf(&plan, "App: %s in org %s\n", appName, opts.OrgSlug)
+	if opts.PrimaryRegion != "" {
+		fmt.Fprintf(&plan, "  Primary region: %s\n", opts.PrimaryRegion)
+	}
+	if volume != nil {
+		encryption := "encrypted"
+		if !*volumeRequest.Encrypted {
+			encryption = "unencrypted"
+		}
+		fmt.Fprintf(&plan, "Volume: %s (%dGB, %s) in %s\n", volumeRequest.Name, *volumeRequest.SizeGb, encryption, region)
+	} else {
+		plan.WriteString("Volume: none, Docker data is stored on the ephemeral root disk\n")
+	}
+	fmt.Fprintf(&plan, "Machine: %s (%s, image %s) in %s\n", launchInput.Name, launchInput.Config.VMSize, launchInput.Config.Image, region)
+	for _, mount := range launchInput.Config.Mounts {
+		fmt.Fprintf(&plan, "  Mount: %s at %s\n", mount.Name, mount.Path)
+	}
+	fmt.Fprintf(&plan, "  Env: %s\n", strings.Join(envKeys, ", "))
+	if len(opts.Secrets) > 0 {
+		fmt.Fprintf(&plan, "  Secrets: %s\n", strings.Join(slices.Sorted(maps.Keys(opts.Secrets)), ", "))
+	}
+
+	return plan.String()
+}
+
+// createMachine creates a new machine for the provided target.
+// The volume is the one already prepared in the primary region, or nil to create it.
+func createMachine(ctx context.Context, target *models.Target, opts *types.TargetOptions, initScript string, volume *fly.Volume, volumeCreated bool, timings *PhaseTimings) (*fly.Machine, error) {
+	appName := getAppName(target.Id, opts)
+	flapsClient, err := createFlapsClient(appName, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(opts.Secrets) > 0 {
+		err = setAppSecrets(appName, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, command := range opts.ExtraInitCommands {
+		log.Infof("Target %s runs the extra init command: %s", target.Id, command)
+	}
+
+	regions := append([]string{opts.Region}, opts.RegionFallback...)
+	for i, region := range regions {
+		regionOpts := *opts
+		regionOpts.Region = region
+
+		var regionVolume *fly.Volume
+		regionVolumeCreated := false
+		if i == 0 {
+			regionVolume, regionVolumeCreated = volume, volumeCreated
+		}
+
+		var machine *fly.Machine
+		machine, err = launchMachineInRegion(ctx, flapsClient, target, &regionOpts, initScript, regionVolume, regionVolumeCreated, timings)
+		if err == nil {
+			return machine, nil
+		}
+
+		if i == len(regions)-1 || !isCapacityError(err) {
+			break
+		}
+		log.Warnf("Launching machine in region %s failed due to missing capacity, trying region %s: %s", region, regions[i+1], err)
+	}
+
+	return nil, err
+}
+
+// launchMachineInRegion launches the machine in opts.Region, creating the volume if none is passed.
+// A volume created for the launch is deleted again if the launch fails, since volumes are bound to a region.
+// Reused volumes are kept.
+func launchMachineInRegion(ctx context.Context, flapsClient flapsAPI, target *models.Target, opts *types.TargetOptions, initScript string, volume *fly.Volume, volumeCreated bool, timings *PhaseTimings) (*fly.Machine, error) {
+	log.Infof("Launching machine for target %s in region %s", target.Id, opts.Region)
+
+	if volume == nil && !opts.NoPersistentDisk {
+		var err error
+		volume, volumeCreated, err = createVolume(ctx, flapsClient, target, opts, timings)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The volume may have been created or looked up before the region was settled
+	if volume != nil {
+		if err := checkVolumeRegion(volume, opts.Region); err != nil {
+			return nil, err
+		}
+	}
+
+	machineLaunchDone := timings.Track(PhaseMachineLaunch)
+	machine, err := flapsClient.Launch(ctx, getLaunchInput(target, opts, initScript, volume))
+	if err != nil {
+		if volume != nil && volumeCreated {
+			_, deleteErr := flapsClient.DeleteVolume(context.Background(), volume.ID)
+			if deleteErr != nil {
+				log.Warnf("Failed to delete volume %s after failed launch: %s", volume.ID, deleteErr)
+			}
+		}
+		if isBillingError(err) {
+			return nil, billingError(opts.OrgSlug, err)
+		}
+		return nil, err
+	}
+	machineLaunchDone()
+
+	return machine, nil
+}
+
+// createVolume creates the volume of the target in opts.Region and reports whether it was newly created.
+// The volume set as opts.VolumeId, or an unattached volume of the target left in the region, e.g. by a
+// reused app, is reused instead. Transient failures are retried, capacity errors are returned right away
+// so another region can be tried.
+func createVolume(ctx context.Context, flapsClient flapsAPI, target *models.Target, opts *types.TargetOptions, timings *PhaseTimings) (*fly.Volume, bool, error) {
+	volumeCreateDone := timings.Track(PhaseVolumeCreate)
+
+	if opts.VolumeId != "" {
+		volume, err := getExistingVolume(ctx, flapsClient, opts)
+		if err != nil {
+			return nil, false, err
+		}
+		log.Infof("Attaching existing volume %s in region %s", volume.ID, volume.Region)
+		volumeCreateDone()
+		return volume, false, nil
+	}
+
+	volume, err := findReusableVolume(ctx, flapsClient, target, opts)
+	if err != nil {
+		return nil, false, err
+	}
+	if volume != nil {
+		log.Infof("Reusing existing volume %s in region %s", volume.ID, opts.Region)
+		volumeCreateDone()
+		return volume, false, nil
+	}
+
+	// The snapshot is checked up front, a failed create can't tell a missing snapshot from an app that isn't ready
+	if opts.SnapshotId != "" {
+		snapshot, err := findSnapshot(ctx, opts)
+		if err != nil {
+			return nil, false, err
+		}
+		if sizeGb := (snapshot.Size + bytesPerGb - 1) / bytesPerGb; sizeGb > int(opts.DiskSize) {
+			return nil, false, fmt.Errorf("snapshot %s needs a %dGB volume but the disk size is %dGB", opts.SnapshotId, sizeGb, opts.DiskSize)
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		volume, err = flapsClient.CreateVolume(ctx, getVolumeRequest(target, opts))
+		if err == nil {
+			break
+		}
+
+		if attempt >= volumeCreateAttempts || !isRetriableCreateError(err) || isCapacityError(err) {
+			return nil, false, fmt.Errorf("failed to create data volume in region %s: %w", opts.Region, err)
+		}
+
+		log.Warnf("Creating data volume in region %s failed (attempt %d of %d), retrying: %s", opts.Region, attempt, volumeCreateAttempts, err)
+		select {
+		case <-ctx.Done():
+			return nil, false, fmt.Errorf("failed to create data volume in region %s: %w", opts.Region, ctx.Err())
+		case <-time.After(volumeCreateBackoff):
+		}
+	}
+
+	volumeCreateDone()
+
+	return volume, true, nil
+}
+
+// findSnapshot returns the snapshot set as opts.SnapshotId. Fly only lists snapshots per volume, so the snapshot
+// is looked up among the volumes of the daytona apps of the organization.
+func findSnapshot(ctx context.Context, opts *types.TargetOptions) (*fly.VolumeSnapshot, error) {
+	appNames, err := listDaytonaApps(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, appName := range appNames {
+		flapsClient, err := createFlapsClient(appName, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		volumes, err := flapsClient.GetVolumes(ctx)
+		if isNotFoundError(err) {
+			// The app of the target may still be being created
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list volumes of app %s: %w", appName, err)
+		}
+
+		for _, volume := range volumes {
+			snapshots, err := flapsClient.GetVolumeSnapshots(ctx, volume.ID)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list snapshots of volume %s: %w", volume.ID, err)
+			}
+			for _, snapshot := range snapshots {
+				if snapshot.ID == opts.SnapshotId {
+					return &snapshot, nil
+				}
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrSnapshotNotFound, opts.SnapshotId)
+}
+
+// findReusableVolume returns the existing volume of the target in opts.Region, or nil if there is none.
+// A volume that is still attached to a machine, or that would have to be restored from a snapshot, can't be reused.
+func findReusableVolume(ctx context.Context, flapsClient flapsAPI, target *models.Target, opts *types.TargetOptions) (*fly.Volume, error) {
+	volumes, err := flapsClient.GetVolumes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list volumes: %w", classifyAppError(err))
+	}
+
+	volumeName := getVolumeName(target.Id, opts)
+	for _, volume := range volumes {
+		if volume.Name != volumeName || volume.Region != opts.Region {
+			continue
+		}
+
+		if volume.IsAttached() {
+			return nil, fmt.Errorf("volume %s of the target already exists in region %s and is attached to another machine", volume.ID, opts.Region)
+		}
+		if opts.SnapshotId != "" {
+			return nil, fmt.Errorf("volume %s of the target already exists in region %s and can't be restored from snapshot %s", volume.ID, opts.Region, opts.SnapshotId)
+		}
+
+		return &volume, nil
+	}
+
+	return nil, nil
+}
+
+// getExistingVolume returns the volume set as opts.VolumeId, checking that it can be attached to a new
+// machine in opts.Region.
+func getExistingVolume(ctx context.Context, flapsClient flapsAPI, opts *types.TargetOptions) (*fly.Volume, error) {
+	volume, err := flapsClient.GetVolume(ctx, opts.VolumeId)
+	if err != nil {
+		var flapsErr *flaps.FlapsError
+		if errors.As(err, &flapsErr) && flapsErr.ResponseStatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("%w: %s does not exist in the target app", ErrVolumeNotFound, opts.VolumeId)
+		}
+		return nil, fmt.Errorf("failed to get volume %s: %w", opts.VolumeId, err)
+	}
+
+	if err := checkVolumeRegion(volume, opts.Region); err != nil {
+		return nil, err
+	}
+	if volume.IsAttached() {
+		return nil, fmt.Errorf("volume %s is attached to another machine", volume.ID)
+	}
+
+	return volume, nil
+}
+
+// checkVolumeRegion returns ErrVolumeRegionMismatch unless the volume is in the region, volumes are bound to the
+// region they were created in.
+func checkVolumeRegion(volume *fly.Volume, region string) error {
+	if volume.Region != region {
+		return fmt.Errorf("%w: volume %s is in region %s but the machine is launched in region %s", ErrVolumeRegionMismatch, volume.ID, volume.Region, region)
+	}
+	return nil
+}
+
+// getVolumeRequest returns the request used to create the volume for the provided target.
+func getVolumeRequest(target *models.Target, opts *types.TargetOptions) fly.CreateVolumeRequest {
+	sizeGb := int(opts.DiskSize)
+	encrypted := opts.VolumeEncrypted()
+	request := fly.CreateVolumeRequest{
+		Name:      getVolumeName(target.Id, opts),
+		SizeGb:    &sizeGb,
+		Region:    opts.Region,
+		Encrypted: &encrypted,
+	}
+	if opts.SnapshotRetention > 0 {
+		request.SnapshotRetention = &opts.SnapshotRetention
+	}
+	if opts.SnapshotId != "" {
+		request.SnapshotID = &opts.SnapshotId
+	}
+
+	return request
+}
+
+// getLaunchInput returns the input used to launch the machine for the provided target.
+func getLaunchInput(target *models.Target, opts *types.TargetOptions, initScript string, volume *fly.Volume) fly.LaunchMachineInput {
+	script := getMachineScript(opts, initScript)
+
+	image := opts.Image
+	if image == "" {
+		image = types.DefaultImage
+	}
+
+	config := &fly.MachineConfig{
+		VMSize: opts.MachineSize(),
+		// Digest pinned references are passed through unchanged
+		Image: image,
+		Init: fly.MachineInit{
+			Entrypoint: []string{"/bin/sh", "-c", script},
+		},
+		Env: getMachineEnv(target, opts),
+		// One-shot targets are destroyed by fly once the machine exits
+		AutoDestroy: opts.AutoDestroy,
+	}
+	config.Services = getMachineServices(opts)
+	// Targets without a persistent disk are launched without a volume
+	if volume != nil {
+		config.Mounts = []fly.MachineMount{
+			{
+				Name:   volume.Name,
+				Volume: volume.ID,
+				Path:   dockerDataPath(opts),
+				SizeGb: int(opts.DiskSize),
+				// Fly configures volume auto extend on the machine mount
+				ExtendThresholdPercent: opts.AutoExtendThreshold,
+				SizeGbLimit:            opts.AutoExtendSizeLimitGb,
+			},
+		}
+	}
+	// Labels are set first so the daytona keys win on conflict
+	config.Metadata = map[string]string{}
+	maps.Copy(config.Metadata, opts.Labels)
+	config.Metadata[ConfigChecksumMetadataKey] = ConfigChecksum(config)
+	if ttl, err := time.ParseDuration(opts.TTL); err == nil && ttl > 0 {
+		config.Metadata[ExpiresAtMetadataKey] = time.Now().Add(ttl).UTC().Format(time.RFC3339)
+	}
+
+	return fly.LaunchMachineInput{
+		Name:   getResourceName(target.Id, opts),
+		Config: config,
+		Region: opts.Region,
+	}
+}
+
+// getMachineScript generates the entrypoint script for the target machine.
+func getMachineScript(opts *types.TargetOptions, initScript string) string {
+	dataPath := dockerDataPath(opts)
+	user := agentUser(opts)
+	home := agentHome(opts)
+
+	// Without a persistent disk Docker data lives on the ephemeral root disk, so there is no mount to wait for
+	mountProbeScript := ""
+	if !opts.NoPersistentDisk {
+		mountProbeScript = fmt.Sprintf(`# Wait for the volume to be mounted
+i=0
+until grep -qs " %[2]s " /proc/mounts; do
+    i=$((i + 1))
+    if [ $i -ge %[1]d ]; then
+        echo "Timed out waiting for %[2]s to be mounted"
+        exit 1
+    fi
+    sleep 1
+done
+
+`, opts.MountProbeTimeout, dataPath)
+	}
+
+	preallocateScript := ""
+	if opts.PreallocateDockerData > 0 {
+		preallocateScript = fmt.Sprintf(`
+# Preallocate space for the Docker data directory on first boot
+if [ ! -f %[2]s/.daytona-preallocated ]; then
+    fallocate -l %[1]dG %[2]s/.daytona-preallocate && rm -f %[2]s/.daytona-preallocate
+    touch %[2]s/.daytona-preallocated
+fi
+`, opts.PreallocateDockerData, dataPath)
+	}
+
+	// Extra init commands run in their own shell so a failing command stops the setup with a message in the machine logs
+	extraInitScript := ""
+	for _, command := range opts.ExtraInitCommands {
+		quoted := shellQuote(command)
+		extraInitScript += fmt.Sprintf(`echo "Running extra init command:" %[1]s
+if ! sh -c %[1]s; then
+    echo "Extra init command failed:" %[1]s
+    exit 1
+fi
+`, quoted)
+	}
+	if extraInitScript != "" {
+		extraInitScript = "\n# Run the extra init commands\n" + extraInitScript
+	}
+
+	// dockerd-entrypoint.sh passes flag arguments through to dockerd
+	dockerdArgs := ""
+	if dataPath != types.DefaultDockerDataPath {
+		dockerdArgs = " --data-root " + dataPath
+	}
+	if opts.MTU > 0 {
+		dockerdArgs += fmt.Sprintf(" --mtu=%d", opts.MTU)
+	}
+	for _, arg := range opts.DockerDaemonArgs {
+		dockerdArgs += " " + shellQuote(arg)
+	}
+
+	// With an external Docker host the docker CLI and the agent use DOCKER_HOST, so no daemon is started
+	dockerStartScript := fmt.Sprintf(`# Start Docker daemon
+if command -v dockerd-entrypoint.sh > /dev/null 2>&1; then
+    dockerd-entrypoint.sh%[1]s &
+elif command -v dockerd > /dev/null 2>&1; then
+    dockerd%[1]s &
+else
+    echo "Unsupported image: Docker is not installed"
+    exit 1
+fi
+`, dockerdArgs)
+	if opts.DockerHost != "" {
+		dockerStartScript = fmt.Sprintf("# Docker runs on the external host %s\n", opts.DockerHost)
+	}
+
+	return fmt.Sprintf(`#!/bin/sh
+%[1]s# Wait for the network to be ready. The fly internal DNS answers on every machine, also when the package
+# mirrors or the download host are private, and getent ships with both glibc and musl images unlike nslookup
+i=0
+until getent hosts _api.internal > /dev/null 2>&1; do
+    i=$((i + 1))
+    if [ $i -ge %[2]d ]; then
+        echo "Timed out waiting for the network"
+        exit 1
+    fi
+    sleep 1
+done
+%[3]s
+# Install the packages needed by the daytona agent installer
+if command -v apk > /dev/null 2>&1; then
+    timeout %[4]d apk add --no-cache curl bash
+elif command -v apt-get > /dev/null 2>&1; then
+    timeout %[4]d sh -c "apt-get update && DEBIAN_FRONTEND=noninteractive apt-get install -y curl bash"
+else
+    echo "Unsupported image: neither apk nor apt-get is available to install curl and bash"
+    exit 1
+fi
+if ! command -v curl > /dev/null 2>&1 || ! command -v bash > /dev/null 2>&1; then
+    echo "Failed to install curl and bash within %[4]d seconds"
+    exit 1
+fi
+
+%[7]s
+# Wait for Docker to be ready
+i=0
+while ! docker info > /dev/null 2>&1; do
+    i=$((i + 1))
+    if [ $i -ge %[5]d ]; then
+        echo "%[12]s"
+        exit 1
+    fi
+    echo "Waiting for Docker to start..."
+    sleep 1
+done
+
+# Create the agent user unless the image already has it, BusyBox images only provide adduser
+if id %[8]s > /dev/null 2>&1; then
+    if command -v usermod > /dev/null 2>&1; then
+        usermod -aG docker %[8]s
+    else
+        addgroup %[8]s docker
+    fi
+elif command -v useradd > /dev/null 2>&1; then
+    useradd -m -d %[9]s -s /bin/bash -G docker %[8]s
+else
+    adduser -D -h %[9]s -G docker %[8]s
+fi
+
+# Download and install daytona agent
+%[6]s
+%[10]s
+# Switch to the agent user and run Daytona agent
+su %[8]s -c %[11]s
+`, mountProbeScript, opts.NetworkProbeTimeout, preallocateScript, packageInstallTimeout, dockerStartTimeout(opts), initScript, dockerStartScript, user, home, extraInitScript, doubleQuote(agentCommand(opts)), dockerStartTimeoutMessage)
+}
+
+// agentCommand returns the command running the daytona agent with the agent args of the options.
+// Each arg is quoted, so it reaches the agent as a single argument.
+func agentCommand(opts *types.TargetOptions) string {
+	command := "daytona agent --target"
+	for _, arg := range opts.AgentArgs {
+		command += " " + shellQuote(arg)
+	}
+	return command
+}
+
+// shellQuote quotes the value as a single shell word.
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'"'"'`) + "'"
+}
+
+// doubleQuote quotes the value as a single shell word in double quotes, escaping the characters the shell
+// still interprets within them.
+func doubleQuote(value string) string {
+	return `"` + doubleQuoteEscaper.Replace(value) + `"`
+}
+
+var doubleQuoteEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`")
+
+// dockerStartTimeout returns the number of seconds the machine script waits for Docker, falling back to the default.
+func dockerStartTimeout(opts *types.TargetOptions) int {
+	if opts.DockerStartTimeout == 0 {
+		return types.DefaultDockerStartTimeout
+	}
+	return opts.DockerStartTimeout
+}
+
+// agentUser returns the user the daytona agent runs as, falling back to the default.
+func agentUser(opts *types.TargetOptions) string {
+	if opts.AgentUser == "" {
+		return types.DefaultAgentUser
+	}
+	return opts.AgentUser
+}
+
+// agentHome returns the home directory of the agent user, defaulting to /home/<user>.
+func agentHome(opts *types.TargetOptions) string {
+	if opts.AgentHome == "" {
+		return "/home/" + agentUser(opts)
+	}
+	return opts.AgentHome
+}
+
+// dockerDataPath returns the mount path of the data volume, falling back to the default.
+func dockerDataPath(opts *types.TargetOptions) string {
+	if opts.DockerDataPath == "" {
+		return types.DefaultDockerDataPath
+	}
+	return opts.DockerDataPath
+}
+
+// ConfigChecksum computes a checksum of the drift-relevant parts of the machine config.
+// Metadata is excluded so the checksum can be stored in the machine metadata itself.
+func ConfigChecksum(config *fly.MachineConfig) string {
+	guest := config.Guest
+	if guest == nil {
+		guest = fly.MachinePresets[config.VMSize]
+	}
+
+	type checksumMount struct {
+		Name   string
+		Path   string
+		SizeGb int
+	}
+	mounts := []checksumMount{}
+	for _, mount := range config.Mounts {
+		mounts = append(mounts, checksumMount{Name: mount.Name, Path: mount.Path, SizeGb: mount.SizeGb})
+	}
+
+	// json.Marshal sorts map keys, so identical configs always produce the same checksum
+	data, _ := json.Marshal(struct {
+		Image      string
+		Guest      *fly.MachineGuest
+		Mounts     []checksumMount
+		Entrypoint []string
+		Env        map[string]string
+	}{
+		Image:      config.Image,
+		Guest:      guest,
+		Mounts:     mounts,
+		Entrypoint: config.Init.Entrypoint,
+		Env:        config.Env,
+	})
+
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+// HasConfigDrift reports whether the live machine config differs from the config checksum
+// stored at create time. Machines without a stored checksum are not considered drifted.
+func HasConfigDrift(machine *fly.Machine) bool {
+	if machine.Config == nil {
+		return false
+	}
+
+	checksum, ok := machine.Config.Metadata[ConfigChecksumMetadataKey]
+	if !ok {
+		return false
+	}
+
+	return ConfigChecksum(machine.Config) != checksum
+}
+
+// getMachineServices maps the Services option to the fly services of the machine config.
+func getMachineServices(opts *types.TargetOptions) []fly.MachineService {
+	var services []fly.MachineService
+	for _, service := range opts.Services {
+		services = append(services, fly.MachineService{
+			Protocol:     "tcp",
+			InternalPort: service.InternalPort,
+			Ports: []fly.MachinePort{
+				{Port: fly.Pointer(service.Port), Handlers: service.Handlers},
+			},
+		})
+	}
+	return services
+}
+
+// getMachineEnv merges the extra target options env with the target env vars.
+// Target env vars take precedence over the extra env, and the Docker TLS settings
+// required by the provider take precedence over both.
+func getMachineEnv(target *models.Target, opts *types.TargetOptions) map[string]string {
+	envVars := map[string]string{}
+	maps.Copy(envVars, opts.ExtraEnv)
+	maps.Copy(envVars, target.EnvVars)
+
+	// Disable running docker with TLS
+	envVars["DOCKER_TLS_VERIFY"] = ""
+	envVars["DOCKER_TLS_CERTDIR"] = ""
+
+	if opts.DockerHost != "" {
+		envVars["DOCKER_HOST"] = opts.DockerHost
+	}
+
+	if region := opts.AppPrimaryRegion(); region != "" {
+		envVars["PRIMARY_REGION"] = region
+	}
+
+	return envVars
+}
+
+// GetMachine returns the machine for the provided target.
+func GetMachine(target *models.Target, opts *types.TargetOptions) (*fly.Machine, error) {
+	appName := getAppName(target.Id, opts)
+	flapsClient, err := createFlapsClient(appName, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	machineName := getResourceName(target.Id, opts)
+	return findMachine(flapsClient, machineName)
+}
+
+// GetAppName returns the name of the fly app of the provided target.
+func GetAppName(target *models.Target, opts *types.TargetOptions) string {
+	return getAppName(target.Id, opts)
+}
+
+// GetVolume returns the fly volume with the given id from the target app.
+func GetVolume(target *models.Target, opts *types.TargetOptions, volumeId string) (*fly.Volume, error) {
+	appName := getAppName(target.Id, opts)
+	flapsClient, err := createFlapsClient(appName, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return flapsClient.GetVolume(context.Background(), volumeId)
+}
+
+// ListVolumeSnapshots returns the available snapshots of the target's data volume.
+func ListVolumeSnapshots(target *models.Target, opts *types.TargetOptions) ([]fly.VolumeSnapshot, error) {
+	appName := getAppName(target.Id, opts)
+	flapsClient, err := createFlapsClient(appName, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	volume, err := findTargetVolume(flapsClient, target.Id, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return flapsClient.GetVolumeSnapshots(context.Background(), volume.ID)
+}
+
+// findTargetVolume returns the data volume of the target, the volume set as opts.VolumeId or else the volume
+// named after the target.
+func findTargetVolume(flapsClient flapsAPI, targetId string, opts *types.TargetOptions) (*fly.Volume, error) {
+	if opts.VolumeId != "" {
+		volume, err := flapsClient.GetVolume(context.Background(), opts.VolumeId)
+		if err != nil {
+			var flapsErr *flaps.FlapsError
+			if errors.As(err, &flapsErr) && flapsErr.ResponseStatusCode == http.StatusNotFound {
+				return nil, fmt.Errorf("%w: %s does not exist in the target app", ErrVolumeNotFound, opts.VolumeId)
+			}
+			return nil, classifyAppError(err)
+		}
+		return volume, nil
+	}
+
+	volumeName := getVolumeName(targetId, opts)
+	volume, err := findVolume(flapsClient, volumeName)
+	if err != nil {
+		return nil, classifyAppError(err)
+	}
+	if volume == nil {
+		return nil, fmt.Errorf("volume %s not found", volumeName)
+	}
+
+	return volume, nil
+}
+
+// ExtendVolume extends the data volume of the workspace's target to the new size, so a full Docker data disk
+// doesn't require recreating the target. The machine is restarted when fly reports dockerd can only see the
+// larger filesystem after a restart. Volumes can't be shrunk.
+func ExtendVolume(workspace *models.Workspace, opts *types.TargetOptions, newSizeGb int) error {
+	if opts.NoPersistentDisk {
+		return fmt.Errorf("target %s has no data volume", workspace.TargetId)
+	}
+	if newSizeGb > types.MaxDiskSize {
+		return fmt.Errorf("volume size %dGB exceeds the maximum of %dGB", newSizeGb, types.MaxDiskSize)
+	}
+
+	appName := getAppName(workspace.TargetId, opts)
+	flapsClient, err := createFlapsClient(appName, opts)
+	if err != nil {
+		return err
+	}
+
+	volume, err := findTargetVolume(flapsClient, workspace.TargetId, opts)
+	if err != nil {
+		return err
+	}
+
+	if newSizeGb <= volume.SizeGb {
+		return fmt.Errorf("volume size %dGB must be larger than the current size of %dGB, volumes can't be shrunk", newSizeGb, volume.SizeGb)
+	}
+
+	log.Infof("Extending volume %s from %dGB to %dGB", volume.ID, volume.SizeGb, newSizeGb)
+	_, needsRestart, err := flapsClient.ExtendVolume(context.Background(), volume.ID, newSizeGb)
+	if err != nil {
+		return err
+	}
+
+	if !needsRestart {
+		return nil
+	}
+
+	machine, err := findMachine(flapsClient, getResourceName(workspace.TargetId, opts))
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Restarting machine %s so dockerd sees the extended volume", machine.ID)
+	err = flapsClient.Restart(context.Background(), fly.RestartMachineInput{ID: machine.ID}, "")
+	if err != nil {
+		return err
+	}
+
+	return waitForMachineState(flapsClient, machine, fly.MachineStateStarted, machineStartTimeout)
+}
+
+// GettargetLogs fetches app logs for a specified target machine and writes the fetched log entries to the logger.
+func GetTargetLogs(target *models.Target, opts *types.TargetOptions, machineId string, logger io.Writer) error {
+	return StreamTargetLogs(context.Background(), target, opts, machineId, logger)
+}
+
+// StreamTargetLogs streams app logs for a specified target machine to out until the context is cancelled.
+// It returns nil once the context is cancelled and the log writer goroutine has exited.
+func StreamTargetLogs(ctx context.Context, target *models.Target, opts *types.TargetOptions, machineId string, out io.Writer) error {
+	appName := getAppName(target.Id, opts)
+	client, err := createFlyClient(appName, opts)
+	if err != nil {
+		return err
+	}
+
+	outLog := make(chan string)
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		for entry := range outLog {
+			out.Write([]byte(entry))
+		}
+	}()
+
+	err = pollLogs(ctx, outLog, client, appName, opts.Region, machineId)
+	close(outLog)
+	<-writerDone
+
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return err
+}
+
+// GetLogsSince returns the app logs of the target machine logged between since and until.
+// Unlike StreamTargetLogs it does not tail, it pages through the logs retained by fly and stops once
+// an entry passes until or the next page token stops advancing.
+func GetLogsSince(ctx context.Context, target *models.Target, opts *types.TargetOptions, machineId string, since, until time.Time) ([]fly.LogEntry, error) {
+	appName := getAppName(target.Id, opts)
+	client, err := createFlyClient(appName, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return getAppLogsBetween(ctx, client, appName, opts.Region, machineId, since, until)
+}
+
+// getAppLogsBetween pages through the logs of the machine of the app, returning the entries with a timestamp
+// between since and until. Rate limited requests are retried up to logRateLimitRetries times once the delay
+// requested by the API has passed.
+func getAppLogsBetween(ctx context.Context, client *fly.Client, appName, region, machineId string, since, until time.Time) ([]fly.LogEntry, error) {
+	entries := []fly.LogEntry{}
+	var token string
+	retries := 0
+	for {
+		var retryAfter time.Duration
+		page, nextToken, err := client.GetAppLogs(context.WithValue(ctx, retryAfterKey{}, &retryAfter), appName, token, region, machineId)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+
+			retryAfter, ok := logRetryDelay(err, retryAfter)
+			if !ok {
+				return nil, err
+			}
+			if retries == logRateLimitRetries {
+				return nil, fmt.Errorf("fetching logs of app %s is still rate limited after %d retries: %w", appName, retries, err)
+			}
+			retries++
+			log.Warnf("Fetching logs of app %s is rate limited, retrying in %s", appName, retryAfter)
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(retryAfter):
+			}
+			continue
+		}
+
+		for _, entry := range page {
+			timestamp, err := time.Parse(time.RFC3339Nano, entry.Timestamp)
+			if err != nil || timestamp.Before(since) {
+				continue
+			}
+			if timestamp.After(until) {
+				return entries, nil
+			}
+			entries = append(entries, entry)
+		}
+
+		if nextToken == "" || nextToken == token {
+			return entries, nil
+		}
+		token = nextToken
+	}
+}
 
-	err = flapsClient.CreateApp(context.Background(), appName, opts.OrgSlug)
+// DockerStartTimedOut reports whether the machine logs since the given time show that the machine script
+// gave up waiting for Docker to become ready.
+func DockerStartTimedOut(ctx context.Context, target *models.Target, opts *types.TargetOptions, machineId string, since time.Time) (bool, error) {
+	entries, err := GetLogsSince(ctx, target, opts, machineId, since, time.Now())
 	if err != nil {
-		return nil, err
+		return false, err
 	}
 
-	err = flapsClient.WaitForApp(context.Background(), appName)
-	if err != nil {
-		return nil, err
+	for _, entry := range entries {
+		if strings.Contains(entry.Message, dockerStartTimeoutMessage) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// logRetryDelay returns the delay before retrying a rate limited log request, the delay requested
+// by the API or logPollInterval. It returns false if err is not a rate limit error.
+func logRetryDelay(err error, retryAfter time.Duration) (time.Duration, bool) {
+	var apiErr *fly.ApiError
+	if !errors.As(err, &apiErr) || apiErr.Status != http.StatusTooManyRequests {
+		return 0, false
+	}
+	if retryAfter <= 0 {
+		retryAfter = logPollInterval
 	}
+	return retryAfter, true
+}
 
-	machine, err := createMachine(target, opts, initScript)
+// NearestRegion returns the code of the fly region nearest to the caller.
+func NearestRegion(opts *types.TargetOptions) (string, error) {
+	client, err := createFlyClient("", opts)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	err = flapsClient.Wait(context.Background(), machine, fly.MachineStateStarted, time.Minute*5)
+	region, err := client.GetNearestRegion(context.Background())
 	if err != nil {
-		return nil, err
+		return "", fmt.Errorf("failed to resolve nearest region: %w", err)
 	}
 
-	return machine, nil
+	return region.Code, nil
 }
 
-// Starttarget starts the machine for the provided target.
-func StartTarget(target *models.Target, opts *types.TargetOptions) error {
-	appName := getResourceName(target.Id)
-	flapsClient, err := createFlapsClient(appName, opts.AuthToken)
+// ValidateSizeRegion checks with fly's placement API that the machine size can be launched in the region
+// or one of the fallback regions of the target options, so unavailable sizes such as GPUs missing from a
+// region fail before any resource is created. It returns ErrSizeNotAvailable with the regions offering the size.
+func ValidateSizeRegion(opts *types.TargetOptions) error {
+	size := opts.MachineSize()
+	guest, ok := fly.MachinePresets[size]
+	if !ok {
+		return fmt.Errorf("unknown machine size %s", size)
+	}
+
+	flapsClient, err := createFlapsClient("", opts)
 	if err != nil {
 		return err
 	}
 
-	err = flapsClient.WaitForApp(context.Background(), appName)
+	// TODO: use placements method from flaps client when implemented in sdk
+	body := map[string]any{
+		"compute":  guest,
+		"count":    1,
+		"org_slug": opts.OrgSlug,
+	}
+	var result struct {
+		Regions []struct {
+			Region string `json:"region"`
+			Count  int    `json:"count"`
+		} `json:"regions"`
+	}
+	req, err := flapsClient.NewRequest(context.Background(), http.MethodPost, "/placements", body, nil)
 	if err != nil {
-		return fmt.Errorf("there was an issue waiting for the app: %w", err)
+		return err
 	}
 
-	machineName := getResourceName(target.Id)
-	machine, err := findMachine(flapsClient, machineName)
+	httpClient, err := createFlapsHttpClient(opts)
 	if err != nil {
 		return err
 	}
 
-	// Start the machine if it is stopped
-	if machine.State == fly.MachineStateStopped {
-		_, err = flapsClient.Start(context.Background(), machine.ID, "")
-		if err != nil {
-			return err
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d while checking the availability of size %s", resp.StatusCode, size)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return err
+	}
+
+	available := []string{}
+	for _, placement := range result.Regions {
+		if placement.Count > 0 {
+			available = append(available, placement.Region)
 		}
 	}
 
-	return nil
+	regions := append([]string{opts.Region}, opts.RegionFallback...)
+	for _, region := range regions {
+		if slices.Contains(available, region) {
+			return nil
+		}
+	}
+
+	slices.Sort(available)
+	if len(available) == 0 {
+		return fmt.Errorf("%w: size %s not available in any region", ErrSizeNotAvailable, size)
+	}
+	return fmt.Errorf("%w: size %s not available in %s; available in %s", ErrSizeNotAvailable, size, strings.Join(regions, ", "), strings.Join(available, ", "))
 }
 
-// Stoptarget stops the machine for the provided target.
-func StopTarget(target *models.Target, opts *types.TargetOptions) error {
-	appName := getResourceName(target.Id)
-	flapsClient, err := createFlapsClient(appName, opts.AuthToken)
+// ValidateToken does an authenticated request to the fly API to check that the auth token is accepted.
+func ValidateToken(opts *types.TargetOptions) error {
+	client, err := createFlyClient("", opts)
 	if err != nil {
 		return err
 	}
 
-	machineName := getResourceName(target.Id)
-	machine, err := findMachine(flapsClient, machineName)
+	_, err = client.GetCurrentUser(context.Background())
+	if err == nil {
+		return nil
+	}
+
+	if isNotAuthenticatedError(err) {
+		return fmt.Errorf("%w: %w", ErrInvalidAuth, err)
+	}
+
+	return fmt.Errorf("failed to reach the fly api: %w", err)
+}
+
+// graphqlUnauthorizedSuffix ends the error of the fly GraphQL client for a 401 response, which carries no status field.
+var graphqlUnauthorizedSuffix = fmt.Sprintf("non-200 status code: %d", http.StatusUnauthorized)
+
+// isNotAuthenticatedError reports whether the fly API rejected the auth token of a request.
+func isNotAuthenticatedError(err error) bool {
+	message := strings.ToLower(err.Error())
+	return fly.IsNotAuthenticatedError(err) || strings.HasSuffix(message, graphqlUnauthorizedSuffix) || strings.Contains(message, "must be authenticated")
+}
+
+// ValidateOrg checks that the auth token may access the org of the target options.
+// Tokens scoped to an app or to another org can't create apps in the org and return ErrInsufficientScope.
+func ValidateOrg(opts *types.TargetOptions) error {
+	client, err := createFlyClient("", opts)
 	if err != nil {
 		return err
 	}
 
-	return flapsClient.Stop(context.Background(), fly.StopMachineInput{ID: machine.ID}, "")
+	_, err = client.GetOrganizationBySlug(context.Background(), opts.OrgSlug)
+	if err == nil {
+		return nil
+	}
+
+	if isNotAuthenticatedError(err) {
+		return fmt.Errorf("%w: %w", ErrInvalidAuth, err)
+	}
+	// Scoped tokens don't see the orgs they have no access to
+	if message := strings.ToLower(err.Error()); strings.Contains(message, "could not find") || strings.Contains(message, "not found") {
+		return fmt.Errorf("%w: this token cannot access org %s; check the org slug or use an org deploy token (fly tokens create org -o %s): %w",
+			ErrInsufficientScope, opts.OrgSlug, opts.OrgSlug, err)
+	}
+
+	return classifyScopeError(opts.OrgSlug, err)
 }
 
-// Deletetarget deletes the app associated with the provided target.
-func DeleteTarget(target *models.Target, opts *types.TargetOptions) error {
-	appName := getResourceName(target.Id)
-	flapsClient, err := createFlapsClient(appName, opts.AuthToken)
+// classifyScopeError wraps errors of a token that is not permitted to act on the org with ErrInsufficientScope
+// and guidance on the token to use instead. Other errors are returned unchanged.
+func classifyScopeError(orgSlug string, err error) error {
+	var flapsErr *flaps.FlapsError
+	isForbidden := errors.As(err, &flapsErr) && flapsErr.ResponseStatusCode == http.StatusForbidden
+
+	message := strings.ToLower(err.Error())
+	if !isForbidden && !strings.Contains(message, "not authorized") && !strings.Contains(message, "permission") {
+		return err
+	}
+
+	return fmt.Errorf("%w: this token cannot create apps in org %s; use an org deploy token (fly tokens create org -o %s): %w",
+		ErrInsufficientScope, orgSlug, orgSlug, err)
+}
+
+// billingMarkers are the parts of the fly API error messages returned when the org can't be billed.
+var billingMarkers = []string{"payment information", "payment method", "credit card", "organization is suspended", "organization has been suspended"}
+
+// isBillingError reports whether the fly API rejected the request because the org has no payment method
+// or is blocked. The machines API reports it as 402, GraphQL errors only carry the message.
+func isBillingError(err error) bool {
+	var flapsErr *flaps.FlapsError
+	if errors.As(err, &flapsErr) && flapsErr.ResponseStatusCode == http.StatusPaymentRequired {
+		return true
+	}
+
+	message := strings.ToLower(err.Error())
+	if errors.As(err, &flapsErr) {
+		message += " " + strings.ToLower(string(flapsErr.ResponseBody))
+	}
+	for _, marker := range billingMarkers {
+		if strings.Contains(message, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// billingError wraps the billing error of the fly API with guidance to add a payment method to the org.
+func billingError(orgSlug string, err error) error {
+	return fmt.Errorf("%w, add one at https://fly.io/dashboard/%s/billing: %w", ErrBillingRequired, orgSlug, err)
+}
+
+// setAppSecrets sets the target secrets as fly app secrets so they are injected into the
+// machine at boot instead of being stored in the machine config env.
+func setAppSecrets(appName string, opts *types.TargetOptions) error {
+	client, err := createFlyClient(appName, opts)
 	if err != nil {
 		return err
 	}
 
-	// TODO: use delete method from flaps client when implemented in sdk
-	path := fmt.Sprintf("/apps/%s", appName)
-	req, err := flapsClient.NewRequest(context.Background(), http.MethodDelete, path, nil, nil)
+	_, err = client.SetSecrets(context.Background(), appName, opts.Secrets)
+	if err != nil {
+		return fmt.Errorf("failed to set app secrets: %w", err)
+	}
+
+	return nil
+}
+
+// releasePublicIPs releases every public IP address allocated to the app.
+// Private addresses, used for flycast, are kept.
+func releasePublicIPs(appName string, opts *types.TargetOptions) error {
+	client, err := createFlyClient(appName, opts)
 	if err != nil {
 		return err
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	ips, err := client.GetIPAddresses(context.Background(), appName)
+	if err != nil {
+		return fmt.Errorf("failed to list app ip addresses: %w", err)
+	}
+
+	for _, ip := range ips {
+		if ip.Type == "private_v6" {
+			continue
+		}
+
+		err = client.ReleaseIPAddress(context.Background(), appName, ip.Address)
+		if err != nil {
+			return fmt.Errorf("failed to release public ip %s: %w", ip.Address, err)
+		}
+	}
+
+	return nil
+}
+
+// allocateServiceIPs allocates a shared IPv4 and an IPv6 address to the app, so fly's edge routes the
+// services of the machine. Apps that already have a public IP address are left unchanged.
+func allocateServiceIPs(appName string, opts *types.TargetOptions) error {
+	client, err := createFlyClient(appName, opts)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusAccepted {
-		return fmt.Errorf("unexpected error while deleting the app status code: %d", resp.StatusCode)
+	ips, err := client.GetIPAddresses(context.Background(), appName)
+	if err != nil {
+		return fmt.Errorf("failed to list app ip addresses: %w", err)
+	}
+
+	for _, ip := range ips {
+		if ip.Type != "private_v6" {
+			return nil
+		}
+	}
+
+	_, err = client.AllocateSharedIPAddress(context.Background(), appName)
+	if err != nil {
+		return fmt.Errorf("failed to allocate shared ipv4 address: %w", err)
+	}
+
+	_, err = client.AllocateIPAddress(context.Background(), appName, "v6", "", nil, "")
+	if err != nil {
+		return fmt.Errorf("failed to allocate ipv6 address: %w", err)
 	}
 
 	return nil
 }
 
-// createMachine creates a new machine for the provided target.
-func createMachine(target *models.Target, opts *types.TargetOptions, initScript string) (*fly.Machine, error) {
-	appName := getResourceName(target.Id)
-	flapsClient, err := createFlapsClient(appName, opts.AuthToken)
+// createFlyClient creates a new fly api client.
+func createFlyClient(appName string, opts *types.TargetOptions) (*fly.Client, error) {
+	transport, err := getHttpTransport(opts)
 	if err != nil {
 		return nil, err
 	}
 
-	volume, err := flapsClient.CreateVolume(context.Background(), fly.CreateVolumeRequest{
-		Name:   getVolumeName(target.Id),
-		SizeGb: &opts.DiskSize,
-		Region: opts.Region,
-	})
+	apiBaseUrl := flyApiBaseUrl
+	if opts.ApiBaseUrl != "" {
+		apiBaseUrl = opts.ApiBaseUrl
+	}
+
+	fly.SetBaseURL(apiBaseUrl)
+	return fly.NewClientFromOptions(fly.ClientOptions{
+		Tokens:    tokens.Parse(opts.AuthToken),
+		Name:      appName,
+		Version:   internal.Version,
+		BaseURL:   apiBaseUrl,
+		Transport: &fly.Transport{UnderlyingTransport: &rateLimitTransport{next: transport}},
+	}), nil
+}
+
+// createFlapsHttpClient creates an http client for machines API requests the flaps client has no method for.
+func createFlapsHttpClient(opts *types.TargetOptions) (*http.Client, error) {
+	transport, err := getFlapsTransport(opts)
 	if err != nil {
 		return nil, err
 	}
 
-	script := fmt.Sprintf(`#!/bin/sh
-# Start Docker daemon
-dockerd-entrypoint.sh &
+	return &http.Client{Transport: transport}, nil
+}
 
-# Wait for Docker to be ready
-while ! docker info > /dev/null 2>&1; do
-    echo "Waiting for Docker to start..."
-    sleep 1
-done
+// getFlapsTransport returns the transport for machines API requests, redirecting them to opts.FlapsBaseUrl if set.
+func getFlapsTransport(opts *types.TargetOptions) (http.RoundTripper, error) {
+	transport, err := getHttpTransport(opts)
+	if err != nil {
+		return nil, err
+	}
 
-# Create daytona user and add to docker group
-adduser -D -G docker daytona
+	if opts.FlapsBaseUrl == "" {
+		return transport, nil
+	}
 
-# Download and install daytona agent
-%s
+	// The flaps client only reads its base url from the environment, so requests are redirected instead
+	baseUrl, err := url.Parse(opts.FlapsBaseUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid flaps base url: %w", err)
+	}
+	return &baseUrlTransport{baseUrl: baseUrl, next: transport}, nil
+}
 
-# Switch to daytona user and run Daytona agent
-su daytona -c "daytona agent --target"
-`, initScript)
+// getHttpTransport returns the transport for fly API requests. Unless a custom transport is set,
+// requests go through opts.ProxyUrl, or the proxy from the HTTP_PROXY and HTTPS_PROXY environment variables.
+func getHttpTransport(opts *types.TargetOptions) (http.RoundTripper, error) {
+	if opts.Transport != nil {
+		return opts.Transport, nil
+	}
 
-	envVars := target.EnvVars
-	// Disable running docker with TLS
-	envVars["DOCKER_TLS_VERIFY"] = ""
-	envVars["DOCKER_TLS_CERTDIR"] = ""
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if opts.ProxyUrl != "" {
+		proxyUrl, err := url.Parse(opts.ProxyUrl)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyUrl)
+	}
+	return transport, nil
+}
 
-	return flapsClient.Launch(context.Background(), fly.LaunchMachineInput{
-		Name: getResourceName(target.Id),
-		Config: &fly.MachineConfig{
-			VMSize: opts.Size,
-			Image:  "docker:dind",
-			Mounts: []fly.MachineMount{
-				{
-					Name:   volume.Name,
-					Volume: volume.ID,
-					Path:   "/var/lib/docker",
-					SizeGb: opts.DiskSize,
-				},
-			},
-			Init: fly.MachineInit{
-				Entrypoint: []string{"/bin/sh", "-c", script},
-			},
-			Env: envVars,
-		},
-		Region: opts.Region,
-	})
+// baseUrlTransport sends requests to baseUrl, keeping the request path below the base url path.
+type baseUrlTransport struct {
+	baseUrl *url.URL
+	next    http.RoundTripper
 }
 
-// GetMachine returns the machine for the provided target.
-func GetMachine(target *models.Target, opts *types.TargetOptions) (*fly.Machine, error) {
-	appName := getResourceName(target.Id)
-	flapsClient, err := createFlapsClient(appName, opts.AuthToken)
+func (t *baseUrlTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = t.baseUrl.Scheme
+	req.URL.Host = t.baseUrl.Host
+	req.URL.Path = strings.TrimSuffix(t.baseUrl.Path, "/") + req.URL.Path
+	req.URL.RawPath = ""
+	req.Host = t.baseUrl.Host
+
+	return t.next.RoundTrip(req)
+}
+
+// retryAfterKey is the context key of the *time.Duration a rateLimitTransport stores the Retry-After delay in.
+type retryAfterKey struct{}
+
+// rateLimitTransport records the Retry-After delay of rate limited responses, as the fly client
+// only returns the status code to its callers.
+type rateLimitTransport struct {
+	next http.RoundTripper
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+		return resp, err
+	}
+
+	if retryAfter, ok := req.Context().Value(retryAfterKey{}).(*time.Duration); ok {
+		*retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	}
+	return resp, nil
+}
+
+// parseRetryAfter returns the delay of a Retry-After header, given either in seconds or as an http date.
+// It returns 0 if the header is empty or invalid.
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(header); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+
+	return 0
+}
+
+// findMachine finds the machine with the provided name. Targets have a single machine, so more than one
+// machine with the name that is not destroyed is reported as ErrMultipleMachines.
+func findMachine(flapsClient flapsAPI, machineName string) (*fly.Machine, error) {
+	machineList, err := flapsClient.List(context.Background(), "")
 	if err != nil {
-		return nil, err
+		return nil, classifyAppError(err)
 	}
 
-	machineName := getResourceName(target.Id)
-	return findMachine(flapsClient, machineName)
+	return selectMachine(machineList, machineName)
 }
 
-// GettargetLogs fetches app logs for a specified target machine and writes the fetched log entries to the logger.
-func GetTargetLogs(target *models.Target, opts *types.TargetOptions, machineId string, logger io.Writer) error {
-	appName := getResourceName(target.Id)
+// findMachineForDeletion finds the machine with the provided name like findMachine, but falls back to a destroyed
+// machine with the name, so callers deleting the machine can tell it is already destroyed.
+func findMachineForDeletion(flapsClient flapsAPI, machineName string) (*fly.Machine, error) {
+	machineList, err := flapsClient.List(context.Background(), "")
+	if err != nil {
+		return nil, classifyAppError(err)
+	}
 
-	fly.SetBaseURL("https://api.fly.io")
-	client := fly.NewClientFromOptions(fly.ClientOptions{
-		Tokens:  tokens.Parse(opts.AuthToken),
-		Name:    appName,
-		Version: internal.Version,
-	})
+	machine, err := selectMachine(machineList, machineName)
+	if errors.Is(err, ErrMachineNotFound) {
+		for _, m := range machineList {
+			if m.Name == machineName {
+				return m, nil
+			}
+		}
+	}
+	return machine, err
+}
 
-	outLog := make(chan string)
-	go func() {
-		for entry := range outLog {
-			logger.Write([]byte(entry))
+// selectMachine returns the machine of the list with the provided name that is not destroyed.
+func selectMachine(machineList []*fly.Machine, machineName string) (*fly.Machine, error) {
+	if len(machineList) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrAppHasNoMachines, machineName)
+	}
+
+	var matches []*fly.Machine
+	for _, m := range machineList {
+		if m.Name == machineName && m.State != fly.MachineStateDestroyed {
+			matches = append(matches, m)
 		}
-	}()
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("%w: %s", ErrMachineNotFound, machineName)
+	case 1:
+		return matches[0], nil
+	}
+
+	ids := make([]string, len(matches))
+	for i, m := range matches {
+		ids[i] = m.ID
+	}
+	return nil, fmt.Errorf("%w: %s is the name of machines %s", ErrMultipleMachines, machineName, strings.Join(ids, ", "))
+}
+
+// findVolume returns the volume of the app with the name, or nil if there is none.
+func findVolume(flapsClient flapsAPI, name string) (*fly.Volume, error) {
+	volumes, err := flapsClient.GetVolumes(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, volume := range volumes {
+		if volume.Name == name {
+			return &volume, nil
+		}
+	}
+	return nil, nil
+}
+
+// classifyAppError wraps errors of app level flaps requests with ErrAppNotFound, ErrInvalidAuth or
+// ErrInsufficientScope when the app does not exist, the auth token was rejected or the token may not
+// access the app. A 403 means the token is valid but lacks the scope, as in classifyScopeError.
+func classifyAppError(err error) error {
+	var flapsErr *flaps.FlapsError
+	if !errors.As(err, &flapsErr) {
+		return err
+	}
+
+	switch flapsErr.ResponseStatusCode {
+	case http.StatusUnauthorized:
+		return fmt.Errorf("%w: %w", ErrInvalidAuth, err)
+	case http.StatusForbidden:
+		return fmt.Errorf("%w: %w", ErrInsufficientScope, err)
+	case http.StatusNotFound:
+		return fmt.Errorf("%w: %w", ErrAppNotFound, err)
+	}
+
+	return err
+}
+
+// waitForMachineState waits for the machine to reach the provided state within the timeout.
+func waitForMachineState(flapsClient flapsAPI, machine *fly.Machine, state string, timeout time.Duration) error {
+	err := flapsClient.Wait(context.Background(), machine, state, timeout)
+	if err == nil {
+		return nil
+	}
 
-	return pollLogs(outLog, client, appName, opts.Region, machineId)
+	var flapsErr *flaps.FlapsError
+	if errors.As(err, &flapsErr) && flapsErr.ResponseStatusCode == http.StatusRequestTimeout {
+		return fmt.Errorf("timeout: machine %s did not reach %s state after %f minutes", machine.ID, state, timeout.Minutes())
+	}
+
+	return err
 }
 
-// createFlapsClient creates a new flaps client.
-func createFlapsClient(appName string, accessToken string) (*flaps.Client, error) {
-	return flaps.NewWithOptions(context.Background(), flaps.NewClientOpts{
-		AppName: appName,
-		Tokens:  tokens.Parse(accessToken),
-		Logger:  log.New(),
+// createApp creates the fly app of the target. The machines API can't set the primary region of an app,
+// so apps with a Primary Region option are created through the GraphQL API instead.
+func createApp(ctx context.Context, flapsClient flapsAPI, appName string, opts *types.TargetOptions) error {
+	if opts.PrimaryRegion == "" {
+		return flapsClient.CreateApp(ctx, appName, opts.OrgSlug)
+	}
+
+	client, err := createFlyClient(appName, opts)
+	if err != nil {
+		return err
+	}
+
+	org, err := client.GetOrganizationBySlug(ctx, opts.OrgSlug)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.CreateApp(ctx, fly.CreateAppInput{
+		OrganizationID:  org.ID,
+		Name:            appName,
+		PreferredRegion: &opts.PrimaryRegion,
+		Machines:        true,
 	})
+	return err
 }
 
-// findMachine finds the machine with the provided name.
-func findMachine(flapsClient *flaps.Client, machineName string) (*fly.Machine, error) {
-	machineList, err := flapsClient.List(context.Background(), "")
+// isAppAlreadyExistsError reports whether the app creation failed because the app name is taken.
+func isAppAlreadyExistsError(err error) bool {
+	var flapsErr *flaps.FlapsError
+	if !errors.As(err, &flapsErr) {
+		// GraphQL errors carry no status code, only the validation message
+		return err != nil && strings.Contains(strings.ToLower(err.Error()), "already been taken")
+	}
+
+	if flapsErr.ResponseStatusCode != http.StatusConflict && flapsErr.ResponseStatusCode != http.StatusUnprocessableEntity {
+		return false
+	}
+
+	body := strings.ToLower(string(flapsErr.ResponseBody))
+	return strings.Contains(body, "already exists") || strings.Contains(body, "already been taken")
+}
+
+// checkAppReusable returns an error if the existing app already has a daytona machine of the target,
+// whatever its state, since launching another one would leave two machines with the same name.
+func checkAppReusable(flapsClient flapsAPI, target *models.Target, opts *types.TargetOptions) error {
+	machines, err := flapsClient.List(context.Background(), "")
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	for _, m := range machineList {
-		if m.Name == machineName {
-			return m, nil
+	machineName := getResourceName(target.Id, opts)
+	for _, machine := range machines {
+		if machine.Name == machineName && machine.State != fly.MachineStateDestroyed {
+			return fmt.Errorf("app already exists and has machine %s in state %s for target %s", machine.ID, machine.State, target.Id)
 		}
 	}
 
-	return nil, fmt.Errorf("machine %s not found", machineName)
+	return nil
+}
+
+// waitForApp waits for the app to be ready, giving up after the configured app ready timeout.
+func waitForApp(ctx context.Context, flapsClient flapsAPI, appName string, opts *types.TargetOptions) error {
+	timeout := types.DefaultAppReadyTimeout
+	if opts.AppReadyTimeout > 0 {
+		timeout = opts.AppReadyTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	err := flapsClient.WaitForApp(ctx, appName)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("timeout: app %s was not ready after %d seconds", appName, timeout)
+	}
+
+	return err
+}
+
+// getAppName generates an app name for the provided target, appending the optional
+// app name suffix while keeping the name within Fly's app name length limit.
+// Names that would be invalid or too long are shortened and made valid, ending the name
+// with a hash of the full name so different targets and suffixes never share an app name.
+func getAppName(targetId string, opts *types.TargetOptions) string {
+	name := getResourceName(targetId, opts)
+	if opts.AppNameSuffix != "" {
+		name = fmt.Sprintf("%s-%s", name, opts.AppNameSuffix)
+	}
+	if len(name) > maxAppNameLength || !appNameRegex.MatchString(name) {
+		return sanitizeAppName(name)
+	}
+
+	return name
+}
+
+// sanitizeAppName turns the name into a valid fly app name ending with a hash of the name.
+func sanitizeAppName(name string) string {
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(name)))[:appNameHashLength]
+
+	formatted := invalidAppNameCharsRegex.ReplaceAllString(strings.ToLower(name), "-")
+	formatted = formatted[:min(len(formatted), maxAppNameLength-appNameHashLength-1)]
+	formatted = strings.Trim(formatted, "-")
+	if formatted == "" {
+		return hash
+	}
+	return formatted + "-" + hash
+}
+
+// validateAppName checks the name against fly's app naming rules, so an invalid name fails with a
+// description of the rules instead of a vague error of the fly API.
+func validateAppName(name string) error {
+	if len(name) > maxAppNameLength || !appNameRegex.MatchString(name) {
+		return fmt.Errorf("invalid fly app name %q: app names must be at most %d lowercase letters, numbers "+
+			"and dashes, starting and ending with a letter or number", name, maxAppNameLength)
+	}
+	return nil
 }
 
 // getResourceName generates a machine name for the provided target.
-func getResourceName(identifier string) string {
-	return fmt.Sprintf("daytona-%s", identifier)
+func getResourceName(identifier string, opts *types.TargetOptions) string {
+	return namePrefix(opts) + identifier
+}
+
+// namePrefix returns the prefix of the fly resource names, falling back to the default.
+func namePrefix(opts *types.TargetOptions) string {
+	if opts.NamePrefix == "" {
+		return types.DefaultNamePrefix
+	}
+	return opts.NamePrefix
 }
 
 // getVolumeName generates a volume name for the provided target.
-func getVolumeName(name string) string {
-	name = fmt.Sprintf("daytona_%s", name)
+// Volume names may not contain dashes, so the dashes of the name prefix become underscores.
+// Names changed by stripping invalid characters or by truncation end with a hash of the full name,
+// so different targets never share a volume name.
+func getVolumeName(name string, opts *types.TargetOptions) string {
+	fullName := namePrefix(opts) + name
+	name = strings.ReplaceAll(namePrefix(opts), "-", "_") + name
 	regex := regexp.MustCompile(`[^a-zA-Z0-9_]`)
 	formatted := regex.ReplaceAllString(name, "")
 
-	if len(formatted) > 30 {
-		return formatted[:30]
+	if formatted == name && len(formatted) <= maxVolumeNameLength {
+		return formatted
 	}
 
-	return formatted
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(fullName)))[:volumeNameHashLength]
+	formatted = formatted[:min(len(formatted), maxVolumeNameLength-volumeNameHashLength-1)]
+	return formatted + "_" + hash
 }
 
 // pollLogs fetches app logs for a specified app name, region, and machine ID using the provided fly.Client.
 // It sends the fetched log entries to the out channel.
 // It continues fetching logs indefinitely until an error occurs.
-func pollLogs(out chan<- string, client *fly.Client, appName, region, machineId string) error {
+func pollLogs(ctx context.Context, out chan<- string, client *fly.Client, appName, region, machineId string) error {
 	var (
 		prevToken string
 		nextToken string
 	)
 
 	for {
-		entries, token, err := client.GetAppLogs(context.Background(), appName, nextToken, region, machineId)
+		var retryAfter time.Duration
+		entries, token, err := client.GetAppLogs(context.WithValue(ctx, retryAfterKey{}, &retryAfter), appName, nextToken, region, machineId)
 		if err != nil {
-			return err
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			// Rate limited requests are retried once the delay requested by the API has passed
+			retryAfter, ok := logRetryDelay(err, retryAfter)
+			if !ok {
+				return err
+			}
+			log.Warnf("Fetching logs of app %s is rate limited, retrying in %s", appName, retryAfter)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(retryAfter):
+			}
+			continue
 		}
 
 		// Adds a delay in fetching logs when current log entries have been fully fetched.
 		// This is done to reduce pressure on the server and give time for new logs to accumulate.
 		if token == prevToken {
-			time.Sleep(10 * time.Second)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(logPollInterval):
+			}
 		}
 
 		prevToken = token
@@ -297,7 +2332,11 @@ func pollLogs(out chan<- string, client *fly.Client, appName, region, machineId
 				entry.Level,
 				entry.Message,
 			)
-			out <- logMessage
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case out <- logMessage:
+			}
 		}
 	}
 }
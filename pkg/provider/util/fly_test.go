@@ -0,0 +1,2818 @@
+package util
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/daytonaio/daytona-provider-fly/pkg/types"
+	"github.com/daytonaio/daytona/pkg/models"
+	"github.com/superfly/fly-go"
+)
+
+var (
+	testTarget = &models.Target{
+		Id:   "123",
+		Name: "target",
+	}
+	testTargetOptions = &types.TargetOptions{
+		Region:    "lax",
+		Size:      "shared-cpu-4x",
+		DiskSize:  10,
+		OrgSlug:   "org",
+		AuthToken: "token",
+	}
+)
+
+// mockFlapsServer is a minimal in-memory stand-in for the Fly machines API.
+type mockFlapsServer struct {
+	mu         sync.Mutex
+	machines   []*fly.Machine
+	volumes    []fly.Volume
+	appDeleted bool
+	mux        *http.ServeMux
+}
+
+// newMockFlapsServer starts a mock flaps server and points the flaps client at it.
+func newMockFlapsServer(t *testing.T, machines ...*fly.Machine) *mockFlapsServer {
+	m := &mockFlapsServer{
+		machines: machines,
+		mux:      http.NewServeMux(),
+	}
+
+	m.mux.HandleFunc("GET /v1/apps/{app}/machines", func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		writeJSON(w, http.StatusOK, m.machines)
+	})
+
+	m.mux.HandleFunc("GET /v1/apps/{app}/volumes", func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		writeJSON(w, http.StatusOK, append([]fly.Volume{}, m.volumes...))
+	})
+
+	m.mux.HandleFunc("GET /v1/apps/{app}", func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.appDeleted {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "app not found"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"name": r.PathValue("app")})
+	})
+
+	server := httptest.NewServer(m.mux)
+	t.Cleanup(server.Close)
+	t.Setenv("FLY_FLAPS_BASE_URL", server.URL)
+
+	return m
+}
+
+// handle registers an additional handler on the mock server.
+func (m *mockFlapsServer) handle(pattern string, handler func(w http.ResponseWriter, r *http.Request)) {
+	m.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		handler(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func TestStopTargetWaitsForStopped(t *testing.T) {
+	cases := []struct {
+		name       string
+		transition bool
+		isValid    bool
+	}{
+		{
+			name:       "Machine stops after one poll",
+			transition: true,
+			isValid:    true,
+		},
+		{
+			name:       "Machine never stops",
+			transition: false,
+			isValid:    false,
+		},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			machine := &fly.Machine{ID: "m1", Name: getResourceName(testTarget.Id, testTargetOptions), State: fly.MachineStateStarted}
+			server := newMockFlapsServer(t, machine)
+
+			waitPolls := 0
+			server.handle("POST /v1/apps/{app}/machines/{id}/stop", func(w http.ResponseWriter, r *http.Request) {
+				machine.State = "stopping"
+				writeJSON(w, http.StatusOK, map[string]any{})
+			})
+			server.handle("GET /v1/apps/{app}/machines/{id}/wait", func(w http.ResponseWriter, r *http.Request) {
+				waitPolls++
+				if testCase.transition {
+					machine.State = fly.MachineStateStopped
+				}
+
+				if machine.State != r.URL.Query().Get("state") {
+					writeJSON(w, http.StatusRequestTimeout, map[string]string{"error": "deadline_exceeded"})
+					return
+				}
+				writeJSON(w, http.StatusOK, map[string]any{})
+			})
+
+			err := StopTarget(testTarget, testTargetOptions)
+			if testCase.isValid && err != nil {
+				t.Errorf("Expected target to stop but got error: %s", err)
+			} else if !testCase.isValid && err == nil {
+				t.Errorf("Expected timeout error but got none")
+			}
+
+			if waitPolls != 1 {
+				t.Errorf("Expected a single wait poll but got %d", waitPolls)
+			}
+		})
+	}
+}
+
+func TestGetMachineScriptPreallocation(t *testing.T) {
+	opts := *testTargetOptions
+
+	script := getMachineScript(&opts, "")
+	if strings.Contains(script, "fallocate") {
+		t.Errorf("Expected no preallocation in script when option is unset")
+	}
+
+	opts.PreallocateDockerData = 5
+	script = getMachineScript(&opts, "")
+	if !strings.Contains(script, "fallocate -l 5G /var/lib/docker/") {
+		t.Errorf("Expected preallocation command in script but got:\n%s", script)
+	}
+}
+
+func TestGetMachineScriptProbes(t *testing.T) {
+	opts := *testTargetOptions
+	opts.MountProbeTimeout = 30
+	opts.NetworkProbeTimeout = 45
+
+	script := getMachineScript(&opts, "echo init")
+
+	mountProbe := strings.Index(script, "/proc/mounts")
+	networkProbe := strings.Index(script, "getent hosts _api.internal")
+	initScript := strings.Index(script, "echo init")
+	if mountProbe == -1 || networkProbe == -1 {
+		t.Fatalf("Expected mount and network probes in script but got:\n%s", script)
+	}
+	if mountProbe > initScript || networkProbe > initScript {
+		t.Errorf("Expected probes to run before the init script")
+	}
+
+	if !strings.Contains(script, "-ge 30 ]") || !strings.Contains(script, "-ge 45 ]") {
+		t.Errorf("Expected probes to use the configured timeouts but got:\n%s", script)
+	}
+}
+
+func TestGetMachineScriptPackageInstall(t *testing.T) {
+	script := getMachineScript(testTargetOptions, "echo init")
+
+	for _, expected := range []string{
+		"timeout 300 apk add --no-cache curl bash",
+		"apt-get install -y curl bash",
+		"Unsupported image: neither apk nor apt-get",
+		"Unsupported image: Docker is not installed",
+		"useradd -m -d /home/daytona -s /bin/bash -G docker daytona",
+		"adduser -D -h /home/daytona -G docker daytona",
+		"if [ $i -ge 120 ]; then\n        echo \"Timed out waiting for Docker to start\"",
+	} {
+		if !strings.Contains(script, expected) {
+			t.Errorf("Expected script to contain %q but got:\n%s", expected, script)
+		}
+	}
+
+	if strings.Index(script, "apk add") > strings.Index(script, "echo init") {
+		t.Errorf("Expected packages to be installed before the init script")
+	}
+}
+
+func TestGetMachineScriptDockerStartTimeout(t *testing.T) {
+	opts := *testTargetOptions
+	opts.DockerStartTimeout = 300
+
+	script := getMachineScript(&opts, "")
+	if !strings.Contains(script, "if [ $i -ge 300 ]; then\n        echo \"Timed out waiting for Docker to start\"") {
+		t.Errorf("Expected the Docker wait to use the configured timeout but got:\n%s", script)
+	}
+}
+
+func TestDockerDataPath(t *testing.T) {
+	script := getMachineScript(testTargetOptions, "")
+	if strings.Contains(script, "--data-root") {
+		t.Errorf("Expected no --data-root for the default data path but got:\n%s", script)
+	}
+
+	opts := *testTargetOptions
+	opts.DockerDataPath = "/data/docker"
+
+	script = getMachineScript(&opts, "")
+	for _, expected := range []string{
+		`grep -qs " /data/docker " /proc/mounts`,
+		"dockerd-entrypoint.sh --data-root /data/docker &",
+		"dockerd --data-root /data/docker &",
+	} {
+		if !strings.Contains(script, expected) {
+			t.Errorf("Expected script to contain %q but got:\n%s", expected, script)
+		}
+	}
+
+	launchInput := getLaunchInput(testTarget, &opts, "", &fly.Volume{ID: "vol_1"})
+	if path := launchInput.Config.Mounts[0].Path; path != "/data/docker" {
+		t.Errorf("Expected volume mounted at /data/docker but got %s", path)
+	}
+}
+
+func TestGetMachineScriptDockerDaemonArgs(t *testing.T) {
+	opts := *testTargetOptions
+	opts.DockerDataPath = "/data/docker"
+	opts.DockerDaemonArgs = types.CommandList{"--mtu=1280", "--default-address-pool=base=10.10.0.0/16,size=24"}
+
+	script := getMachineScript(&opts, "")
+	for _, expected := range []string{
+		"dockerd-entrypoint.sh --data-root /data/docker '--mtu=1280' '--default-address-pool=base=10.10.0.0/16,size=24' &",
+		"dockerd --data-root /data/docker '--mtu=1280' '--default-address-pool=base=10.10.0.0/16,size=24' &",
+	} {
+		if !strings.Contains(script, expected) {
+			t.Errorf("Expected script to contain %q but got:\n%s", expected, script)
+		}
+	}
+
+	if script := getMachineScript(testTargetOptions, ""); !strings.Contains(script, "dockerd-entrypoint.sh &") {
+		t.Errorf("Expected no daemon args by default but got:\n%s", script)
+	}
+}
+
+func TestGetMachineScriptMTU(t *testing.T) {
+	opts := *testTargetOptions
+	opts.MTU = 1280
+
+	script := getMachineScript(&opts, "")
+	for _, expected := range []string{"dockerd-entrypoint.sh --mtu=1280 &", "dockerd --mtu=1280 &"} {
+		if !strings.Contains(script, expected) {
+			t.Errorf("Expected script to contain %q but got:\n%s", expected, script)
+		}
+	}
+
+	if script := getMachineScript(testTargetOptions, ""); strings.Contains(script, "--mtu") {
+		t.Errorf("Expected no mtu by default but got:\n%s", script)
+	}
+}
+
+func TestGetMachineScriptAgentUser(t *testing.T) {
+	opts := *testTargetOptions
+	opts.AgentUser = "dev"
+	opts.AgentHome = "/workspace"
+
+	script := getMachineScript(&opts, "")
+	for _, expected := range []string{
+		"if id dev > /dev/null 2>&1; then",
+		"usermod -aG docker dev",
+		"useradd -m -d /workspace -s /bin/bash -G docker dev",
+		"adduser -D -h /workspace -G docker dev",
+		`su dev -c "daytona agent --target"`,
+	} {
+		if !strings.Contains(script, expected) {
+			t.Errorf("Expected script to contain %q but got:\n%s", expected, script)
+		}
+	}
+	if strings.Contains(script, "su daytona") {
+		t.Errorf("Expected the agent to run as dev but got:\n%s", script)
+	}
+}
+
+func TestGetMachineScriptAgentArgs(t *testing.T) {
+	opts := *testTargetOptions
+	opts.AgentArgs = types.CommandList{"--log-level=debug", `--name=it's "$HOME"`}
+
+	script := getMachineScript(&opts, "")
+	expected := `su daytona -c "daytona agent --target '--log-level=debug' '--name=it'\"'\"'s \"\$HOME\"'"`
+	if !strings.Contains(script, expected) {
+		t.Errorf("Expected script to contain %q but got:\n%s", expected, script)
+	}
+
+	if script := getMachineScript(testTargetOptions, ""); !strings.Contains(script, `su daytona -c "daytona agent --target"`+"\n") {
+		t.Errorf("Expected the agent to run with --target only by default but got:\n%s", script)
+	}
+}
+
+func TestGetMachineScriptExtraInitCommands(t *testing.T) {
+	opts := *testTargetOptions
+	opts.ExtraInitCommands = types.CommandList{"apk add nodejs", "echo 'ready' > /tmp/ready"}
+
+	script := getMachineScript(&opts, "install-agent")
+	for _, expected := range []string{
+		`if ! sh -c 'apk add nodejs'; then`,
+		`if ! sh -c 'echo '"'"'ready'"'"' > /tmp/ready'; then`,
+		`echo "Extra init command failed:" 'apk add nodejs'`,
+	} {
+		if !strings.Contains(script, expected) {
+			t.Errorf("Expected script to contain %q but got:\n%s", expected, script)
+		}
+	}
+
+	dockerReady := strings.Index(script, "Timed out waiting for Docker to start")
+	command := strings.Index(script, "sh -c 'apk add nodejs'")
+	agent := strings.Index(script, "daytona agent --target")
+	if !(dockerReady < command && command < agent) {
+		t.Errorf("Expected the extra init commands to run after Docker is ready and before the agent starts:\n%s", script)
+	}
+
+	if script := getMachineScript(testTargetOptions, ""); strings.Contains(script, "extra init command") {
+		t.Errorf("Expected no extra init commands by default but got:\n%s", script)
+	}
+}
+
+func TestGetMachineScriptDockerHost(t *testing.T) {
+	opts := *testTargetOptions
+	opts.DockerHost = "tcp://docker.internal:2375"
+	opts.NoPersistentDisk = true
+
+	script := getMachineScript(&opts, "")
+	if strings.Contains(script, "dockerd") {
+		t.Errorf("Expected no Docker daemon to be started with an external docker host but got:\n%s", script)
+	}
+	if !strings.Contains(script, "while ! docker info") {
+		t.Errorf("Expected the script to wait for the external Docker host but got:\n%s", script)
+	}
+	if env := getMachineEnv(testTarget, &opts); env["DOCKER_HOST"] != opts.DockerHost {
+		t.Errorf("Expected DOCKER_HOST %s in the machine env but got %q", opts.DockerHost, env["DOCKER_HOST"])
+	}
+
+	if script := getMachineScript(testTargetOptions, ""); !strings.Contains(script, "dockerd-entrypoint.sh &") {
+		t.Errorf("Expected the embedded Docker daemon to be started by default but got:\n%s", script)
+	}
+}
+
+func TestGetAppName(t *testing.T) {
+	nameHash := func(name string) string {
+		return fmt.Sprintf("%x", sha256.Sum256([]byte(name)))[:appNameHashLength]
+	}
+
+	cases := []struct {
+		name     string
+		targetId string
+		suffix   string
+		expected string
+	}{
+		{
+			name:     "No suffix",
+			targetId: "123",
+			suffix:   "",
+			expected: "daytona-123",
+		},
+		{
+			name:     "Suffix applied",
+			targetId: "123",
+			suffix:   "staging",
+			expected: "daytona-123-staging",
+		},
+		{
+			name:     "Suffix too long",
+			targetId: strings.Repeat("a", 50),
+			suffix:   "staging-environment",
+			expected: "daytona-" + strings.Repeat("a", 46) + "-" + nameHash("daytona-"+strings.Repeat("a", 50)+"-staging-environment"),
+		},
+		{
+			name:     "Very long target id",
+			targetId: strings.Repeat("a", 100),
+			suffix:   "",
+			expected: "daytona-" + strings.Repeat("a", 46) + "-" + nameHash("daytona-"+strings.Repeat("a", 100)),
+		},
+		{
+			name:     "Invalid characters",
+			targetId: "Target_1",
+			suffix:   "",
+			expected: "daytona-target-1-" + nameHash("daytona-Target_1"),
+		},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			opts := *testTargetOptions
+			opts.AppNameSuffix = testCase.suffix
+
+			appName := getAppName(testCase.targetId, &opts)
+			if appName != testCase.expected {
+				t.Errorf("Expected app name %s but got %s", testCase.expected, appName)
+			}
+			if err := validateAppName(appName); err != nil {
+				t.Errorf("Expected a valid app name but got: %s", err)
+			}
+		})
+	}
+
+	long := getAppName(strings.Repeat("a", 100), testTargetOptions)
+	if other := getAppName(strings.Repeat("a", 99)+"b", testTargetOptions); other == long {
+		t.Errorf("Expected long target ids to get different app names but both got %s", long)
+	}
+
+	staging := getAppName(strings.Repeat("a", 50), &types.TargetOptions{AppNameSuffix: "staging-1"})
+	if other := getAppName(strings.Repeat("a", 50), &types.TargetOptions{AppNameSuffix: "staging-2"}); other == staging {
+		t.Errorf("Expected long app names with different suffixes to differ but both got %s", staging)
+	}
+}
+
+func TestValidateAppName(t *testing.T) {
+	cases := []struct {
+		name    string
+		appName string
+		isValid bool
+	}{
+		{"Valid name", "daytona-123", true},
+		{"Maximum length", strings.Repeat("a", maxAppNameLength), true},
+		{"Too long", strings.Repeat("a", maxAppNameLength+1), false},
+		{"Uppercase", "daytona-ABC", false},
+		{"Underscore", "daytona_123", false},
+		{"Trailing dash", "daytona-", false},
+		{"Empty", "", false},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			err := validateAppName(testCase.appName)
+			if testCase.isValid && err != nil {
+				t.Errorf("Expected app name to be valid but got: %s", err)
+			} else if !testCase.isValid && err == nil {
+				t.Errorf("Expected app name %q to be rejected", testCase.appName)
+			}
+		})
+	}
+}
+
+// machineCalls records the machine operations received by the mock flaps server.
+type machineCalls struct {
+	starts int
+	stops  int
+	waits  []string
+}
+
+// handleMachineTransitions registers start, stop and wait handlers where every wait
+// immediately transitions the machine into the requested state.
+func (m *mockFlapsServer) handleMachineTransitions(machine *fly.Machine, calls *machineCalls) {
+	m.handle("POST /v1/apps/{app}/machines/{id}/start", func(w http.ResponseWriter, r *http.Request) {
+		calls.starts++
+		machine.State = machineStateStarting
+		writeJSON(w, http.StatusOK, map[string]any{})
+	})
+	m.handle("POST /v1/apps/{app}/machines/{id}/stop", func(w http.ResponseWriter, r *http.Request) {
+		calls.stops++
+		machine.State = machineStateStopping
+		writeJSON(w, http.StatusOK, map[string]any{})
+	})
+	m.handle("GET /v1/apps/{app}/machines/{id}/wait", func(w http.ResponseWriter, r *http.Request) {
+		state := r.URL.Query().Get("state")
+		calls.waits = append(calls.waits, state)
+		machine.State = state
+		writeJSON(w, http.StatusOK, map[string]any{})
+	})
+}
+
+func TestNamePrefix(t *testing.T) {
+	custom := &types.TargetOptions{NamePrefix: "acme-daytona-prod-"}
+
+	if name := getResourceName("123", &types.TargetOptions{}); name != "daytona-123" {
+		t.Errorf("Expected the default prefix in the machine name but got %s", name)
+	}
+	if name := getResourceName("123", custom); name != "acme-daytona-prod-123" {
+		t.Errorf("Expected the custom prefix in the machine name but got %s", name)
+	}
+	if name := getAppName("123", custom); name != "acme-daytona-prod-123" {
+		t.Errorf("Expected the custom prefix in the app name but got %s", name)
+	}
+
+	if name := getVolumeName("123", &types.TargetOptions{}); name != "daytona_123" {
+		t.Errorf("Expected the default prefix in the volume name but got %s", name)
+	}
+	name := getVolumeName("a1b2c3d4-e5f6-7890-abcd-ef1234567890", custom)
+	if !strings.HasPrefix(name, "acme_daytona_prod_") {
+		t.Errorf("Expected the custom prefix with underscores in the volume name but got %s", name)
+	}
+	if len(name) > 30 {
+		t.Errorf("Expected the volume name to be at most 30 characters but got %d", len(name))
+	}
+}
+
+func TestGetVolumeNameUnique(t *testing.T) {
+	opts := &types.TargetOptions{}
+	longId := strings.Repeat("a", 40)
+
+	cases := []struct {
+		name  string
+		first string
+		other string
+	}{
+		{"Ids differing after the length limit", longId + "1", longId + "2"},
+		{"Ids differing in stripped characters", "ab-cd", "abcd"},
+		{"Ids differing only in special characters", "ab.cd", "ab-cd"},
+		{"Uuids sharing a prefix", "a1b2c3d4-e5f6-7890-abcd-ef1234567890", "a1b2c3d4-e5f6-7890-abcd-ef1234567891"},
+	}
+
+	validName := regexp.MustCompile(`^[a-z0-9_]+$`)
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			first := getVolumeName(testCase.first, opts)
+			other := getVolumeName(testCase.other, opts)
+			if first == other {
+				t.Errorf("Expected different volume names for %s and %s but both got %s", testCase.first, testCase.other, first)
+			}
+			for _, name := range []string{first, other} {
+				if len(name) > 30 || !validName.MatchString(name) {
+					t.Errorf("Expected a valid volume name of at most 30 characters but got %s", name)
+				}
+			}
+			if getVolumeName(testCase.first, opts) != first {
+				t.Errorf("Expected the volume name of %s to be stable", testCase.first)
+			}
+		})
+	}
+}
+
+func TestGetMachineErrors(t *testing.T) {
+	cases := []struct {
+		name     string
+		status   int
+		body     any
+		expected error
+	}{
+		{"Machine found", http.StatusOK, []*fly.Machine{{ID: "m1", Name: getResourceName(testTarget.Id, testTargetOptions)}}, nil},
+		{"Machine name mismatch", http.StatusOK, []*fly.Machine{{ID: "m1", Name: "daytona-other"}}, ErrMachineNotFound},
+		{"App without machines", http.StatusOK, []*fly.Machine{}, ErrAppHasNoMachines},
+		{"Multiple target machines", http.StatusOK, []*fly.Machine{{ID: "m1", Name: getResourceName(testTarget.Id, testTargetOptions)}, {ID: "m2", Name: getResourceName(testTarget.Id, testTargetOptions)}}, ErrMultipleMachines},
+		{"Destroyed duplicate machine", http.StatusOK, []*fly.Machine{{ID: "m0", Name: getResourceName(testTarget.Id, testTargetOptions), State: fly.MachineStateDestroyed}, {ID: "m1", Name: getResourceName(testTarget.Id, testTargetOptions)}}, nil},
+		{"Only a destroyed machine", http.StatusOK, []*fly.Machine{{ID: "m0", Name: getResourceName(testTarget.Id, testTargetOptions), State: fly.MachineStateDestroyed}}, ErrMachineNotFound},
+		{"App not found", http.StatusNotFound, map[string]string{"error": "app not found"}, ErrAppNotFound},
+		{"Invalid token", http.StatusUnauthorized, map[string]string{"error": "unauthorized"}, ErrInvalidAuth},
+		{"Token without access to the app", http.StatusForbidden, map[string]string{"error": "forbidden"}, ErrInsufficientScope},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, testCase.status, testCase.body)
+			}))
+			t.Cleanup(server.Close)
+			t.Setenv("FLY_FLAPS_BASE_URL", server.URL)
+
+			_, err := GetMachine(testTarget, testTargetOptions)
+			if testCase.expected == nil && err != nil {
+				t.Errorf("Expected machine but got error: %s", err)
+			} else if !errors.Is(err, testCase.expected) {
+				t.Errorf("Expected error %v but got %v", testCase.expected, err)
+			}
+
+			if testCase.expected == ErrMachineNotFound && errors.Is(err, ErrAppHasNoMachines) {
+				t.Errorf("Expected a name mismatch to be distinct from an app without machines but got %v", err)
+			}
+		})
+	}
+}
+
+func TestAppExistsInvalidAuth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+	}))
+	t.Cleanup(server.Close)
+	t.Setenv("FLY_FLAPS_BASE_URL", server.URL)
+
+	appName := getAppName(testTarget.Id, testTargetOptions)
+	flapsClient, err := createFlapsClient(appName, testTargetOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = appExists(flapsClient, appName, testTargetOptions)
+	if !errors.Is(err, ErrInvalidAuth) {
+		t.Errorf("Expected ErrInvalidAuth but got %v", err)
+	}
+}
+
+func TestStartTargetIdempotent(t *testing.T) {
+	cases := []struct {
+		state         string
+		expectedStart bool
+		expectedWaits []string
+	}{
+		{
+			state:         fly.MachineStateStarted,
+			expectedStart: false,
+			expectedWaits: nil,
+		},
+		{
+			state:         machineStateStarting,
+			expectedStart: false,
+			expectedWaits: []string{fly.MachineStateStarted},
+		},
+		{
+			state:         machineStateReplacing,
+			expectedStart: false,
+			expectedWaits: []string{fly.MachineStateStarted},
+		},
+		{
+			state:         fly.MachineStateCreated,
+			expectedStart: false,
+			expectedWaits: []string{fly.MachineStateStarted},
+		},
+		{
+			state:         machineStateStopping,
+			expectedStart: true,
+			expectedWaits: []string{fly.MachineStateStopped, fly.MachineStateStarted},
+		},
+		{
+			state:         fly.MachineStateStopped,
+			expectedStart: true,
+			expectedWaits: []string{fly.MachineStateStarted},
+		},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.state, func(t *testing.T) {
+			machine := &fly.Machine{ID: "m1", Name: getResourceName(testTarget.Id, testTargetOptions), State: testCase.state}
+			server := newMockFlapsServer(t, machine)
+
+			calls := &machineCalls{}
+			server.handleMachineTransitions(machine, calls)
+
+			err := StartTarget(testTarget, testTargetOptions)
+			if err != nil {
+				t.Fatalf("Expected target to start but got error: %s", err)
+			}
+
+			if testCase.expectedStart != (calls.starts == 1) {
+				t.Errorf("Expected start to be issued: %t, but got %d start calls", testCase.expectedStart, calls.starts)
+			}
+			if !slices.Equal(calls.waits, testCase.expectedWaits) {
+				t.Errorf("Expected waits %v but got %v", testCase.expectedWaits, calls.waits)
+			}
+			if machine.State != fly.MachineStateStarted {
+				t.Errorf("Expected machine to be started but it is %s", machine.State)
+			}
+		})
+	}
+}
+
+func TestStopTargetIdempotent(t *testing.T) {
+	cases := []struct {
+		state         string
+		expectedStop  bool
+		expectedWaits []string
+	}{
+		{
+			state:         fly.MachineStateStopped,
+			expectedStop:  false,
+			expectedWaits: nil,
+		},
+		{
+			state:         machineStateStopping,
+			expectedStop:  false,
+			expectedWaits: []string{fly.MachineStateStopped},
+		},
+		{
+			state:         machineStateStarting,
+			expectedStop:  true,
+			expectedWaits: []string{fly.MachineStateStarted, fly.MachineStateStopped},
+		},
+		{
+			state:         fly.MachineStateStarted,
+			expectedStop:  true,
+			expectedWaits: []string{fly.MachineStateStopped},
+		},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.state, func(t *testing.T) {
+			machine := &fly.Machine{ID: "m1", Name: getResourceName(testTarget.Id, testTargetOptions), State: testCase.state}
+			server := newMockFlapsServer(t, machine)
+
+			calls := &machineCalls{}
+			server.handleMachineTransitions(machine, calls)
+
+			err := StopTarget(testTarget, testTargetOptions)
+			if err != nil {
+				t.Fatalf("Expected target to stop but got error: %s", err)
+			}
+
+			if testCase.expectedStop != (calls.stops == 1) {
+				t.Errorf("Expected stop to be issued: %t, but got %d stop calls", testCase.expectedStop, calls.stops)
+			}
+			if !slices.Equal(calls.waits, testCase.expectedWaits) {
+				t.Errorf("Expected waits %v but got %v", testCase.expectedWaits, calls.waits)
+			}
+			if machine.State != fly.MachineStateStopped {
+				t.Errorf("Expected machine to be stopped but it is %s", machine.State)
+			}
+		})
+	}
+}
+
+func TestGetMachineEnv(t *testing.T) {
+	target := &models.Target{
+		Id: "123",
+		EnvVars: map[string]string{
+			"DAYTONA_TARGET_ID": "123",
+			"HTTP_PROXY":        "http://target-proxy:8080",
+		},
+	}
+	opts := *testTargetOptions
+	opts.ExtraEnv = types.KeyValueMap{
+		"HTTP_PROXY":        "http://extra-proxy:8080",
+		"REGISTRY_USER":     "user",
+		"DOCKER_TLS_VERIFY": "1",
+	}
+
+	env := getMachineEnv(target, &opts)
+
+	expected := map[string]string{
+		"DAYTONA_TARGET_ID":  "123",
+		"HTTP_PROXY":         "http://target-proxy:8080",
+		"REGISTRY_USER":      "user",
+		"DOCKER_TLS_VERIFY":  "",
+		"DOCKER_TLS_CERTDIR": "",
+		"PRIMARY_REGION":     "lax",
+	}
+	if !maps.Equal(env, expected) {
+		t.Errorf("Expected env %v but got %v", expected, env)
+	}
+
+	if target.EnvVars["DOCKER_TLS_VERIFY"] != "" || len(target.EnvVars) != 2 {
+		t.Errorf("Expected target env vars to be left untouched but got %v", target.EnvVars)
+	}
+}
+
+func TestPlanTarget(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(server.Close)
+	t.Setenv("FLY_FLAPS_BASE_URL", server.URL)
+
+	plan := PlanTarget(testTarget, testTargetOptions, "curl -H \"Authorization: Bearer secret\"")
+
+	if requests != 0 {
+		t.Errorf("Expected no requests to the fly api but got %d", requests)
+	}
+
+	expected := []string{
+		"App: daytona-123 in org org",
+		"Volume: daytona_123 (10GB, encrypted) in lax",
+		"Machine: daytona-123 (shared-cpu-4x, image docker:dind) in lax",
+		"Mount: daytona_123 at /var/lib/docker",
+	}
+	for _, line := range expected {
+		if !strings.Contains(plan, line) {
+			t.Errorf("Expected plan to contain %q but got:\n%s", line, plan)
+		}
+	}
+
+	if strings.Contains(plan, "secret") {
+		t.Errorf("Expected plan to not contain the init script but got:\n%s", plan)
+	}
+}
+
+func TestConfigChecksum(t *testing.T) {
+	launchInput := getLaunchInput(testTarget, testTargetOptions, "", &fly.Volume{ID: "vol_1", Name: "daytona_123"})
+	checksum := launchInput.Config.Metadata[ConfigChecksumMetadataKey]
+	if checksum == "" {
+		t.Fatalf("Expected config checksum in machine metadata")
+	}
+
+	identical := getLaunchInput(testTarget, testTargetOptions, "", &fly.Volume{ID: "vol_1", Name: "daytona_123"})
+	if ConfigChecksum(identical.Config) != checksum {
+		t.Errorf("Expected identical configs to have matching checksums")
+	}
+
+	opts := *testTargetOptions
+	opts.Size = "performance-2x"
+	changed := getLaunchInput(testTarget, &opts, "", &fly.Volume{ID: "vol_1", Name: "daytona_123"})
+	if ConfigChecksum(changed.Config) == checksum {
+		t.Errorf("Expected changed config to have a different checksum")
+	}
+}
+
+func TestHasConfigDrift(t *testing.T) {
+	launchInput := getLaunchInput(testTarget, testTargetOptions, "", &fly.Volume{ID: "vol_1", Name: "daytona_123"})
+	machine := &fly.Machine{ID: "m1", Config: launchInput.Config}
+
+	if HasConfigDrift(machine) {
+		t.Errorf("Expected no drift for an unchanged machine config")
+	}
+
+	machine.Config.Guest = &fly.MachineGuest{CPUKind: "performance", CPUs: 8, MemoryMB: 16384}
+	if !HasConfigDrift(machine) {
+		t.Errorf("Expected drift after the machine guest was changed")
+	}
+
+	if HasConfigDrift(&fly.Machine{ID: "m2", Config: &fly.MachineConfig{}}) {
+		t.Errorf("Expected no drift for a machine without a stored checksum")
+	}
+}
+
+func TestDeleteTargetConfirmsVolumeDeletion(t *testing.T) {
+	defaultPollInterval := deletePollInterval
+	deletePollInterval = time.Millisecond
+	t.Cleanup(func() { deletePollInterval = defaultPollInterval })
+
+	cases := []struct {
+		name          string
+		volumeDeleted bool
+	}{
+		{
+			name:          "Volume left after app deletion",
+			volumeDeleted: false,
+		},
+		{
+			name:          "Volume already deleted",
+			volumeDeleted: true,
+		},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			machine := &fly.Machine{ID: "m1", Name: getResourceName(testTarget.Id, testTargetOptions), State: fly.MachineStateStopped}
+			server := newMockFlapsServer(t, machine)
+			server.volumes = []fly.Volume{{ID: "vol_1", Name: getVolumeName(testTarget.Id, testTargetOptions)}}
+
+			volumeDeleted := testCase.volumeDeleted
+			deletes := 0
+			polls := 0
+			server.handle("DELETE /v1/apps/{app}/machines/{id}", func(w http.ResponseWriter, r *http.Request) {
+				machine.State = fly.MachineStateDestroyed
+				writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+			})
+			server.handle("DELETE /v1/apps/{app}", func(w http.ResponseWriter, r *http.Request) {
+				// The volume can only be confirmed as deleted while the app exists
+				if !volumeDeleted {
+					t.Errorf("Expected the volume to be deleted before the app")
+				}
+				w.WriteHeader(http.StatusAccepted)
+			})
+			server.handle("DELETE /v1/apps/{app}/volumes/{id}", func(w http.ResponseWriter, r *http.Request) {
+				deletes++
+				if machine.State != fly.MachineStateDestroyed {
+					t.Errorf("Expected the machine to be destroyed before its volume")
+				}
+				if volumeDeleted {
+					writeJSON(w, http.StatusNotFound, map[string]string{"error": "volume not found"})
+					return
+				}
+				writeJSON(w, http.StatusOK, fly.Volume{ID: r.PathValue("id"), State: "pending_destroy"})
+			})
+			server.handle("GET /v1/apps/{app}/volumes/{id}", func(w http.ResponseWriter, r *http.Request) {
+				polls++
+				if volumeDeleted {
+					writeJSON(w, http.StatusNotFound, map[string]string{"error": "volume not found"})
+					return
+				}
+				// The volume is gone on the second poll
+				volumeDeleted = true
+				writeJSON(w, http.StatusOK, fly.Volume{ID: r.PathValue("id"), State: "pending_destroy"})
+			})
+
+			err := DeleteTarget(testTarget, testTargetOptions)
+			if err != nil {
+				t.Fatalf("Expected target to be deleted but got error: %s", err)
+			}
+			if deletes != 1 {
+				t.Errorf("Expected a single volume delete but got %d", deletes)
+			}
+			if polls == 0 {
+				t.Errorf("Expected the volume deletion to be confirmed")
+			}
+		})
+	}
+}
+
+func TestDeleteTargetWaitsForMachine(t *testing.T) {
+	defaultPollInterval := deletePollInterval
+	deletePollInterval = time.Millisecond
+	t.Cleanup(func() { deletePollInterval = defaultPollInterval })
+
+	machine := &fly.Machine{ID: "m1", Name: getResourceName(testTarget.Id, testTargetOptions), State: fly.MachineStateStarted}
+	server := newMockFlapsServer(t, machine)
+
+	machineGone := make(chan struct{})
+	server.handle("DELETE /v1/apps/{app}", func(w http.ResponseWriter, r *http.Request) {
+		// The machine is still being destroyed when the app delete returns
+		machine.State = fly.MachineStateDestroying
+		time.AfterFunc(20*time.Millisecond, func() {
+			server.mu.Lock()
+			defer server.mu.Unlock()
+			server.machines = nil
+			close(machineGone)
+		})
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	err := DeleteTarget(testTarget, testTargetOptions)
+	if err != nil {
+		t.Fatalf("Expected target to be deleted but got error: %s", err)
+	}
+
+	select {
+	case <-machineGone:
+	default:
+		t.Errorf("Expected DeleteTarget to return only after the machine is gone")
+	}
+}
+
+func TestNearestRegion(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/graphql" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"data": map[string]any{
+				"nearestRegion": map[string]any{"code": "ams", "name": "Amsterdam, Netherlands"},
+			},
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	defaultApiBaseUrl := flyApiBaseUrl
+	flyApiBaseUrl = server.URL
+	t.Cleanup(func() { flyApiBaseUrl = defaultApiBaseUrl })
+
+	region, err := NearestRegion(testTargetOptions)
+	if err != nil {
+		t.Fatalf("Expected nearest region but got error: %s", err)
+	}
+	if region != "ams" {
+		t.Errorf("Expected nearest region ams but got %s", region)
+	}
+}
+
+// recordingTransport records the requests sent through it.
+type recordingTransport struct {
+	requests []*http.Request
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.requests = append(t.requests, req)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestValidateSizeRegion(t *testing.T) {
+	cases := []struct {
+		name           string
+		regions        []map[string]any
+		regionFallback types.StringList
+		expected       error
+		message        string
+	}{
+		{"Available in region", []map[string]any{{"region": "lax", "count": 1}, {"region": "ord", "count": 1}}, nil, nil, ""},
+		{"Available in fallback region", []map[string]any{{"region": "iad", "count": 1}}, types.StringList{"iad"}, nil, ""},
+		{"Not available in region", []map[string]any{{"region": "lax", "count": 0}, {"region": "ord", "count": 1}, {"region": "iad", "count": 1}}, nil, ErrSizeNotAvailable, "size a100-40gb not available in lax; available in iad, ord"},
+		{"Not available anywhere", []map[string]any{}, nil, ErrSizeNotAvailable, "not available in any region"},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			server := newMockFlapsServer(t)
+			var compute map[string]any
+			server.handle("POST /v1/placements", func(w http.ResponseWriter, r *http.Request) {
+				var body map[string]map[string]any
+				_ = json.NewDecoder(r.Body).Decode(&body)
+				compute = body["compute"]
+				writeJSON(w, http.StatusOK, map[string]any{"regions": testCase.regions})
+			})
+
+			opts := *testTargetOptions
+			opts.Size = "a100-40gb"
+			opts.RegionFallback = testCase.regionFallback
+
+			err := ValidateSizeRegion(&opts)
+			if testCase.expected == nil {
+				if err != nil {
+					t.Errorf("Expected size to be available but got error: %s", err)
+				}
+			} else if !errors.Is(err, testCase.expected) || !strings.Contains(err.Error(), testCase.message) {
+				t.Errorf("Expected error %q but got %v", testCase.message, err)
+			}
+
+			if compute["gpu_kind"] != "a100-pcie-40gb" {
+				t.Errorf("Expected the placement request for the size's guest but got %v", compute)
+			}
+		})
+	}
+}
+
+func TestValidateToken(t *testing.T) {
+	cases := []struct {
+		name     string
+		status   int
+		body     map[string]any
+		expected error
+	}{
+		{"Valid token", http.StatusOK, map[string]any{"data": map[string]any{"viewer": map[string]any{"email": "dev@example.com"}}}, nil},
+		{"Rejected token", http.StatusUnauthorized, map[string]any{"errors": []map[string]any{{"message": "You must be authenticated to view this."}}}, ErrInvalidAuth},
+		{"Unauthenticated query", http.StatusOK, map[string]any{"errors": []map[string]any{{"message": "You must be authenticated to view this."}}}, ErrInvalidAuth},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, testCase.status, testCase.body)
+			}))
+			t.Cleanup(server.Close)
+
+			defaultApiBaseUrl := flyApiBaseUrl
+			flyApiBaseUrl = server.URL
+			t.Cleanup(func() { flyApiBaseUrl = defaultApiBaseUrl })
+
+			err := ValidateToken(testTargetOptions)
+			if testCase.expected == nil && err != nil {
+				t.Errorf("Expected token to be valid but got error: %s", err)
+			} else if !errors.Is(err, testCase.expected) {
+				t.Errorf("Expected error %v but got %v", testCase.expected, err)
+			}
+		})
+	}
+}
+
+func TestIsNotAuthenticatedError(t *testing.T) {
+	cases := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"Api error", &fly.ApiError{Status: http.StatusUnauthorized}, true},
+		{"GraphQL status", errors.New("server returned a non-200 status code: 401"), true},
+		{"Unauthenticated query", errors.New("You must be authenticated to view this."), true},
+		{"Name containing 401", errors.New("Could not find App daytona-401"), false},
+		{"Other status", errors.New("server returned a non-200 status code: 4010"), false},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if actual := isNotAuthenticatedError(testCase.err); actual != testCase.expected {
+				t.Errorf("Expected %v for %q but got %v", testCase.expected, testCase.err, actual)
+			}
+		})
+	}
+}
+
+func TestValidateOrg(t *testing.T) {
+	cases := []struct {
+		name     string
+		status   int
+		body     map[string]any
+		expected error
+	}{
+		{"Org token", http.StatusOK, map[string]any{"data": map[string]any{"organization": map[string]any{"id": "org_1", "slug": "org"}}}, nil},
+		{"Token of another org", http.StatusOK, map[string]any{"errors": []map[string]any{{"message": "Could not find Organization"}}}, ErrInsufficientScope},
+		{"App scoped token", http.StatusOK, map[string]any{"errors": []map[string]any{{"message": "Not authorized to access this organization"}}}, ErrInsufficientScope},
+		{"Rejected token", http.StatusUnauthorized, map[string]any{"errors": []map[string]any{{"message": "You must be authenticated to view this."}}}, ErrInvalidAuth},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, testCase.status, testCase.body)
+			}))
+			t.Cleanup(server.Close)
+
+			defaultApiBaseUrl := flyApiBaseUrl
+			flyApiBaseUrl = server.URL
+			t.Cleanup(func() { flyApiBaseUrl = defaultApiBaseUrl })
+
+			err := ValidateOrg(testTargetOptions)
+			if testCase.expected == nil {
+				if err != nil {
+					t.Errorf("Expected org access but got error: %s", err)
+				}
+				return
+			}
+			if !errors.Is(err, testCase.expected) {
+				t.Errorf("Expected error %v but got %v", testCase.expected, err)
+			}
+			if testCase.expected == ErrInsufficientScope && !strings.Contains(err.Error(), "org deploy token") {
+				t.Errorf("Expected guidance on the token to use but got: %s", err)
+			}
+		})
+	}
+}
+
+func TestCreateAppPrimaryRegion(t *testing.T) {
+	cases := []struct {
+		name          string
+		primaryRegion string
+		usesGraphql   bool
+	}{
+		{"Primary region defaults to the machine region", "", false},
+		{"Explicit primary region", "ord", true},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			server := newMockFlapsServer(t)
+			flapsCreates := 0
+			server.handle("POST /v1/apps", func(w http.ResponseWriter, r *http.Request) {
+				flapsCreates++
+				writeJSON(w, http.StatusCreated, map[string]any{})
+			})
+
+			var preferredRegion any
+			graphql := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var body struct {
+					Query     string
+					Variables map[string]map[string]any
+				}
+				_ = json.NewDecoder(r.Body).Decode(&body)
+				if strings.Contains(body.Query, "createApp") {
+					preferredRegion = body.Variables["input"]["preferredRegion"]
+					writeJSON(w, http.StatusOK, map[string]any{"data": map[string]any{"createApp": map[string]any{"app": map[string]any{"name": "app"}}}})
+					return
+				}
+				writeJSON(w, http.StatusOK, map[string]any{"data": map[string]any{"organization": map[string]any{"id": "org_1", "slug": "org"}}})
+			}))
+			t.Cleanup(graphql.Close)
+
+			defaultApiBaseUrl := flyApiBaseUrl
+			flyApiBaseUrl = graphql.URL
+			t.Cleanup(func() { flyApiBaseUrl = defaultApiBaseUrl })
+
+			opts := *testTargetOptions
+			opts.PrimaryRegion = testCase.primaryRegion
+			flapsClient, err := createFlapsClient("app", &opts)
+			if err != nil {
+				t.Fatalf("Failed to create flaps client: %s", err)
+			}
+
+			err = createApp(context.Background(), flapsClient, "app", &opts)
+			if err != nil {
+				t.Fatalf("Expected the app to be created but got error: %s", err)
+			}
+
+			if testCase.usesGraphql {
+				if flapsCreates != 0 || preferredRegion != testCase.primaryRegion {
+					t.Errorf("Expected the app to be created with primary region %s but got %v", testCase.primaryRegion, preferredRegion)
+				}
+			} else if flapsCreates != 1 {
+				t.Errorf("Expected the app to be created through the machines API")
+			}
+
+			if env := getMachineEnv(testTarget, &opts); env["PRIMARY_REGION"] != opts.AppPrimaryRegion() {
+				t.Errorf("Expected PRIMARY_REGION %s but got %s", opts.AppPrimaryRegion(), env["PRIMARY_REGION"])
+			}
+		})
+	}
+}
+
+func TestCreateTargetScopeDenied(t *testing.T) {
+	server := newMockFlapsServer(t)
+	server.handle("POST /v1/apps", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "unauthorized"})
+	})
+
+	_, err := CreateTarget(context.Background(), testTarget, testTargetOptions, "", nil)
+	if !errors.Is(err, ErrInsufficientScope) {
+		t.Fatalf("Expected ErrInsufficientScope but got: %v", err)
+	}
+	if !strings.Contains(err.Error(), "cannot create apps in org "+testTargetOptions.OrgSlug) {
+		t.Errorf("Expected guidance naming the org but got: %s", err)
+	}
+}
+
+func TestCreateTargetBillingRequired(t *testing.T) {
+	paymentError := map[string]string{"error": "We need your payment information to continue! Add a credit card or buy credit: https://fly.io/dashboard/org/billing"}
+
+	cases := []struct {
+		name         string
+		createStatus int
+		launchStatus int
+	}{
+		{"App create rejected", http.StatusPaymentRequired, http.StatusOK},
+		{"Launch rejected", http.StatusCreated, http.StatusPaymentRequired},
+		{"Launch rejected with unprocessable entity", http.StatusCreated, http.StatusUnprocessableEntity},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			server := newMockFlapsServer(t)
+
+			launches := 0
+			server.handle("POST /v1/apps", func(w http.ResponseWriter, r *http.Request) {
+				if testCase.createStatus != http.StatusCreated {
+					writeJSON(w, testCase.createStatus, paymentError)
+					return
+				}
+				writeJSON(w, http.StatusCreated, map[string]any{})
+			})
+			server.handle("DELETE /v1/apps/{app}", func(w http.ResponseWriter, r *http.Request) {
+				server.appDeleted = true
+				w.WriteHeader(http.StatusAccepted)
+			})
+			server.handle("POST /v1/apps/{app}/volumes", func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, http.StatusOK, fly.Volume{ID: "vol_1", Name: getVolumeName(testTarget.Id, testTargetOptions), Region: testTargetOptions.Region})
+			})
+			server.handle("DELETE /v1/apps/{app}/volumes/{id}", func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, http.StatusOK, fly.Volume{ID: r.PathValue("id")})
+			})
+			server.handle("POST /v1/apps/{app}/machines", func(w http.ResponseWriter, r *http.Request) {
+				launches++
+				writeJSON(w, testCase.launchStatus, paymentError)
+			})
+
+			opts := *testTargetOptions
+			opts.CreateMaxAttempts = 3
+
+			_, err := CreateTarget(context.Background(), testTarget, &opts, "", nil)
+			if !errors.Is(err, ErrBillingRequired) {
+				t.Fatalf("Expected ErrBillingRequired but got: %v", err)
+			}
+			if !strings.Contains(err.Error(), "your Fly org requires a payment method before creating machines") {
+				t.Errorf("Expected a friendly billing message but got: %s", err)
+			}
+			if launches > 1 {
+				t.Errorf("Expected billing errors not to be retried but got %d launches", launches)
+			}
+		})
+	}
+}
+
+func TestLogClientUsesCustomTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"data": []any{}, "meta": map[string]string{"next_token": ""}})
+	}))
+	t.Cleanup(server.Close)
+
+	defaultApiBaseUrl := flyApiBaseUrl
+	flyApiBaseUrl = server.URL
+	t.Cleanup(func() {
+		flyApiBaseUrl = defaultApiBaseUrl
+		fly.SetBaseURL(defaultApiBaseUrl)
+	})
+
+	transport := &recordingTransport{}
+	opts := *testTargetOptions
+	opts.Transport = transport
+
+	client, err := createFlyClient(getAppName(testTarget.Id, &opts), &opts)
+	if err != nil {
+		t.Fatalf("Expected fly client to be created but got error: %s", err)
+	}
+	_, _, err = client.GetAppLogs(context.Background(), getAppName(testTarget.Id, &opts), "", opts.Region, "m1")
+	if err != nil {
+		t.Fatalf("Expected logs to be fetched but got error: %s", err)
+	}
+
+	if len(transport.requests) != 1 {
+		t.Fatalf("Expected a single request through the custom transport but got %d", len(transport.requests))
+	}
+	if !strings.Contains(transport.requests[0].URL.Path, "/logs") {
+		t.Errorf("Expected a logs request but got %s", transport.requests[0].URL.Path)
+	}
+}
+
+func TestHttpTransportProxy(t *testing.T) {
+	cases := []struct {
+		name          string
+		proxyUrl      string
+		expectedProxy string
+	}{
+		{"Proxy url option", "http://proxy.corp:3128", "http://proxy.corp:3128"},
+		{"Socks proxy url option", "socks5://proxy.corp:1080", "socks5://proxy.corp:1080"},
+		{"Proxy from environment", "", ""},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			opts := *testTargetOptions
+			opts.ProxyUrl = testCase.proxyUrl
+
+			httpClient, err := createFlapsHttpClient(&opts)
+			if err != nil {
+				t.Fatalf("Expected http client to be created but got error: %s", err)
+			}
+			transport, ok := httpClient.Transport.(*http.Transport)
+			if !ok {
+				t.Fatalf("Expected an http transport but got %T", httpClient.Transport)
+			}
+			if transport.Proxy == nil {
+				t.Fatal("Expected the transport proxy func to be set")
+			}
+
+			if testCase.expectedProxy == "" {
+				return
+			}
+			req, _ := http.NewRequest(http.MethodGet, "https://api.machines.dev/v1/apps", nil)
+			proxyUrl, err := transport.Proxy(req)
+			if err != nil || proxyUrl == nil || proxyUrl.String() != testCase.expectedProxy {
+				t.Errorf("Expected proxy %s but got %v (error: %v)", testCase.expectedProxy, proxyUrl, err)
+			}
+		})
+	}
+}
+
+func TestGetLaunchInputAutoExtend(t *testing.T) {
+	opts := *testTargetOptions
+	opts.AutoExtendThreshold = 80
+	opts.AutoExtendSizeLimitGb = 50
+
+	launchInput := getLaunchInput(testTarget, &opts, "", &fly.Volume{ID: "vol_1", Name: "daytona_123"})
+
+	mount := launchInput.Config.Mounts[0]
+	if mount.ExtendThresholdPercent != 80 {
+		t.Errorf("Expected extend threshold 80 but got %d", mount.ExtendThresholdPercent)
+	}
+	if mount.SizeGbLimit != 50 {
+		t.Errorf("Expected size limit 50 but got %d", mount.SizeGbLimit)
+	}
+}
+
+func TestImagePullDuration(t *testing.T) {
+	cases := []struct {
+		name     string
+		events   []*fly.MachineEvent
+		expected time.Duration
+		ok       bool
+	}{
+		{
+			name: "Launched and started",
+			events: []*fly.MachineEvent{
+				{Type: "start", Timestamp: 60_000},
+				{Type: "exit", Timestamp: 50_000},
+				{Type: "start", Timestamp: 12_500},
+				{Type: "launch", Timestamp: 1_000},
+			},
+			expected: 11500 * time.Millisecond,
+			ok:       true,
+		},
+		{"Not started yet", []*fly.MachineEvent{{Type: "launch", Timestamp: 1_000}}, 0, false},
+		{"No events", nil, 0, false},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			duration, ok := imagePullDuration(&fly.Machine{Events: testCase.events})
+			if ok != testCase.ok || duration != testCase.expected {
+				t.Errorf("Expected %s (%t) but got %s (%t)", testCase.expected, testCase.ok, duration, ok)
+			}
+		})
+	}
+}
+
+func TestGetLaunchInputAutoDestroy(t *testing.T) {
+	opts := *testTargetOptions
+	opts.NoPersistentDisk = true
+	opts.AutoDestroy = true
+
+	if config := getLaunchInput(testTarget, &opts, "", nil).Config; !config.AutoDestroy {
+		t.Errorf("Expected the machine to be launched with auto destroy")
+	}
+
+	if config := getLaunchInput(testTarget, testTargetOptions, "", nil).Config; config.AutoDestroy {
+		t.Errorf("Expected no auto destroy by default")
+	}
+}
+
+func TestGetLaunchInputLabels(t *testing.T) {
+	opts := *testTargetOptions
+	opts.TTL = "1h"
+	opts.Labels = types.KeyValueMap{
+		"team":                    "platform",
+		"cost-center":             "cc-42",
+		ConfigChecksumMetadataKey: "forged",
+		ExpiresAtMetadataKey:      "never",
+	}
+
+	metadata := getLaunchInput(testTarget, &opts, "", nil).Config.Metadata
+
+	if metadata["team"] != "platform" || metadata["cost-center"] != "cc-42" {
+		t.Errorf("Expected the labels in the machine metadata but got %v", metadata)
+	}
+	if metadata[ConfigChecksumMetadataKey] == "forged" || metadata[ExpiresAtMetadataKey] == "never" {
+		t.Errorf("Expected the daytona keys to win over the labels but got %v", metadata)
+	}
+}
+
+func TestGetLaunchInputServices(t *testing.T) {
+	opts := *testTargetOptions
+	opts.Services = types.ServiceList{
+		{InternalPort: 8080, Port: 443, Handlers: []string{"tls", "http"}},
+		{InternalPort: 5432, Port: 5432},
+	}
+
+	services := getLaunchInput(testTarget, &opts, "", nil).Config.Services
+
+	if len(services) != 2 {
+		t.Fatalf("Expected 2 services but got %d", len(services))
+	}
+	first := services[0]
+	if first.Protocol != "tcp" || first.InternalPort != 8080 || *first.Ports[0].Port != 443 || !slices.Equal(first.Ports[0].Handlers, []string{"tls", "http"}) {
+		t.Errorf("Expected tcp service 8080 -> 443 with tls and http handlers but got %+v", first)
+	}
+	if services[1].InternalPort != 5432 || *services[1].Ports[0].Port != 5432 || services[1].Ports[0].Handlers != nil {
+		t.Errorf("Expected raw tcp service 5432 -> 5432 but got %+v", services[1])
+	}
+
+	if services := getLaunchInput(testTarget, testTargetOptions, "", nil).Config.Services; services != nil {
+		t.Errorf("Expected no services by default but got %+v", services)
+	}
+}
+
+func TestGetVolumeRequestSnapshotRetention(t *testing.T) {
+	request := getVolumeRequest(testTarget, testTargetOptions)
+	if request.SnapshotRetention != nil {
+		t.Errorf("Expected the fly default snapshot retention but got %d", *request.SnapshotRetention)
+	}
+
+	opts := *testTargetOptions
+	opts.SnapshotRetention = 14
+
+	request = getVolumeRequest(testTarget, &opts)
+	if request.SnapshotRetention == nil || *request.SnapshotRetention != 14 {
+		t.Errorf("Expected snapshot retention of 14 days but got %v", request.SnapshotRetention)
+	}
+}
+
+func TestGetVolumeRequestEncryption(t *testing.T) {
+	request := getVolumeRequest(testTarget, testTargetOptions)
+	if request.Encrypted == nil || !*request.Encrypted {
+		t.Errorf("Expected the volume to be encrypted by default but got %v", request.Encrypted)
+	}
+
+	opts := *testTargetOptions
+	opts.EncryptVolume = fly.Pointer(false)
+
+	request = getVolumeRequest(testTarget, &opts)
+	if request.Encrypted == nil || *request.Encrypted {
+		t.Errorf("Expected an unencrypted volume but got %v", request.Encrypted)
+	}
+
+	data, err := json.Marshal(request)
+	if err != nil {
+		t.Fatalf("Failed to marshal volume request: %s", err)
+	}
+	if !strings.Contains(string(data), `"encrypted":false`) {
+		t.Errorf("Expected the request to carry the encryption flag but got %s", data)
+	}
+}
+
+func TestListVolumeSnapshots(t *testing.T) {
+	server := newMockFlapsServer(t)
+
+	server.volumes = []fly.Volume{
+		{ID: "vol_other", Name: "daytona_other", State: "created"},
+		{ID: "vol_1", Name: getVolumeName(testTarget.Id, testTargetOptions), State: "created"},
+	}
+	server.handle("GET /v1/apps/{app}/volumes/{id}/snapshots", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("id") != "vol_1" {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "volume not found"})
+			return
+		}
+		writeJSON(w, http.StatusOK, []fly.VolumeSnapshot{{ID: "vs_1", Size: 10}, {ID: "vs_2", Size: 10}})
+	})
+
+	snapshots, err := ListVolumeSnapshots(testTarget, testTargetOptions)
+	if err != nil {
+		t.Fatalf("Expected snapshots but got error: %s", err)
+	}
+	if len(snapshots) != 2 || snapshots[0].ID != "vs_1" {
+		t.Errorf("Expected the snapshots of vol_1 but got %v", snapshots)
+	}
+}
+
+func TestListVolumeSnapshotsWithVolumeId(t *testing.T) {
+	server := newMockFlapsServer(t)
+	server.handle("GET /v1/apps/{app}/volumes/{id}", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, fly.Volume{ID: r.PathValue("id"), Name: "recovered", State: "created"})
+	})
+	server.handle("GET /v1/apps/{app}/volumes/{id}/snapshots", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("id") != "vol_existing" {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "volume not found"})
+			return
+		}
+		writeJSON(w, http.StatusOK, []fly.VolumeSnapshot{{ID: "vs_1", Size: 10}})
+	})
+
+	opts := *testTargetOptions
+	opts.VolumeId = "vol_existing"
+
+	snapshots, err := ListVolumeSnapshots(testTarget, &opts)
+	if err != nil {
+		t.Fatalf("Expected snapshots but got error: %s", err)
+	}
+	if len(snapshots) != 1 || snapshots[0].ID != "vs_1" {
+		t.Errorf("Expected the snapshots of vol_existing but got %v", snapshots)
+	}
+}
+
+func TestCreateVolumeFromSnapshot(t *testing.T) {
+	cases := []struct {
+		name        string
+		snapshots   []fly.VolumeSnapshot
+		expectedErr string
+	}{
+		{"Snapshot restored", []fly.VolumeSnapshot{{ID: "vs_0"}, {ID: "vs_1", Size: 4 << 30}}, ""},
+		{"Snapshot not found", []fly.VolumeSnapshot{{ID: "vs_0"}}, "volume snapshot not found: vs_1"},
+		{"Snapshot larger than the disk", []fly.VolumeSnapshot{{ID: "vs_1", Size: 20 << 30}}, "snapshot vs_1 needs a 20GB volume but the disk size is 10GB"},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				writeOrgApps(w, r, "daytona-source")
+			}))
+			t.Cleanup(apiServer.Close)
+
+			defaultApiBaseUrl := flyApiBaseUrl
+			flyApiBaseUrl = apiServer.URL
+			t.Cleanup(func() {
+				flyApiBaseUrl = defaultApiBaseUrl
+				fly.SetBaseURL(defaultApiBaseUrl)
+			})
+
+			server := newMockFlapsServer(t)
+			server.volumes = []fly.Volume{{ID: "vol_source", Name: "daytona_source", Region: "lax"}}
+			server.handle("GET /v1/apps/{app}/volumes/{id}/snapshots", func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, http.StatusOK, testCase.snapshots)
+			})
+
+			var request fly.CreateVolumeRequest
+			creates := 0
+			server.handle("POST /v1/apps/{app}/volumes", func(w http.ResponseWriter, r *http.Request) {
+				creates++
+				_ = json.NewDecoder(r.Body).Decode(&request)
+				writeJSON(w, http.StatusOK, fly.Volume{ID: "vol_1", Name: request.Name, Region: request.Region, SizeGb: *request.SizeGb})
+			})
+
+			opts := *testTargetOptions
+			opts.DiskSize = 10
+			opts.SnapshotId = "vs_1"
+
+			appName := getAppName(testTarget.Id, &opts)
+			flapsClient, err := createFlapsClient(appName, &opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, _, err = createVolume(context.Background(), flapsClient, testTarget, &opts, nil)
+			if testCase.expectedErr == "" {
+				if err != nil {
+					t.Errorf("Expected volume to be restored but got error: %s", err)
+				}
+				if request.SnapshotID == nil || *request.SnapshotID != "vs_1" {
+					t.Errorf("Expected the volume to be created from snapshot vs_1 but got %v", request.SnapshotID)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), testCase.expectedErr) {
+				t.Errorf("Expected error %q but got %v", testCase.expectedErr, err)
+			}
+			// The snapshot is checked before the volume is created
+			if creates != 0 {
+				t.Errorf("Expected no volume to be created but got %d create requests", creates)
+			}
+		})
+	}
+}
+
+func TestReleasePublicIPs(t *testing.T) {
+	var released []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Query     string         `json:"query"`
+			Variables map[string]any `json:"variables"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if strings.Contains(req.Query, "releaseIpAddress") {
+			input := req.Variables["input"].(map[string]any)
+			released = append(released, input["ip"].(string))
+			writeJSON(w, http.StatusOK, map[string]any{"data": map[string]any{"releaseIpAddress": map[string]any{}}})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, map[string]any{
+			"data": map[string]any{
+				"app": map[string]any{
+					"ipAddresses": map[string]any{
+						"nodes": []map[string]any{
+							{"id": "ip_1", "address": "2a09:8280:1::1", "type": "v6"},
+							{"id": "ip_2", "address": "fdaa:0:1::2", "type": "private_v6"},
+						},
+					},
+					"sharedIpAddress": "66.241.124.1",
+				},
+			},
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	defaultApiBaseUrl := flyApiBaseUrl
+	flyApiBaseUrl = server.URL
+	t.Cleanup(func() {
+		flyApiBaseUrl = defaultApiBaseUrl
+		fly.SetBaseURL(defaultApiBaseUrl)
+	})
+
+	err := releasePublicIPs(getAppName(testTarget.Id, testTargetOptions), testTargetOptions)
+	if err != nil {
+		t.Fatalf("Expected public ips to be released but got error: %s", err)
+	}
+
+	expected := []string{"2a09:8280:1::1", "66.241.124.1"}
+	if !slices.Equal(released, expected) {
+		t.Errorf("Expected released ips %v but got %v", expected, released)
+	}
+}
+
+func TestSetAppSecrets(t *testing.T) {
+	var received map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Variables struct {
+				Input fly.SetSecretsInput `json:"input"`
+			} `json:"variables"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		received = map[string]string{}
+		for _, secret := range req.Variables.Input.Secrets {
+			received[secret.Key] = secret.Value
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"data": map[string]any{"setSecrets": map[string]any{"release": map[string]any{}}}})
+	}))
+	t.Cleanup(server.Close)
+
+	defaultApiBaseUrl := flyApiBaseUrl
+	flyApiBaseUrl = server.URL
+	t.Cleanup(func() {
+		flyApiBaseUrl = defaultApiBaseUrl
+		fly.SetBaseURL(defaultApiBaseUrl)
+	})
+
+	opts := *testTargetOptions
+	opts.Secrets = types.KeyValueMap{"REGISTRY_TOKEN": "secret"}
+
+	err := setAppSecrets(getAppName(testTarget.Id, &opts), &opts)
+	if err != nil {
+		t.Fatalf("Expected secrets to be set but got error: %s", err)
+	}
+
+	if !maps.Equal(received, map[string]string(opts.Secrets)) {
+		t.Errorf("Expected secrets %v but got %v", opts.Secrets, received)
+	}
+
+	launchInput := getLaunchInput(testTarget, &opts, "", &fly.Volume{ID: "vol_1"})
+	if _, ok := launchInput.Config.Env["REGISTRY_TOKEN"]; ok {
+		t.Errorf("Expected secrets to be kept out of the machine env")
+	}
+}
+
+func TestCreateTargetRetry(t *testing.T) {
+	cases := []struct {
+		name             string
+		launchStatus     int
+		launchError      string
+		maxAttempts      int
+		expectedLaunches int
+		isValid          bool
+	}{
+		{"Transient failure retried", http.StatusInternalServerError, "insufficient resources", 2, 2, true},
+		{"Transient failure without retries", http.StatusInternalServerError, "insufficient resources", 1, 1, false},
+		{"Non-retriable failure", http.StatusUnprocessableEntity, "invalid region", 2, 1, false},
+	}
+
+	defaultBackoff := createRetryBackoff
+	createRetryBackoff = 0
+	t.Cleanup(func() { createRetryBackoff = defaultBackoff })
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			server := newMockFlapsServer(t)
+
+			launches, deletes := 0, 0
+			server.handle("POST /v1/apps", func(w http.ResponseWriter, r *http.Request) {
+				server.appDeleted = false
+				writeJSON(w, http.StatusCreated, map[string]any{})
+			})
+			server.handle("DELETE /v1/apps/{app}", func(w http.ResponseWriter, r *http.Request) {
+				deletes++
+				server.appDeleted = true
+				w.WriteHeader(http.StatusAccepted)
+			})
+			server.handle("POST /v1/apps/{app}/volumes", func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, http.StatusOK, fly.Volume{ID: "vol_1", Name: getVolumeName(testTarget.Id, testTargetOptions), Region: testTargetOptions.Region})
+			})
+			server.handle("POST /v1/apps/{app}/machines", func(w http.ResponseWriter, r *http.Request) {
+				launches++
+				if launches == 1 {
+					writeJSON(w, testCase.launchStatus, map[string]string{"error": testCase.launchError})
+					return
+				}
+				writeJSON(w, http.StatusOK, fly.Machine{ID: "m1", Name: getResourceName(testTarget.Id, testTargetOptions), State: fly.MachineStateCreated})
+			})
+			server.handle("GET /v1/apps/{app}/machines/{id}/wait", func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, http.StatusOK, map[string]any{})
+			})
+
+			opts := *testTargetOptions
+			opts.CreateMaxAttempts = testCase.maxAttempts
+
+			machine, err := CreateTarget(context.Background(), testTarget, &opts, "", nil)
+			if testCase.isValid {
+				if err != nil {
+					t.Fatalf("Expected target to be created but got error: %s", err)
+				}
+				if machine.ID != "m1" {
+					t.Errorf("Expected machine m1 but got %s", machine.ID)
+				}
+				if deletes != 1 {
+					t.Errorf("Expected partial resources to be deleted once but got %d deletes", deletes)
+				}
+			} else if err == nil {
+				t.Errorf("Expected error but got none")
+			}
+
+			if launches != testCase.expectedLaunches {
+				t.Errorf("Expected %d launches but got %d", testCase.expectedLaunches, launches)
+			}
+		})
+	}
+}
+
+func TestCreateTargetCancelled(t *testing.T) {
+	server := newMockFlapsServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	deletes := 0
+	server.handle("POST /v1/apps", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusCreated, map[string]any{})
+	})
+	server.handle("DELETE /v1/apps/{app}", func(w http.ResponseWriter, r *http.Request) {
+		deletes++
+		server.appDeleted = true
+		w.WriteHeader(http.StatusAccepted)
+	})
+	server.handle("POST /v1/apps/{app}/volumes", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, fly.Volume{ID: "vol_1", Name: getVolumeName(testTarget.Id, testTargetOptions), Region: testTargetOptions.Region})
+	})
+	server.handle("POST /v1/apps/{app}/machines", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, fly.Machine{ID: "m1", Name: getResourceName(testTarget.Id, testTargetOptions), State: fly.MachineStateCreated})
+	})
+	// The create is cancelled while waiting for the machine to start. The handler does not hold the
+	// mock lock, so the cleanup requests are served while it blocks.
+	server.mux.HandleFunc("GET /v1/apps/{app}/machines/{id}/wait", func(w http.ResponseWriter, r *http.Request) {
+		cancel()
+		<-r.Context().Done()
+	})
+
+	opts := *testTargetOptions
+	opts.CreateMaxAttempts = 3
+
+	_, err := CreateTarget(ctx, testTarget, &opts, "", nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the create to be cancelled but got: %v", err)
+	}
+	if deletes != 1 {
+		t.Errorf("Expected the partially created app to be deleted once but got %d deletes", deletes)
+	}
+}
+
+func TestStartTargetAppReadyTimeout(t *testing.T) {
+	server := newMockFlapsServer(t)
+	// The app is never found, so WaitForApp keeps polling until the timeout fires
+	server.appDeleted = true
+
+	opts := *testTargetOptions
+	opts.AppReadyTimeout = 1
+
+	start := time.Now()
+	err := StartTarget(testTarget, &opts)
+	if err == nil {
+		t.Fatalf("Expected app ready timeout error but got none")
+	}
+	if !strings.Contains(err.Error(), "timeout: app daytona-123 was not ready after 1 seconds") {
+		t.Errorf("Expected a descriptive timeout error but got: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the timeout to fire after about 1 second but took %s", elapsed)
+	}
+}
+
+func TestCreateTargetReuseExistingApp(t *testing.T) {
+	cases := []struct {
+		name             string
+		reuse            bool
+		machines         []*fly.Machine
+		expectedLaunches int
+		isValid          bool
+	}{
+		{"Reuse disabled", false, nil, 0, false},
+		{"Reuse enabled", true, nil, 1, true},
+		{"Reuse enabled with stopped machine", true, []*fly.Machine{{ID: "old", Name: getResourceName(testTarget.Id, testTargetOptions), State: fly.MachineStateStopped}}, 0, false},
+		{"Reuse enabled with destroyed machine", true, []*fly.Machine{{ID: "old", Name: getResourceName(testTarget.Id, testTargetOptions), State: fly.MachineStateDestroyed}}, 1, true},
+		{"Reuse enabled with running machine", true, []*fly.Machine{{ID: "old", Name: getResourceName(testTarget.Id, testTargetOptions), State: fly.MachineStateStarted}}, 0, true},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			server := newMockFlapsServer(t, testCase.machines...)
+
+			launches := 0
+			server.handle("POST /v1/apps", func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": "Name has already been taken"})
+			})
+			server.handle("POST /v1/apps/{app}/volumes", func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, http.StatusOK, fly.Volume{ID: "vol_1", Name: getVolumeName(testTarget.Id, testTargetOptions), Region: testTargetOptions.Region})
+			})
+			server.handle("POST /v1/apps/{app}/machines", func(w http.ResponseWriter, r *http.Request) {
+				launches++
+				writeJSON(w, http.StatusOK, fly.Machine{ID: "m1", Name: getResourceName(testTarget.Id, testTargetOptions), State: fly.MachineStateCreated})
+			})
+			server.handle("GET /v1/apps/{app}/machines/{id}/wait", func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, http.StatusOK, map[string]any{})
+			})
+
+			opts := *testTargetOptions
+			opts.ReuseExistingApp = testCase.reuse
+
+			_, err := CreateTarget(context.Background(), testTarget, &opts, "", nil)
+			if testCase.isValid && err != nil {
+				t.Errorf("Expected existing app to be reused but got error: %s", err)
+			} else if !testCase.isValid && err == nil {
+				t.Errorf("Expected error but got none")
+			}
+
+			if launches != testCase.expectedLaunches {
+				t.Errorf("Expected %d launches but got %d", testCase.expectedLaunches, launches)
+			}
+		})
+	}
+}
+
+func TestCreateTargetAlreadyProvisioned(t *testing.T) {
+	cases := []struct {
+		name               string
+		forceRecreate      bool
+		expectedAppCreates int
+		expectedDeletes    int
+		expectedMachine    string
+	}{
+		{"Running machine is kept", false, 0, 0, "old"},
+		{"Force recreate", true, 1, 1, "m1"},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			server := newMockFlapsServer(t, &fly.Machine{ID: "old", Name: getResourceName(testTarget.Id, testTargetOptions), State: fly.MachineStateStarted})
+
+			appCreates, deletes, launches := 0, 0, 0
+			server.handle("POST /v1/apps", func(w http.ResponseWriter, r *http.Request) {
+				appCreates++
+				server.appDeleted = false
+				writeJSON(w, http.StatusCreated, map[string]any{})
+			})
+			server.handle("DELETE /v1/apps/{app}", func(w http.ResponseWriter, r *http.Request) {
+				deletes++
+				server.appDeleted = true
+				server.machines = nil
+				w.WriteHeader(http.StatusAccepted)
+			})
+			server.handle("POST /v1/apps/{app}/volumes", func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, http.StatusOK, fly.Volume{ID: "vol_1", Name: getVolumeName(testTarget.Id, testTargetOptions), Region: testTargetOptions.Region})
+			})
+			server.handle("POST /v1/apps/{app}/machines", func(w http.ResponseWriter, r *http.Request) {
+				launches++
+				writeJSON(w, http.StatusOK, fly.Machine{ID: "m1", Name: getResourceName(testTarget.Id, testTargetOptions), State: fly.MachineStateCreated})
+			})
+			server.handle("GET /v1/apps/{app}/machines/{id}/wait", func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, http.StatusOK, map[string]any{})
+			})
+
+			opts := *testTargetOptions
+			opts.ForceRecreate = testCase.forceRecreate
+
+			machine, err := CreateTarget(context.Background(), testTarget, &opts, "", nil)
+			if err != nil {
+				t.Fatalf("Expected the target to be created but got error: %s", err)
+			}
+
+			if machine.ID != testCase.expectedMachine {
+				t.Errorf("Expected machine %s but got %s", testCase.expectedMachine, machine.ID)
+			}
+			if appCreates != testCase.expectedAppCreates {
+				t.Errorf("Expected %d app creates but got %d", testCase.expectedAppCreates, appCreates)
+			}
+			if deletes != testCase.expectedDeletes {
+				t.Errorf("Expected %d app deletes but got %d", testCase.expectedDeletes, deletes)
+			}
+			if launches != testCase.expectedAppCreates {
+				t.Errorf("Expected %d launches but got %d", testCase.expectedAppCreates, launches)
+			}
+		})
+	}
+}
+
+func TestGetLaunchInputImageDigest(t *testing.T) {
+	opts := *testTargetOptions
+	opts.Image = "docker:dind@sha256:" + strings.Repeat("a", 64)
+
+	launchInput := getLaunchInput(testTarget, &opts, "", &fly.Volume{ID: "vol_1"})
+	if launchInput.Config.Image != opts.Image {
+		t.Errorf("Expected image %s to be passed through but got %s", opts.Image, launchInput.Config.Image)
+	}
+}
+
+func TestCreateMachineRegionFallback(t *testing.T) {
+	server := newMockFlapsServer(t)
+
+	var volumeRegions, launchRegions, deletedVolumes []string
+	server.handle("POST /v1/apps/{app}/volumes", func(w http.ResponseWriter, r *http.Request) {
+		var req fly.CreateVolumeRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		volumeRegions = append(volumeRegions, req.Region)
+		writeJSON(w, http.StatusOK, fly.Volume{ID: "vol_" + req.Region, Name: req.Name, Region: req.Region})
+	})
+	server.handle("DELETE /v1/apps/{app}/volumes/{id}", func(w http.ResponseWriter, r *http.Request) {
+		deletedVolumes = append(deletedVolumes, r.PathValue("id"))
+		writeJSON(w, http.StatusOK, fly.Volume{ID: r.PathValue("id")})
+	})
+	server.handle("POST /v1/apps/{app}/machines", func(w http.ResponseWriter, r *http.Request) {
+		var input fly.LaunchMachineInput
+		_ = json.NewDecoder(r.Body).Decode(&input)
+		launchRegions = append(launchRegions, input.Region)
+		if input.Region == "lax" {
+			writeJSON(w, http.StatusPreconditionFailed, map[string]string{"error": "insufficient resources available to fulfill request"})
+			return
+		}
+		writeJSON(w, http.StatusOK, fly.Machine{ID: "m1", Region: input.Region})
+	})
+
+	opts := *testTargetOptions
+	opts.RegionFallback = types.StringList{"ord", "iad"}
+
+	machine, err := createMachine(context.Background(), testTarget, &opts, "", nil, false, nil)
+	if err != nil {
+		t.Fatalf("Expected machine to be launched in a fallback region but got error: %s", err)
+	}
+
+	if machine.Region != "ord" {
+		t.Errorf("Expected machine in region ord but got %s", machine.Region)
+	}
+	if expected := []string{"lax", "ord"}; !slices.Equal(launchRegions, expected) || !slices.Equal(volumeRegions, expected) {
+		t.Errorf("Expected volumes and launches in %v but got %v and %v", expected, volumeRegions, launchRegions)
+	}
+	if !slices.Equal(deletedVolumes, []string{"vol_lax"}) {
+		t.Errorf("Expected the lax volume to be deleted but got %v", deletedVolumes)
+	}
+}
+
+func TestCreateTargetVolumeParallelToAppWait(t *testing.T) {
+	appWaitStarted, volumeCreateStarted := make(chan struct{}), make(chan struct{})
+	var appWaitOnce, volumeCreateOnce sync.Once
+	// awaitOther blocks the handler until the other request has started, so it only succeeds if both run concurrently
+	awaitOther := func(other chan struct{}) bool {
+		select {
+		case <-other:
+			return true
+		case <-time.After(5 * time.Second):
+			return false
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/apps", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusCreated, map[string]any{})
+	})
+	mux.HandleFunc("GET /v1/apps/{app}", func(w http.ResponseWriter, r *http.Request) {
+		appWaitOnce.Do(func() { close(appWaitStarted) })
+		if !awaitOther(volumeCreateStarted) {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "volume was not created in parallel"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"name": r.PathValue("app")})
+	})
+	mux.HandleFunc("GET /v1/apps/{app}/volumes", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, []fly.Volume{})
+	})
+	mux.HandleFunc("POST /v1/apps/{app}/volumes", func(w http.ResponseWriter, r *http.Request) {
+		volumeCreateOnce.Do(func() { close(volumeCreateStarted) })
+		if !awaitOther(appWaitStarted) {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "app was not awaited in parallel"})
+			return
+		}
+		writeJSON(w, http.StatusOK, fly.Volume{ID: "vol_1", Name: getVolumeName(testTarget.Id, testTargetOptions), Region: testTargetOptions.Region})
+	})
+	mux.HandleFunc("GET /v1/apps/{app}/machines", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, []fly.Machine{})
+	})
+	mux.HandleFunc("POST /v1/apps/{app}/machines", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, fly.Machine{ID: "m1", Name: getResourceName(testTarget.Id, testTargetOptions), State: fly.MachineStateCreated})
+	})
+	mux.HandleFunc("GET /v1/apps/{app}/machines/{id}/wait", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{})
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	t.Setenv("FLY_FLAPS_BASE_URL", server.URL)
+
+	opts := *testTargetOptions
+	opts.CreateMaxAttempts = 1
+
+	_, err := CreateTarget(context.Background(), testTarget, &opts, "", nil)
+	if err != nil {
+		t.Fatalf("Expected the volume to be created while waiting for the app but got error: %s", err)
+	}
+}
+
+func TestCreateTargetVolumeErrorCancelsAppWait(t *testing.T) {
+	server := newMockFlapsServer(t)
+	// The app is never found, so only the failing volume creation can end the app wait early
+	server.appDeleted = true
+
+	server.handle("POST /v1/apps", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusCreated, map[string]any{})
+	})
+	server.handle("POST /v1/apps/{app}/volumes", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": "invalid volume size"})
+	})
+
+	opts := *testTargetOptions
+	opts.CreateMaxAttempts = 1
+	opts.AppReadyTimeout = 30
+
+	start := time.Now()
+	_, err := CreateTarget(context.Background(), testTarget, &opts, "", nil)
+	if err == nil || !strings.Contains(err.Error(), "invalid volume size") {
+		t.Fatalf("Expected the volume error but got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Expected the app wait to be cancelled but took %s", elapsed)
+	}
+}
+
+func TestCreateVolume(t *testing.T) {
+	attachedMachine := "m_old"
+	cases := []struct {
+		name            string
+		existing        []fly.Volume
+		failures        int
+		expectedVolume  string
+		expectedCreated bool
+		expectedCreates int
+		expectedErr     string
+	}{
+		{"Fresh volume", nil, 0, "vol_new", true, 1, ""},
+		{"Transient failure retried", nil, 1, "vol_new", true, 2, ""},
+		{"Transient failures exhausted", nil, 3, "", false, 3, "failed to create data volume in region lax"},
+		{"Unattached volume reused", []fly.Volume{{ID: "vol_old", Name: getVolumeName(testTarget.Id, testTargetOptions), Region: "lax"}}, 0, "vol_old", false, 0, ""},
+		{"Volume in another region ignored", []fly.Volume{{ID: "vol_ord", Name: getVolumeName(testTarget.Id, testTargetOptions), Region: "ord"}}, 0, "vol_new", true, 1, ""},
+		{"Attached volume", []fly.Volume{{ID: "vol_old", Name: getVolumeName(testTarget.Id, testTargetOptions), Region: "lax", AttachedMachine: &attachedMachine}}, 0, "", false, 0, "is attached to another machine"},
+	}
+
+	defaultBackoff := volumeCreateBackoff
+	volumeCreateBackoff = 0
+	t.Cleanup(func() { volumeCreateBackoff = defaultBackoff })
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			server := newMockFlapsServer(t)
+			server.volumes = testCase.existing
+
+			creates := 0
+			server.handle("POST /v1/apps/{app}/volumes", func(w http.ResponseWriter, r *http.Request) {
+				creates++
+				if creates <= testCase.failures {
+					writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal error"})
+					return
+				}
+				writeJSON(w, http.StatusOK, fly.Volume{ID: "vol_new", Name: getVolumeName(testTarget.Id, testTargetOptions), Region: "lax"})
+			})
+
+			flapsClient, err := createFlapsClient(getAppName(testTarget.Id, testTargetOptions), testTargetOptions)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			volume, created, err := createVolume(context.Background(), flapsClient, testTarget, testTargetOptions, nil)
+			if testCase.expectedErr != "" {
+				if err == nil || !strings.Contains(err.Error(), testCase.expectedErr) {
+					t.Errorf("Expected error %q but got %v", testCase.expectedErr, err)
+				}
+			} else if err != nil {
+				t.Fatalf("Expected volume but got error: %s", err)
+			} else if volume.ID != testCase.expectedVolume || created != testCase.expectedCreated {
+				t.Errorf("Expected volume %s (created %t) but got %s (created %t)", testCase.expectedVolume, testCase.expectedCreated, volume.ID, created)
+			}
+
+			if creates != testCase.expectedCreates {
+				t.Errorf("Expected %d create requests but got %d", testCase.expectedCreates, creates)
+			}
+		})
+	}
+}
+
+func TestLaunchMachineVolumeRegionMismatch(t *testing.T) {
+	server := newMockFlapsServer(t)
+	launches := 0
+	server.handle("POST /v1/apps/{app}/machines", func(w http.ResponseWriter, r *http.Request) {
+		launches++
+		writeJSON(w, http.StatusOK, fly.Machine{ID: "m1", Region: "lax"})
+	})
+
+	flapsClient, err := createFlapsClient(getAppName(testTarget.Id, testTargetOptions), testTargetOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	volume := &fly.Volume{ID: "vol_1", Region: "ord"}
+	_, err = launchMachineInRegion(context.Background(), flapsClient, testTarget, testTargetOptions, "", volume, false, nil)
+	if !errors.Is(err, ErrVolumeRegionMismatch) {
+		t.Errorf("Expected a volume region mismatch error but got %v", err)
+	}
+	if launches != 0 {
+		t.Errorf("Expected no machine to be launched but got %d launch requests", launches)
+	}
+}
+
+func TestCreateVolumeExistingVolumeId(t *testing.T) {
+	attachedMachine := "m_old"
+	cases := []struct {
+		name        string
+		volume      *fly.Volume
+		expectedErr string
+	}{
+		{"Volume attached", &fly.Volume{ID: "vol_keep", Region: "lax"}, ""},
+		{"Volume in another region", &fly.Volume{ID: "vol_keep", Region: "ord"}, "volume vol_keep is in region ord but the machine is launched in region lax"},
+		{"Volume attached to another machine", &fly.Volume{ID: "vol_keep", Region: "lax", AttachedMachine: &attachedMachine}, "is attached to another machine"},
+		{"Volume not found", nil, "volume not found"},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			server := newMockFlapsServer(t)
+
+			creates := 0
+			server.handle("POST /v1/apps/{app}/volumes", func(w http.ResponseWriter, r *http.Request) {
+				creates++
+				writeJSON(w, http.StatusOK, fly.Volume{ID: "vol_new", Region: "lax"})
+			})
+			server.handle("GET /v1/apps/{app}/volumes/{id}", func(w http.ResponseWriter, r *http.Request) {
+				if testCase.volume == nil || r.PathValue("id") != testCase.volume.ID {
+					writeJSON(w, http.StatusNotFound, map[string]string{"error": "volume not found"})
+					return
+				}
+				writeJSON(w, http.StatusOK, testCase.volume)
+			})
+
+			opts := *testTargetOptions
+			opts.VolumeId = "vol_keep"
+
+			flapsClient, err := createFlapsClient(getAppName(testTarget.Id, &opts), &opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			volume, created, err := createVolume(context.Background(), flapsClient, testTarget, &opts, nil)
+			if testCase.expectedErr != "" {
+				if err == nil || !strings.Contains(err.Error(), testCase.expectedErr) {
+					t.Errorf("Expected error %q but got %v", testCase.expectedErr, err)
+				}
+			} else if err != nil {
+				t.Fatalf("Expected the existing volume but got error: %s", err)
+			} else if volume.ID != "vol_keep" || created {
+				t.Errorf("Expected the existing volume vol_keep to be reused but got %s (created %t)", volume.ID, created)
+			}
+
+			if creates != 0 {
+				t.Errorf("Expected no volume to be created but got %d create requests", creates)
+			}
+
+			if testCase.expectedErr == "" {
+				launchInput := getLaunchInput(testTarget, &opts, "", volume)
+				if mount := launchInput.Config.Mounts[0]; mount.Volume != "vol_keep" {
+					t.Errorf("Expected the machine to mount vol_keep but got %s", mount.Volume)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateMachineVolumeCapacityFallback(t *testing.T) {
+	server := newMockFlapsServer(t)
+
+	var volumeRegions []string
+	server.handle("POST /v1/apps/{app}/volumes", func(w http.ResponseWriter, r *http.Request) {
+		var req fly.CreateVolumeRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		volumeRegions = append(volumeRegions, req.Region)
+		if req.Region == "lax" {
+			writeJSON(w, http.StatusPreconditionFailed, map[string]string{"error": "insufficient resources available to fulfill request"})
+			return
+		}
+		writeJSON(w, http.StatusOK, fly.Volume{ID: "vol_" + req.Region, Name: req.Name, Region: req.Region})
+	})
+	server.handle("POST /v1/apps/{app}/machines", func(w http.ResponseWriter, r *http.Request) {
+		var input fly.LaunchMachineInput
+		_ = json.NewDecoder(r.Body).Decode(&input)
+		writeJSON(w, http.StatusOK, fly.Machine{ID: "m1", Region: input.Region})
+	})
+
+	opts := *testTargetOptions
+	opts.RegionFallback = types.StringList{"ord"}
+
+	machine, err := createMachine(context.Background(), testTarget, &opts, "", nil, false, nil)
+	if err != nil {
+		t.Fatalf("Expected machine to be launched in the fallback region but got error: %s", err)
+	}
+	if machine.Region != "ord" {
+		t.Errorf("Expected machine in region ord but got %s", machine.Region)
+	}
+	// Capacity errors are not retried within a region
+	if expected := []string{"lax", "ord"}; !slices.Equal(volumeRegions, expected) {
+		t.Errorf("Expected volumes to be created in %v but got %v", expected, volumeRegions)
+	}
+}
+
+func TestCreateMachineNoPersistentDisk(t *testing.T) {
+	server := newMockFlapsServer(t)
+
+	var launchInput fly.LaunchMachineInput
+	server.handle("POST /v1/apps/{app}/volumes", func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Expected no volume to be created")
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "unexpected volume"})
+	})
+	server.handle("POST /v1/apps/{app}/machines", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&launchInput)
+		writeJSON(w, http.StatusOK, fly.Machine{ID: "m1", Region: launchInput.Region, Config: launchInput.Config})
+	})
+
+	opts := *testTargetOptions
+	opts.NoPersistentDisk = true
+
+	_, err := createMachine(context.Background(), testTarget, &opts, "", nil, false, nil)
+	if err != nil {
+		t.Fatalf("Expected machine to be launched without a volume but got error: %s", err)
+	}
+	if len(launchInput.Config.Mounts) != 0 {
+		t.Errorf("Expected no mounts but got %v", launchInput.Config.Mounts)
+	}
+
+	script := getMachineScript(&opts, "")
+	if strings.Contains(script, "/proc/mounts") {
+		t.Error("Expected no mount probe in the machine script")
+	}
+}
+
+func TestApiBaseUrlOptions(t *testing.T) {
+	var apiPaths, flapsPaths []string
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiPaths = append(apiPaths, r.URL.Path)
+		writeJSON(w, http.StatusOK, map[string]any{
+			"data": map[string]any{"nearestRegion": map[string]any{"code": "ams"}},
+		})
+	}))
+	t.Cleanup(apiServer.Close)
+	flapsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flapsPaths = append(flapsPaths, r.URL.Path)
+		writeJSON(w, http.StatusOK, []fly.Machine{})
+	}))
+	t.Cleanup(flapsServer.Close)
+	t.Cleanup(func() { fly.SetBaseURL(flyApiBaseUrl) })
+	t.Setenv("FLY_FLAPS_BASE_URL", "")
+
+	opts := *testTargetOptions
+	opts.ApiBaseUrl = apiServer.URL
+	opts.FlapsBaseUrl = flapsServer.URL + "/proxy"
+
+	_, err := NearestRegion(&opts)
+	if err != nil {
+		t.Fatalf("Expected nearest region through the api base url but got error: %s", err)
+	}
+
+	flapsClient, err := createFlapsClient(getAppName(testTarget.Id, &opts), &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = flapsClient.List(context.Background(), "")
+	if err != nil {
+		t.Fatalf("Expected machines to be listed through the flaps base url but got error: %s", err)
+	}
+
+	if !slices.Equal(apiPaths, []string{"/graphql"}) {
+		t.Errorf("Expected a graphql request to the api base url but got %v", apiPaths)
+	}
+	if !slices.Equal(flapsPaths, []string{"/proxy/v1/apps/daytona-123/machines"}) {
+		t.Errorf("Expected a machines request below the flaps base url but got %v", flapsPaths)
+	}
+}
+
+func TestStreamTargetLogsCancel(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		token := fmt.Sprintf("token-%d", requests)
+		mu.Unlock()
+
+		writeJSON(w, http.StatusOK, map[string]any{
+			"data": []any{map[string]any{"attributes": map[string]string{"message": "log line", "instance": "m1"}}},
+			"meta": map[string]string{"next_token": token},
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	defaultApiBaseUrl := flyApiBaseUrl
+	flyApiBaseUrl = server.URL
+	t.Cleanup(func() {
+		flyApiBaseUrl = defaultApiBaseUrl
+		fly.SetBaseURL(defaultApiBaseUrl)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	out := &cancelingWriter{cancelAfter: 3, cancel: cancel}
+
+	done := make(chan error)
+	go func() {
+		done <- StreamTargetLogs(ctx, testTarget, testTargetOptions, "m1", out)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected stream to end without error on cancel but got: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected stream to stop after the context was cancelled")
+	}
+
+	if out.writes < 3 || !strings.Contains(out.lines[0], "log line") {
+		t.Errorf("Expected streamed log lines before cancel but got %v", out.lines)
+	}
+}
+
+func TestPollLogsRateLimited(t *testing.T) {
+	var mu sync.Mutex
+	var requestTimes []time.Time
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requestTimes = append(requestTimes, time.Now())
+		first := len(requestTimes) == 1
+		mu.Unlock()
+
+		if first {
+			w.Header().Set("Retry-After", "1")
+			writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "rate limited"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"data": []any{map[string]any{"attributes": map[string]string{"message": "log line"}}},
+			"meta": map[string]string{"next_token": "token-1"},
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	defaultApiBaseUrl := flyApiBaseUrl
+	flyApiBaseUrl = server.URL
+	t.Cleanup(func() {
+		flyApiBaseUrl = defaultApiBaseUrl
+		fly.SetBaseURL(defaultApiBaseUrl)
+	})
+
+	client, err := createFlyClient("daytona-app", testTargetOptions)
+	if err != nil {
+		t.Fatalf("Expected fly client to be created but got error: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	out := make(chan string)
+	done := make(chan error, 1)
+	go func() {
+		done <- pollLogs(ctx, out, client, "daytona-app", "", "m1")
+	}()
+
+	select {
+	case line := <-out:
+		if !strings.Contains(line, "log line") {
+			t.Errorf("Expected a log line after the rate limit but got %q", line)
+		}
+	case err := <-done:
+		t.Fatalf("Expected polling to continue after the rate limit but got: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected logs to be fetched after the rate limit")
+	}
+	cancel()
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	if delay := requestTimes[1].Sub(requestTimes[0]); delay < time.Second {
+		t.Errorf("Expected the retry to wait for the Retry-After delay but it was sent after %s", delay)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name     string
+		header   string
+		expected time.Duration
+	}{
+		{"Seconds", "30", 30 * time.Second},
+		{"Http date", now.Add(time.Minute).Format(http.TimeFormat), time.Minute},
+		{"Date in the past", now.Add(-time.Minute).Format(http.TimeFormat), 0},
+		{"Empty", "", 0},
+		{"Invalid", "soon", 0},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if delay := parseRetryAfter(testCase.header, now); delay != testCase.expected {
+				t.Errorf("Expected delay %s but got %s", testCase.expected, delay)
+			}
+		})
+	}
+}
+
+// cancelingWriter records writes and cancels the stream after a number of writes.
+type cancelingWriter struct {
+	writes      int
+	lines       []string
+	cancelAfter int
+	cancel      context.CancelFunc
+}
+
+func (w *cancelingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	w.lines = append(w.lines, string(p))
+	if w.writes == w.cancelAfter {
+		w.cancel()
+	}
+	return len(p), nil
+}
+
+func TestGetLogsSince(t *testing.T) {
+	pages := map[string]struct {
+		timestamps []string
+		nextToken  string
+	}{
+		"":        {[]string{"2024-05-01T09:00:00Z", "2024-05-01T10:00:00Z"}, "token-1"},
+		"token-1": {[]string{"2024-05-01T10:30:00Z", "not a timestamp"}, "token-2"},
+		"token-2": {[]string{"2024-05-01T11:00:00Z", "2024-05-01T12:00:00Z"}, "token-3"},
+		"token-3": {[]string{"2024-05-01T13:00:00Z"}, "token-3"},
+	}
+
+	var requestedTokens []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("next_token")
+		requestedTokens = append(requestedTokens, token)
+
+		data := []any{}
+		for _, timestamp := range pages[token].timestamps {
+			data = append(data, map[string]any{"attributes": map[string]string{"timestamp": timestamp, "message": "line at " + timestamp}})
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"data": data, "meta": map[string]string{"next_token": pages[token].nextToken}})
+	}))
+	t.Cleanup(server.Close)
+
+	defaultApiBaseUrl := flyApiBaseUrl
+	flyApiBaseUrl = server.URL
+	t.Cleanup(func() {
+		flyApiBaseUrl = defaultApiBaseUrl
+		fly.SetBaseURL(defaultApiBaseUrl)
+	})
+
+	since := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	until := time.Date(2024, 5, 1, 11, 30, 0, 0, time.UTC)
+	entries, err := GetLogsSince(context.Background(), testTarget, testTargetOptions, "m1", since, until)
+	if err != nil {
+		t.Fatalf("Expected logs but got error: %s", err)
+	}
+
+	var timestamps []string
+	for _, entry := range entries {
+		timestamps = append(timestamps, entry.Timestamp)
+	}
+	expected := []string{"2024-05-01T10:00:00Z", "2024-05-01T10:30:00Z", "2024-05-01T11:00:00Z"}
+	if !slices.Equal(timestamps, expected) {
+		t.Errorf("Expected entries %v but got %v", expected, timestamps)
+	}
+
+	// Paging stops at the entry past until, so the last page is never requested
+	if !slices.Equal(requestedTokens, []string{"", "token-1", "token-2"}) {
+		t.Errorf("Expected paging to stop after the window but requested %v", requestedTokens)
+	}
+}
+
+func TestGetLogsSinceCancelledWhileRateLimited(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "60")
+		writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "rate limited"})
+	}))
+	t.Cleanup(server.Close)
+
+	defaultApiBaseUrl := flyApiBaseUrl
+	flyApiBaseUrl = server.URL
+	t.Cleanup(func() {
+		flyApiBaseUrl = defaultApiBaseUrl
+		fly.SetBaseURL(defaultApiBaseUrl)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := GetLogsSince(ctx, testTarget, testTargetOptions, "m1", start.Add(-time.Hour), start)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the cancelled context to stop the retries but got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the retries to stop once the context is done but took %s", elapsed)
+	}
+}
+
+func TestDockerStartTimedOut(t *testing.T) {
+	cases := []struct {
+		name     string
+		messages []string
+		timedOut bool
+	}{
+		{"docker started", []string{"Waiting for Docker to start...", "Starting daytona agent"}, false},
+		{"docker timed out", []string{"Waiting for Docker to start...", "Timed out waiting for Docker to start"}, true},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				data := []any{}
+				for _, message := range testCase.messages {
+					data = append(data, map[string]any{"attributes": map[string]string{
+						"timestamp": time.Now().Add(-time.Second).UTC().Format(time.RFC3339Nano),
+						"message":   message,
+					}})
+				}
+				writeJSON(w, http.StatusOK, map[string]any{"data": data, "meta": map[string]string{"next_token": ""}})
+			}))
+			t.Cleanup(server.Close)
+
+			defaultApiBaseUrl := flyApiBaseUrl
+			flyApiBaseUrl = server.URL
+			t.Cleanup(func() {
+				flyApiBaseUrl = defaultApiBaseUrl
+				fly.SetBaseURL(defaultApiBaseUrl)
+			})
+
+			timedOut, err := DockerStartTimedOut(context.Background(), testTarget, testTargetOptions, "m1", time.Now().Add(-time.Minute))
+			if err != nil {
+				t.Fatalf("Expected logs to be checked but got error: %s", err)
+			}
+			if timedOut != testCase.timedOut {
+				t.Errorf("Expected timed out %t but got %t", testCase.timedOut, timedOut)
+			}
+		})
+	}
+}
+
+func TestUpdateMachineSize(t *testing.T) {
+	volumeName := getVolumeName(testTarget.Id, testTargetOptions)
+	machine := &fly.Machine{
+		ID:     "m1",
+		Name:   getResourceName(testTarget.Id, testTargetOptions),
+		Region: testTargetOptions.Region,
+		State:  fly.MachineStateStarted,
+		Config: &fly.MachineConfig{
+			Guest:  fly.MachinePresets[testTargetOptions.Size],
+			Mounts: []fly.MachineMount{{Name: volumeName, Volume: "vol_1", Path: dockerDataPath(testTargetOptions)}},
+		},
+	}
+	server := newMockFlapsServer(t, machine)
+
+	var calls []string
+	var updated fly.LaunchMachineInput
+	server.handle("POST /v1/apps/{app}/machines/{id}/stop", func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, "stop")
+		machine.State = fly.MachineStateStopped
+		writeJSON(w, http.StatusOK, map[string]any{})
+	})
+	server.handle("POST /v1/apps/{app}/machines/{id}", func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, "update")
+		_ = json.NewDecoder(r.Body).Decode(&updated)
+		machine.Config = updated.Config
+		writeJSON(w, http.StatusOK, machine)
+	})
+	server.handle("POST /v1/apps/{app}/machines/{id}/start", func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, "start")
+		machine.State = fly.MachineStateStarted
+		writeJSON(w, http.StatusOK, map[string]any{})
+	})
+	server.handle("GET /v1/apps/{app}/machines/{id}/wait", func(w http.ResponseWriter, r *http.Request) {
+		if machine.State != r.URL.Query().Get("state") {
+			writeJSON(w, http.StatusRequestTimeout, map[string]string{"error": "deadline_exceeded"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{})
+	})
+
+	err := UpdateMachineSize(testTarget, testTargetOptions, "performance-2x")
+	if err != nil {
+		t.Fatalf("Expected the machine to be resized but got error: %s", err)
+	}
+
+	if expected := []string{"stop", "update", "start"}; !slices.Equal(calls, expected) {
+		t.Errorf("Expected calls %v but got %v", expected, calls)
+	}
+	if !updated.SkipLaunch {
+		t.Errorf("Expected the machine to stay stopped while it is updated")
+	}
+	if !guestMatches(updated.Config.Guest, fly.MachinePresets["performance-2x"]) || updated.Config.VMSize != "performance-2x" {
+		t.Errorf("Expected the machine to be resized to performance-2x but got %+v", updated.Config.Guest)
+	}
+	if len(updated.Config.Mounts) != 1 || updated.Config.Mounts[0].Volume != "vol_1" {
+		t.Errorf("Expected the volume to stay attached but got mounts %+v", updated.Config.Mounts)
+	}
+	if size := updated.Config.Metadata[MachineSizeMetadataKey]; size != "performance-2x" {
+		t.Errorf("Expected the new size to be recorded in the metadata but got %q", size)
+	}
+
+	err = UpdateMachineSize(testTarget, testTargetOptions, "huge")
+	if err == nil {
+		t.Errorf("Expected an invalid size to be rejected")
+	}
+}
+
+func TestExtendVolume(t *testing.T) {
+	workspace := &models.Workspace{Id: "ws", TargetId: testTarget.Id}
+
+	cases := []struct {
+		name             string
+		newSizeGb        int
+		needsRestart     bool
+		expectedExtends  int
+		expectedRestarts int
+		isValid          bool
+	}{
+		{
+			name:            "Volume is extended",
+			newSizeGb:       20,
+			expectedExtends: 1,
+			isValid:         true,
+		},
+		{
+			name:             "Machine is restarted when needed",
+			newSizeGb:        20,
+			needsRestart:     true,
+			expectedExtends:  1,
+			expectedRestarts: 1,
+			isValid:          true,
+		},
+		{
+			name:      "Shrinking is rejected",
+			newSizeGb: 5,
+			isValid:   false,
+		},
+		{
+			name:      "Same size is rejected",
+			newSizeGb: 10,
+			isValid:   false,
+		},
+		{
+			name:      "Size above maximum is rejected",
+			newSizeGb: types.MaxDiskSize + 1,
+			isValid:   false,
+		},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			machine := &fly.Machine{ID: "m1", Name: getResourceName(testTarget.Id, testTargetOptions), State: fly.MachineStateStarted}
+			server := newMockFlapsServer(t, machine)
+			server.volumes = []fly.Volume{{ID: "vol_1", Name: getVolumeName(testTarget.Id, testTargetOptions), SizeGb: 10}}
+
+			extends := 0
+			var extendedSize int
+			server.handle("PUT /v1/apps/{app}/volumes/{id}/extend", func(w http.ResponseWriter, r *http.Request) {
+				extends++
+				var request map[string]int
+				_ = json.NewDecoder(r.Body).Decode(&request)
+				extendedSize = request["size_gb"]
+				writeJSON(w, http.StatusOK, map[string]any{
+					"volume":        fly.Volume{ID: "vol_1", SizeGb: extendedSize},
+					"needs_restart": testCase.needsRestart,
+				})
+			})
+			restarts := 0
+			server.handle("POST /v1/apps/{app}/machines/{id}/restart", func(w http.ResponseWriter, r *http.Request) {
+				restarts++
+				writeJSON(w, http.StatusOK, map[string]any{})
+			})
+			server.handle("GET /v1/apps/{app}/machines/{id}/wait", func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, http.StatusOK, map[string]any{})
+			})
+
+			err := ExtendVolume(workspace, testTargetOptions, testCase.newSizeGb)
+			if testCase.isValid && err != nil {
+				t.Fatalf("Expected the volume to be extended but got error: %s", err)
+			} else if !testCase.isValid && err == nil {
+				t.Errorf("Expected an error but got none")
+			}
+
+			if extends != testCase.expectedExtends {
+				t.Errorf("Expected %d extend calls but got %d", testCase.expectedExtends, extends)
+			}
+			if extends > 0 && extendedSize != testCase.newSizeGb {
+				t.Errorf("Expected the volume to be extended to %dGB but got %dGB", testCase.newSizeGb, extendedSize)
+			}
+			if restarts != testCase.expectedRestarts {
+				t.Errorf("Expected %d restarts but got %d", testCase.expectedRestarts, restarts)
+			}
+		})
+	}
+}
+
+func TestExtendVolumeWithVolumeId(t *testing.T) {
+	server := newMockFlapsServer(t)
+	server.handle("GET /v1/apps/{app}/volumes/{id}", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, fly.Volume{ID: r.PathValue("id"), Name: "recovered", SizeGb: 10})
+	})
+
+	var extended string
+	server.handle("PUT /v1/apps/{app}/volumes/{id}/extend", func(w http.ResponseWriter, r *http.Request) {
+		extended = r.PathValue("id")
+		writeJSON(w, http.StatusOK, map[string]any{
+			"volume":        fly.Volume{ID: extended, SizeGb: 20},
+			"needs_restart": false,
+		})
+	})
+
+	opts := *testTargetOptions
+	opts.VolumeId = "vol_existing"
+
+	err := ExtendVolume(&models.Workspace{Id: "ws", TargetId: testTarget.Id}, &opts, 20)
+	if err != nil {
+		t.Fatalf("Expected the volume to be extended but got error: %s", err)
+	}
+	if extended != "vol_existing" {
+		t.Errorf("Expected volume vol_existing to be extended but got %q", extended)
+	}
+}
+
+func TestCreateTargetProgressFunc(t *testing.T) {
+	server := newMockFlapsServer(t)
+	server.handle("POST /v1/apps", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusCreated, map[string]any{})
+	})
+	server.handle("POST /v1/apps/{app}/machines", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, fly.Machine{ID: "m1", Name: getResourceName(testTarget.Id, testTargetOptions), State: fly.MachineStateCreated})
+	})
+	server.handle("GET /v1/apps/{app}/machines/{id}/wait", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{})
+	})
+
+	// Without a volume the phases run one after another
+	opts := *testTargetOptions
+	opts.NoPersistentDisk = true
+
+	var phases []string
+	timings := NewPhaseTimings(nil)
+	timings.SetProgressFunc(func(phase string, elapsed time.Duration) {
+		phases = append(phases, phase)
+	})
+
+	_, err := CreateTarget(context.Background(), testTarget, &opts, "", timings)
+	if err != nil {
+		t.Fatalf("Expected target to be created but got error: %s", err)
+	}
+
+	if expected := []string{PhaseAppCreate, PhaseMachineLaunch, PhaseMachineStart}; !slices.Equal(phases, expected) {
+		t.Errorf("Expected phases %v but got %v", expected, phases)
+	}
+}
@@ -0,0 +1,115 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/daytonaio/daytona-provider-fly/pkg/types"
+	"github.com/superfly/fly-go"
+	"golang.org/x/sync/errgroup"
+)
+
+// fetchLogsParallelism is the maximum number of machines FetchRecentLogs fetches the logs of at once.
+const fetchLogsParallelism = 4
+
+// machineLocation is the app and region a machine runs in, which the fly logs API needs to find its logs.
+type machineLocation struct {
+	appName string
+	region  string
+}
+
+// FetchRecentLogs returns the logs of the last sinceDuration of each of the machines, keyed by machine ID.
+// The machines are looked up in the daytona apps of the organization named with the name prefix, the default
+// prefix if it is empty, and their logs are fetched a few at
+// a time, retrying rate limited requests a few times until ctx is done. A machine whose logs could not be fetched is left out of the map
+// and its error is joined into the returned error.
+func FetchRecentLogs(ctx context.Context, orgSlug, token, namePrefix string, machineIds []string, sinceDuration time.Duration) (map[string][]fly.LogEntry, error) {
+	opts := &types.TargetOptions{OrgSlug: orgSlug, AuthToken: token, NamePrefix: namePrefix}
+	locations, err := locateMachines(ctx, opts, machineIds)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := createFlyClient("", opts)
+	if err != nil {
+		return nil, err
+	}
+
+	until := time.Now()
+	since := until.Add(-sinceDuration)
+
+	var mu sync.Mutex
+	logs := map[string][]fly.LogEntry{}
+	errs := []error{}
+	group := errgroup.Group{}
+	group.SetLimit(fetchLogsParallelism)
+	for _, machineId := range machineIds {
+		group.Go(func() error {
+			location, ok := locations[machineId]
+			var entries []fly.LogEntry
+			var err error
+			if !ok {
+				err = fmt.Errorf("machine %s not found in the daytona apps of organization %s", machineId, orgSlug)
+			} else {
+				entries, err = getAppLogsBetween(ctx, client, location.appName, location.region, machineId, since, until)
+				if err != nil {
+					err = fmt.Errorf("failed to fetch logs of machine %s: %w", machineId, err)
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+			} else {
+				logs[machineId] = entries
+			}
+			return nil
+		})
+	}
+	_ = group.Wait()
+
+	return logs, errors.Join(errs...)
+}
+
+// locateMachines returns the location of the machines found in the daytona apps of the organization.
+// Machines that are not found are left out of the map.
+func locateMachines(ctx context.Context, opts *types.TargetOptions, machineIds []string) (map[string]machineLocation, error) {
+	appNames, err := listDaytonaApps(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	wanted := map[string]bool{}
+	for _, machineId := range machineIds {
+		wanted[machineId] = true
+	}
+
+	locations := map[string]machineLocation{}
+	for _, appName := range appNames {
+		if len(locations) == len(wanted) {
+			break
+		}
+
+		flapsClient, err := createFlapsClient(appName, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		machines, err := flapsClient.List(ctx, "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to list machines of app %s: %w", appName, err)
+		}
+
+		for _, machine := range machines {
+			if wanted[machine.ID] {
+				locations[machine.ID] = machineLocation{appName: appName, region: machine.Region}
+			}
+		}
+	}
+
+	return locations, nil
+}
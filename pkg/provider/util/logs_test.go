@@ -0,0 +1,98 @@
+package util
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/superfly/fly-go"
+)
+
+func TestFetchRecentLogs(t *testing.T) {
+	machineIds := []string{"m1", "m2", "m3", "m4", "m5", "m6", "m7", "m8"}
+
+	var inFlight, maxInFlight atomic.Int32
+	var mu sync.Mutex
+	requests := map[string]int{}
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			writeOrgApps(w, r, "other-app", "daytona-a")
+			return
+		}
+
+		machineId := r.URL.Query().Get("instance")
+		mu.Lock()
+		requests[machineId]++
+		attempt := requests[machineId]
+		mu.Unlock()
+
+		current := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			previous := maxInFlight.Load()
+			if current <= previous || maxInFlight.CompareAndSwap(previous, current) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+
+		if machineId == "m2" && attempt == 1 {
+			w.Header().Set("Retry-After", "1")
+			writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "rate limited"})
+			return
+		}
+
+		data := []any{}
+		for _, timestamp := range []time.Time{time.Now().Add(-2 * time.Hour), time.Now().Add(-time.Minute)} {
+			data = append(data, map[string]any{"attributes": map[string]string{
+				"timestamp": timestamp.UTC().Format(time.RFC3339Nano),
+				"message":   "line of " + machineId,
+			}})
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"data": data, "meta": map[string]string{"next_token": ""}})
+	}))
+	t.Cleanup(apiServer.Close)
+
+	defaultApiBaseUrl := flyApiBaseUrl
+	flyApiBaseUrl = apiServer.URL
+	t.Cleanup(func() {
+		flyApiBaseUrl = defaultApiBaseUrl
+		fly.SetBaseURL(defaultApiBaseUrl)
+	})
+
+	machines := []*fly.Machine{}
+	for _, machineId := range machineIds {
+		machines = append(machines, &fly.Machine{ID: machineId, Region: "lax", State: fly.MachineStateStarted})
+	}
+	newMockFlapsServer(t, machines...)
+
+	logs, err := FetchRecentLogs(context.Background(), "org", "token", "", append(machineIds, "missing"), time.Hour)
+	if err == nil || !strings.Contains(err.Error(), "machine missing not found") {
+		t.Fatalf("Expected the missing machine to be reported but got %v", err)
+	}
+	if strings.Contains(err.Error(), "m2") {
+		t.Errorf("Expected the rate limited request to be retried but got %v", err)
+	}
+
+	if len(logs) != len(machineIds) {
+		t.Fatalf("Expected logs of %d machines but got %d", len(machineIds), len(logs))
+	}
+	for _, machineId := range machineIds {
+		entries := logs[machineId]
+		if len(entries) != 1 || entries[0].Message != "line of "+machineId {
+			t.Errorf("Expected the recent log line of machine %s but got %v", machineId, entries)
+		}
+	}
+
+	if peak := maxInFlight.Load(); peak > fetchLogsParallelism {
+		t.Errorf("Expected at most %d log requests at once but got %d", fetchLogsParallelism, peak)
+	}
+	if requests["m2"] != 2 {
+		t.Errorf("Expected the rate limited request to be retried once but got %d requests", requests["m2"])
+	}
+}
@@ -0,0 +1,99 @@
+package util
+
+import (
+	"fmt"
+
+	"github.com/daytonaio/daytona-provider-fly/pkg/types"
+)
+
+// hoursPerMonth is the number of hours fly bills for a machine running a full month.
+const hoursPerMonth = 730
+
+// performance8xMonthlyUsd is the approximate monthly price in USD of a performance-8x machine with its
+// included 16GB of memory.
+const performance8xMonthlyUsd = 248.00
+
+// memoryMonthlyUsdPerGb is the approximate monthly price in USD of a GB of memory above the included memory.
+const memoryMonthlyUsdPerGb = 5.00
+
+// gpuMachineExtraMemoryGb is the memory GPU machines have above the 16GB included with a performance-8x machine.
+const gpuMachineExtraMemoryGb = 16
+
+// gpuMachineMonthlyUsd is the approximate monthly price in USD of the machine of a GPU size, excluding the GPU.
+// GPU machines are a performance-8x machine with 32GB of memory.
+const gpuMachineMonthlyUsd = performance8xMonthlyUsd + gpuMachineExtraMemoryGb*memoryMonthlyUsdPerGb
+
+// machineMonthlyUsd is the approximate monthly price in USD of a machine of each size running all month,
+// excluding GPUs. Prices are taken from https://fly.io/docs/about/pricing/ and must be updated when fly
+// changes them.
+var machineMonthlyUsd = map[string]float64{
+	"shared-cpu-1x":   1.94,
+	"shared-cpu-2x":   3.89,
+	"shared-cpu-4x":   7.78,
+	"shared-cpu-8x":   15.55,
+	"performance-1x":  31.00,
+	"performance-2x":  62.00,
+	"performance-4x":  124.00,
+	"performance-8x":  performance8xMonthlyUsd,
+	"performance-16x": 496.00,
+	"a10":             gpuMachineMonthlyUsd,
+	"l40s":            gpuMachineMonthlyUsd,
+	"a100-40gb":       gpuMachineMonthlyUsd,
+	"a100-80gb":       gpuMachineMonthlyUsd,
+}
+
+// gpuHourlyUsd is the approximate hourly price in USD of the GPU of each GPU size.
+var gpuHourlyUsd = map[string]float64{
+	"a10":       1.50,
+	"l40s":      1.25,
+	"a100-40gb": 2.50,
+	"a100-80gb": 3.50,
+}
+
+// volumeMonthlyUsdPerGb is the approximate monthly price in USD of a GB of volume storage.
+const volumeMonthlyUsdPerGb = 0.15
+
+// CostDisclaimer qualifies every cost estimate.
+const CostDisclaimer = "Estimate based on fly's list prices for a machine running all month, excluding " +
+	"bandwidth, IP addresses, regional price differences and discounts. Stopped machines are billed less."
+
+// CostEstimate is the approximate monthly cost of a target in USD.
+type CostEstimate struct {
+	MachineUsd float64
+	GpuUsd     float64
+	VolumeUsd  float64
+	TotalUsd   float64
+}
+
+// String returns the estimate with a breakdown and the disclaimer.
+func (e CostEstimate) String() string {
+	breakdown := fmt.Sprintf("machine $%.2f", e.MachineUsd)
+	if e.GpuUsd > 0 {
+		breakdown += fmt.Sprintf(", GPU $%.2f", e.GpuUsd)
+	}
+	if e.VolumeUsd > 0 {
+		breakdown += fmt.Sprintf(", volume $%.2f", e.VolumeUsd)
+	}
+	return fmt.Sprintf("Estimated cost: $%.2f/month (%s). %s", e.TotalUsd, breakdown, CostDisclaimer)
+}
+
+// EstimateCost returns the approximate monthly cost of a target created with the options,
+// priced from the machine size, its GPU and the size of the data volume.
+func EstimateCost(opts *types.TargetOptions) (CostEstimate, error) {
+	size := opts.MachineSize()
+	machineUsd, ok := machineMonthlyUsd[size]
+	if !ok {
+		return CostEstimate{}, fmt.Errorf("no price known for size %s", size)
+	}
+
+	estimate := CostEstimate{
+		MachineUsd: machineUsd,
+		GpuUsd:     gpuHourlyUsd[size] * hoursPerMonth,
+	}
+	if !opts.NoPersistentDisk {
+		estimate.VolumeUsd = float64(opts.DiskSize) * volumeMonthlyUsdPerGb
+	}
+	estimate.TotalUsd = estimate.MachineUsd + estimate.GpuUsd + estimate.VolumeUsd
+
+	return estimate, nil
+}
@@ -0,0 +1,59 @@
+package util
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/daytonaio/daytona-provider-fly/pkg/types"
+)
+
+func TestEstimateCost(t *testing.T) {
+	cases := []struct {
+		name             string
+		opts             types.TargetOptions
+		expectedTotalUsd float64
+	}{
+		{"Default size and disk", types.TargetOptions{Size: "shared-cpu-4x", DiskSize: 10}, 9.28},
+		{"Performance kind", types.TargetOptions{Size: "shared-cpu-2x", CpuKind: types.CpuKindPerformance, DiskSize: 20}, 65.00},
+		{"No persistent disk", types.TargetOptions{Size: "performance-1x", DiskSize: 10, NoPersistentDisk: true}, 31.00},
+		{"GPU", types.TargetOptions{Size: "a100-40gb", DiskSize: 100}, 2168.00},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			estimate, err := EstimateCost(&testCase.opts)
+			if err != nil {
+				t.Fatalf("Expected an estimate but got error: %s", err)
+			}
+			if math.Abs(estimate.TotalUsd-testCase.expectedTotalUsd) > 0.001 {
+				t.Errorf("Expected $%.2f/month but got $%.2f", testCase.expectedTotalUsd, estimate.TotalUsd)
+			}
+			if !strings.Contains(estimate.String(), CostDisclaimer) {
+				t.Errorf("Expected the disclaimer in %q", estimate.String())
+			}
+		})
+	}
+
+	if _, err := EstimateCost(&types.TargetOptions{Size: "unknown-size"}); err == nil {
+		t.Errorf("Expected an error for an unknown size")
+	}
+}
+
+func TestGpuMachineBasePrice(t *testing.T) {
+	// A GPU machine is a performance-8x machine with 16GB of memory on top of the included 16GB
+	expected := machineMonthlyUsd["performance-8x"] + 16*memoryMonthlyUsdPerGb
+	if expected != 328.00 {
+		t.Errorf("Expected the GPU machine base price to be $328.00/month but got $%.2f", expected)
+	}
+
+	for size := range gpuHourlyUsd {
+		estimate, err := EstimateCost(&types.TargetOptions{Size: size, DiskSize: 10})
+		if err != nil {
+			t.Fatalf("Expected an estimate for %s but got error: %s", size, err)
+		}
+		if estimate.MachineUsd != expected {
+			t.Errorf("Expected the %s machine to cost $%.2f/month without the GPU but got $%.2f", size, expected, estimate.MachineUsd)
+		}
+	}
+}
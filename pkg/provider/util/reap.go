@@ -0,0 +1,143 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/daytonaio/daytona-provider-fly/pkg/types"
+	log "github.com/sirupsen/logrus"
+	"github.com/superfly/fly-go"
+	"golang.org/x/sync/errgroup"
+)
+
+// ExpiresAtMetadataKey is the machine metadata key holding the RFC3339 expiry time of targets created with a TTL.
+const ExpiresAtMetadataKey = "daytona_expires_at"
+
+// deleteAllAppsParallelism is the maximum number of apps DeleteAllDaytonaApps deletes at once.
+const deleteAllAppsParallelism = 4
+
+// AppDeleteResult is the outcome of deleting a single app. Err is nil if the app was deleted.
+type AppDeleteResult struct {
+	AppName string
+	Err     error
+}
+
+// ReapExpired destroys the daytona apps of the organization whose machines have passed their expiry time.
+// Only apps named with the name prefix are considered, the default prefix is used if it is empty.
+// It returns the names of the destroyed apps.
+func ReapExpired(orgSlug, token, namePrefix string) ([]string, error) {
+	opts := &types.TargetOptions{OrgSlug: orgSlug, AuthToken: token, NamePrefix: namePrefix}
+	appNames, err := listDaytonaApps(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	reaped := []string{}
+	now := time.Now()
+	for _, appName := range appNames {
+		flapsClient, err := createFlapsClient(appName, opts)
+		if err != nil {
+			return reaped, err
+		}
+
+		machines, err := flapsClient.List(context.Background(), "")
+		if err != nil {
+			return reaped, fmt.Errorf("failed to list machines of app %s: %w", appName, err)
+		}
+
+		if !isExpired(machines, now) {
+			continue
+		}
+
+		log.Infof("Destroying expired app %s", appName)
+		err = deleteApp(appName, opts)
+		if err != nil {
+			return reaped, fmt.Errorf("failed to destroy expired app %s: %w", appName, err)
+		}
+		reaped = append(reaped, appName)
+	}
+
+	return reaped, nil
+}
+
+// DeleteAllDaytonaApps deletes every daytona app of the organization named with the name prefix, a few at a time.
+// The default prefix is used if it is empty. A failure to delete one app does not stop the others; the outcome of each app is returned
+// in the order the apps were listed. The error is only set if the apps could not be listed.
+func DeleteAllDaytonaApps(orgSlug, token, namePrefix string) ([]AppDeleteResult, error) {
+	opts := &types.TargetOptions{OrgSlug: orgSlug, AuthToken: token, NamePrefix: namePrefix}
+	appNames, err := listDaytonaApps(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]AppDeleteResult, len(appNames))
+	group := errgroup.Group{}
+	group.SetLimit(deleteAllAppsParallelism)
+	for i, appName := range appNames {
+		group.Go(func() error {
+			log.Infof("Destroying app %s", appName)
+			results[i] = AppDeleteResult{AppName: appName, Err: deleteApp(appName, opts)}
+			return nil
+		})
+	}
+	_ = group.Wait()
+
+	return results, nil
+}
+
+// listDaytonaApps returns the names of the daytona apps of the organization, the apps named with the name prefix
+// of the options.
+func listDaytonaApps(opts *types.TargetOptions) ([]string, error) {
+	client, err := createFlyClient("", opts)
+	if err != nil {
+		return nil, err
+	}
+
+	org, err := client.GetOrganizationBySlug(context.Background(), opts.OrgSlug)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get organization %s: %w", opts.OrgSlug, err)
+	}
+
+	apps, err := client.GetAppsForOrganization(context.Background(), org.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list apps of organization %s: %w", opts.OrgSlug, err)
+	}
+
+	appNames := []string{}
+	for _, app := range apps {
+		if strings.HasPrefix(app.Name, namePrefix(opts)) {
+			appNames = append(appNames, app.Name)
+		}
+	}
+
+	return appNames, nil
+}
+
+// isExpired reports whether any of the machines has an expiry time before now.
+// Machines without or with an unparsable expiry are never considered expired.
+func isExpired(machines []*fly.Machine, now time.Time) bool {
+	for _, machine := range machines {
+		if machine.Config == nil {
+			continue
+		}
+
+		expiresAt, ok := machine.Config.Metadata[ExpiresAtMetadataKey]
+		if !ok {
+			continue
+		}
+
+		expiry, err := time.Parse(time.RFC3339, expiresAt)
+		if err != nil {
+			log.Warnf("Ignoring invalid expiry %q of machine %s", expiresAt, machine.ID)
+			continue
+		}
+
+		if expiry.Before(now) {
+			return true
+		}
+	}
+
+	return false
+}
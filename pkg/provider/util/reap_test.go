@@ -0,0 +1,144 @@
+package util
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/superfly/fly-go"
+)
+
+func TestIsExpired(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	machineWithMetadata := func(metadata map[string]string) *fly.Machine {
+		return &fly.Machine{ID: "m1", Config: &fly.MachineConfig{Metadata: metadata}}
+	}
+
+	cases := []struct {
+		name     string
+		machines []*fly.Machine
+		expected bool
+	}{
+		{"No machines", nil, false},
+		{"No expiry", []*fly.Machine{machineWithMetadata(map[string]string{})}, false},
+		{"Expiry passed", []*fly.Machine{machineWithMetadata(map[string]string{ExpiresAtMetadataKey: "2024-06-01T11:00:00Z"})}, true},
+		{"Expiry in the future", []*fly.Machine{machineWithMetadata(map[string]string{ExpiresAtMetadataKey: "2024-06-01T13:00:00Z"})}, false},
+		{"Invalid expiry", []*fly.Machine{machineWithMetadata(map[string]string{ExpiresAtMetadataKey: "tomorrow"})}, false},
+		{"Machine without config", []*fly.Machine{{ID: "m1"}}, false},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if expired := isExpired(testCase.machines, now); expired != testCase.expected {
+				t.Errorf("Expected expired %t but got %t", testCase.expected, expired)
+			}
+		})
+	}
+}
+
+func TestGetLaunchInputTTL(t *testing.T) {
+	opts := *testTargetOptions
+	opts.TTL = "2h"
+
+	before := time.Now()
+	launchInput := getLaunchInput(testTarget, &opts, "", &fly.Volume{ID: "vol_1"})
+
+	expiry, err := time.Parse(time.RFC3339, launchInput.Config.Metadata[ExpiresAtMetadataKey])
+	if err != nil {
+		t.Fatalf("Expected an RFC3339 expiry in the machine metadata but got error: %s", err)
+	}
+	if expiry.Before(before.Add(2*time.Hour).Truncate(time.Second)) || expiry.After(time.Now().Add(2*time.Hour)) {
+		t.Errorf("Expected expiry about 2h from now but got %s", expiry)
+	}
+
+	launchInput = getLaunchInput(testTarget, testTargetOptions, "", &fly.Volume{ID: "vol_1"})
+	if _, ok := launchInput.Config.Metadata[ExpiresAtMetadataKey]; ok {
+		t.Errorf("Expected no expiry without a TTL")
+	}
+}
+
+func TestDeleteAllDaytonaApps(t *testing.T) {
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeOrgApps(w, r, "daytona-a", "other-app", "daytona-b", "daytona-c", "team-a")
+	}))
+	t.Cleanup(apiServer.Close)
+
+	defaultApiBaseUrl := flyApiBaseUrl
+	flyApiBaseUrl = apiServer.URL
+	t.Cleanup(func() {
+		flyApiBaseUrl = defaultApiBaseUrl
+		fly.SetBaseURL(defaultApiBaseUrl)
+	})
+
+	server := newMockFlapsServer(t)
+	var mu sync.Mutex
+	deleted := []string{}
+	server.mux.HandleFunc("DELETE /v1/apps/{app}", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("app") == "daytona-b" {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal error"})
+			return
+		}
+		mu.Lock()
+		deleted = append(deleted, r.PathValue("app"))
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	results, err := DeleteAllDaytonaApps("org", "token", "")
+	if err != nil {
+		t.Fatalf("Expected apps to be listed but got error: %s", err)
+	}
+
+	if len(results) != 3 {
+		t.Fatalf("Expected a result for each daytona app but got %v", results)
+	}
+	for i, expected := range []string{"daytona-a", "daytona-b", "daytona-c"} {
+		result := results[i]
+		if result.AppName != expected {
+			t.Errorf("Expected result %d for app %s but got %s", i, expected, result.AppName)
+		}
+		if failed := result.Err != nil; failed != (expected == "daytona-b") {
+			t.Errorf("Unexpected result for app %s: %v", result.AppName, result.Err)
+		}
+	}
+	if len(deleted) != 2 {
+		t.Errorf("Expected two apps to be deleted but got %v", deleted)
+	}
+
+	results, err = DeleteAllDaytonaApps("org", "token", "team-")
+	if err != nil {
+		t.Fatalf("Expected apps to be listed but got error: %s", err)
+	}
+	if len(results) != 1 || results[0].AppName != "team-a" || results[0].Err != nil {
+		t.Errorf("Expected only the app with the name prefix to be deleted but got %v", results)
+	}
+}
+
+// writeOrgApps answers the fly GraphQL queries listing the apps of the organization with the app names.
+func writeOrgApps(w http.ResponseWriter, r *http.Request, appNames ...string) {
+	var body struct {
+		Query string `json:"query"`
+	}
+	_ = json.NewDecoder(r.Body).Decode(&body)
+	if strings.Contains(body.Query, "organization(slug") {
+		writeJSON(w, http.StatusOK, map[string]any{
+			"data": map[string]any{"organization": map[string]string{"id": "org_1", "slug": "org"}},
+		})
+		return
+	}
+
+	nodes := []map[string]string{}
+	for _, appName := range appNames {
+		nodes = append(nodes, map[string]string{"name": appName})
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"data": map[string]any{"apps": map[string]any{
+			"pageInfo": map[string]any{"hasNextPage": false},
+			"nodes":    nodes,
+		}},
+	})
+}
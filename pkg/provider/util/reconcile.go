@@ -0,0 +1,164 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/daytonaio/daytona-provider-fly/pkg/types"
+	"github.com/daytonaio/daytona/pkg/models"
+	log "github.com/sirupsen/logrus"
+	"github.com/superfly/fly-go"
+)
+
+// ReconcileTarget brings the machine of the target back to the state described by the options after it was
+// changed outside of Daytona. A resized machine is set back to the configured size, or the size set with
+// UpdateMachineSize, a detached data volume is
+// mounted again, a changed restart policy is reset to the fly default and a stopped machine is started.
+// It returns the changes applied, each of which is also logged. A machine in another region can't be moved
+// and is only reported.
+func ReconcileTarget(target *models.Target, opts *types.TargetOptions) ([]string, error) {
+	appName := getAppName(target.Id, opts)
+	flapsClient, err := createFlapsClient(appName, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	machine, err := findMachine(flapsClient, getResourceName(target.Id, opts))
+	if err != nil {
+		return nil, err
+	}
+
+	regions := append([]string{opts.Region}, opts.RegionFallback...)
+	if opts.Region != "" && !slices.Contains(regions, machine.Region) {
+		log.Warnf("Machine %s runs in region %s instead of %s and can only be moved by recreating the target", machine.ID, machine.Region, opts.Region)
+	}
+
+	config, changes, err := getReconciledConfig(flapsClient, target, opts, machine)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(changes) > 0 {
+		for _, change := range changes {
+			log.Infof("Reconciling machine %s: %s", machine.ID, change)
+		}
+
+		machine, err = updateMachineConfig(flapsClient, machine, config, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if machine.State != fly.MachineStateStarted {
+		change := fmt.Sprintf("start machine in state %s", machine.State)
+		log.Infof("Reconciling machine %s: %s", machine.ID, change)
+		changes = append(changes, change)
+
+		err = StartTarget(target, opts)
+		if err != nil {
+			return changes, err
+		}
+	}
+
+	return changes, nil
+}
+
+// getReconciledConfig returns a copy of the machine config with the drifted settings set back to the
+// options, and a description of each change.
+func getReconciledConfig(flapsClient flapsAPI, target *models.Target, opts *types.TargetOptions, machine *fly.Machine) (*fly.MachineConfig, []string, error) {
+	config := *machine.Config
+	var changes []string
+
+	// An explicit resize takes precedence over the size of the options
+	size := opts.MachineSize()
+	if resized := config.Metadata[MachineSizeMetadataKey]; resized != "" {
+		size = resized
+	}
+	desiredGuest := &fly.MachineGuest{}
+	err := desiredGuest.SetSize(size)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !guestMatches(config.Guest, desiredGuest) {
+		changes = append(changes, fmt.Sprintf("resize from %s to %s", describeGuest(config.Guest), size))
+		config.Guest = desiredGuest
+		config.VMSize = size
+	}
+
+	if !opts.NoPersistentDisk && len(config.Mounts) == 0 {
+		volumeName := getVolumeName(target.Id, opts)
+		var volume *fly.Volume
+		if opts.VolumeId != "" {
+			volumeName = opts.VolumeId
+			volume, err = flapsClient.GetVolume(context.Background(), opts.VolumeId)
+		} else {
+			volume, err = findVolume(flapsClient, volumeName)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if volume == nil {
+			log.Warnf("Data volume %s of machine %s not found, it can't be mounted again", volumeName, machine.ID)
+		} else {
+			changes = append(changes, fmt.Sprintf("mount volume %s at %s", volume.ID, dockerDataPath(opts)))
+			config.Mounts = []fly.MachineMount{
+				{
+					Name:                   volume.Name,
+					Volume:                 volume.ID,
+					Path:                   dockerDataPath(opts),
+					SizeGb:                 volume.SizeGb,
+					ExtendThresholdPercent: opts.AutoExtendThreshold,
+					SizeGbLimit:            opts.AutoExtendSizeLimitGb,
+				},
+			}
+		}
+	}
+
+	// Targets are launched with fly's default restart policy
+	if config.Restart != nil && config.Restart.Policy != "" && config.Restart.Policy != fly.MachineRestartPolicyOnFailure {
+		changes = append(changes, fmt.Sprintf("reset restart policy %s to %s", config.Restart.Policy, fly.MachineRestartPolicyOnFailure))
+		config.Restart = nil
+	}
+
+	return &config, changes, nil
+}
+
+// guestMatches reports whether the machine runs with the resources of the desired guest.
+func guestMatches(guest, desired *fly.MachineGuest) bool {
+	return guest != nil && guest.CPUKind == desired.CPUKind && guest.CPUs == desired.CPUs &&
+		guest.MemoryMB == desired.MemoryMB && guest.GPUKind == desired.GPUKind && guest.GPUs == desired.GPUs
+}
+
+// describeGuest returns a short description of the resources of the guest for logging.
+func describeGuest(guest *fly.MachineGuest) string {
+	if guest == nil {
+		return "no guest"
+	}
+	return fmt.Sprintf("%d %s cpus with %dMB", guest.CPUs, guest.CPUKind, guest.MemoryMB)
+}
+
+// updateMachineConfig updates the machine to the config and returns the updated machine. The config checksum
+// is refreshed, so the machine is no longer reported as drifted. Fly restarts the machine to apply the config,
+// unless skipLaunch is set and the machine is left stopped.
+func updateMachineConfig(flapsClient flapsAPI, machine *fly.Machine, config *fly.MachineConfig, skipLaunch bool) (*fly.Machine, error) {
+	config.Metadata = maps.Clone(config.Metadata)
+	if config.Metadata == nil {
+		config.Metadata = map[string]string{}
+	}
+	config.Metadata[ConfigChecksumMetadataKey] = ConfigChecksum(config)
+
+	updated, err := flapsClient.Update(context.Background(), fly.LaunchMachineInput{
+		ID:         machine.ID,
+		Name:       machine.Name,
+		Region:     machine.Region,
+		Config:     config,
+		SkipLaunch: skipLaunch,
+	}, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return updated, nil
+}
@@ -0,0 +1,130 @@
+package util
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/superfly/fly-go"
+)
+
+func TestReconcileTarget(t *testing.T) {
+	volumeName := getVolumeName(testTarget.Id, testTargetOptions)
+
+	cases := []struct {
+		name            string
+		state           string
+		size            string
+		resizedTo       string
+		expectedStarts  int
+		expectedUpdates int
+	}{
+		{
+			name:            "Stopped machine is started",
+			state:           fly.MachineStateStopped,
+			size:            testTargetOptions.Size,
+			expectedStarts:  1,
+			expectedUpdates: 0,
+		},
+		{
+			name:            "Resized machine is updated",
+			state:           fly.MachineStateStarted,
+			size:            "shared-cpu-1x",
+			expectedStarts:  0,
+			expectedUpdates: 1,
+		},
+		{
+			name:            "Machine resized with UpdateMachineSize is left alone",
+			state:           fly.MachineStateStarted,
+			size:            "performance-2x",
+			resizedTo:       "performance-2x",
+			expectedStarts:  0,
+			expectedUpdates: 0,
+		},
+		{
+			name:            "Machine drifted from UpdateMachineSize is resized back",
+			state:           fly.MachineStateStarted,
+			size:            "shared-cpu-1x",
+			resizedTo:       "performance-2x",
+			expectedStarts:  0,
+			expectedUpdates: 1,
+		},
+		{
+			name:            "Machine in sync is left alone",
+			state:           fly.MachineStateStarted,
+			size:            testTargetOptions.Size,
+			expectedStarts:  0,
+			expectedUpdates: 0,
+		},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			machine := &fly.Machine{
+				ID:     "m1",
+				Name:   getResourceName(testTarget.Id, testTargetOptions),
+				Region: testTargetOptions.Region,
+				State:  testCase.state,
+				Config: &fly.MachineConfig{
+					Guest:  fly.MachinePresets[testCase.size],
+					Mounts: []fly.MachineMount{{Name: volumeName, Volume: "vol_1", Path: dockerDataPath(testTargetOptions)}},
+				},
+			}
+			if testCase.resizedTo != "" {
+				machine.Config.Metadata = map[string]string{MachineSizeMetadataKey: testCase.resizedTo}
+			}
+			server := newMockFlapsServer(t, machine)
+
+			starts := 0
+			server.handle("POST /v1/apps/{app}/machines/{id}/start", func(w http.ResponseWriter, r *http.Request) {
+				starts++
+				machine.State = fly.MachineStateStarted
+				writeJSON(w, http.StatusOK, map[string]any{})
+			})
+			server.handle("GET /v1/apps/{app}/machines/{id}/wait", func(w http.ResponseWriter, r *http.Request) {
+				if machine.State != r.URL.Query().Get("state") {
+					writeJSON(w, http.StatusRequestTimeout, map[string]string{"error": "deadline_exceeded"})
+					return
+				}
+				writeJSON(w, http.StatusOK, map[string]any{})
+			})
+
+			var updated fly.LaunchMachineInput
+			updates := 0
+			server.handle("POST /v1/apps/{app}/machines/{id}", func(w http.ResponseWriter, r *http.Request) {
+				updates++
+				_ = json.NewDecoder(r.Body).Decode(&updated)
+				machine.Config = updated.Config
+				writeJSON(w, http.StatusOK, machine)
+			})
+
+			changes, err := ReconcileTarget(testTarget, testTargetOptions)
+			if err != nil {
+				t.Fatalf("Expected the target to be reconciled but got error: %s", err)
+			}
+
+			if starts != testCase.expectedStarts {
+				t.Errorf("Expected %d starts but got %d", testCase.expectedStarts, starts)
+			}
+			if updates != testCase.expectedUpdates {
+				t.Errorf("Expected %d updates but got %d", testCase.expectedUpdates, updates)
+			}
+			if len(changes) != testCase.expectedStarts+testCase.expectedUpdates {
+				t.Errorf("Expected %d changes but got %v", testCase.expectedStarts+testCase.expectedUpdates, changes)
+			}
+
+			if updates > 0 {
+				expectedSize := testTargetOptions.Size
+				if testCase.resizedTo != "" {
+					expectedSize = testCase.resizedTo
+				}
+				if !guestMatches(updated.Config.Guest, fly.MachinePresets[expectedSize]) {
+					t.Errorf("Expected the machine to be resized to %s but got %+v", expectedSize, updated.Config.Guest)
+				}
+				if updated.Config.Metadata[ConfigChecksumMetadataKey] != ConfigChecksum(updated.Config) {
+					t.Errorf("Expected the config checksum to be refreshed")
+				}
+			}
+		})
+	}
+}
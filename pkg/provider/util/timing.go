@@ -0,0 +1,149 @@
+package util
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Phase names recorded while creating a target.
+const (
+	PhaseAppCreate          = "app_create"
+	PhaseVolumeCreate       = "volume_create"
+	PhaseMachineLaunch      = "machine_launch"
+	PhaseMachineStart       = "machine_start"
+	PhaseWaitForDial        = "wait_for_dial"
+	PhaseDockerTargetCreate = "docker_target_create"
+)
+
+// PhaseImagePull is the time fly took from launching the machine to starting it, which is mostly spent
+// pulling the machine image. It is measured from the machine events and recorded with Record.
+const PhaseImagePull = "image_pull"
+
+// Phase names recorded while creating a workspace. They are reported to the progress func only,
+// without progress markers.
+const (
+	PhaseDockerConnect      = "docker_connect"
+	PhaseWorkspaceCreate    = "workspace_create"
+	PhaseWorkspaceResources = "workspace_resources"
+)
+
+// ProgressFunc is called with the name and duration of each phase of an operation when it completes.
+type ProgressFunc func(phase string, elapsed time.Duration)
+
+// phaseLabels are the progress markers logged for each phase, in the order the phases run.
+var phaseLabels = []struct {
+	phase string
+	label string
+}{
+	{PhaseAppCreate, "Creating app"},
+	{PhaseVolumeCreate, "Provisioning volume"},
+	{PhaseMachineLaunch, "Launching machine"},
+	{PhaseMachineStart, "Starting machine"},
+	{PhaseWaitForDial, "Waiting for agent"},
+	{PhaseDockerTargetCreate, "Configuring workspace dir"},
+}
+
+// PhaseTiming is the duration of a single phase of an operation.
+type PhaseTiming struct {
+	Phase    string
+	Duration time.Duration
+}
+
+// PhaseTimings records the duration of the phases of an operation in the order they finished.
+// All methods are no-ops on a nil *PhaseTimings, so callers without a logger pay nothing.
+type PhaseTimings struct {
+	mu           sync.Mutex
+	phases       []PhaseTiming
+	progress     io.Writer
+	progressFunc ProgressFunc
+}
+
+// NewPhaseTimings creates phase timings that log a progress marker to the writer when each
+// phase starts and completes. The writer may be nil to only record the durations.
+func NewPhaseTimings(progress io.Writer) *PhaseTimings {
+	return &PhaseTimings{progress: progress}
+}
+
+// SetProgressFunc sets the func called when each phase completes. It may be nil to call none.
+func (t *PhaseTimings) SetProgressFunc(progressFunc ProgressFunc) {
+	if t == nil {
+		return
+	}
+	t.progressFunc = progressFunc
+}
+
+// Track starts timing the phase and returns a function that records its duration when called.
+func (t *PhaseTimings) Track(phase string) func() {
+	if t == nil {
+		return func() {}
+	}
+
+	marker := phaseMarker(phase)
+	t.logProgress(marker + "...\n")
+
+	start := time.Now()
+	return func() {
+		duration := time.Since(start)
+		t.record(phase, duration)
+		t.logProgress(fmt.Sprintf("%s done in %s\n", marker, duration.Round(time.Millisecond)))
+	}
+}
+
+// Record records the duration of a phase that was measured elsewhere, e.g. by fly.
+func (t *PhaseTimings) Record(phase string, duration time.Duration) {
+	if t == nil {
+		return
+	}
+
+	t.record(phase, duration)
+	t.logProgress(fmt.Sprintf("%s took %s\n", phaseMarker(phase), duration.Round(time.Millisecond)))
+}
+
+func (t *PhaseTimings) record(phase string, duration time.Duration) {
+	t.mu.Lock()
+	t.phases = append(t.phases, PhaseTiming{Phase: phase, Duration: duration})
+	t.mu.Unlock()
+
+	if t.progressFunc != nil {
+		t.progressFunc(phase, duration)
+	}
+}
+
+func (t *PhaseTimings) logProgress(message string) {
+	if t.progress != nil {
+		t.progress.Write([]byte(message))
+	}
+}
+
+// phaseMarker returns the progress marker of the phase, e.g. "[2/6] Provisioning volume".
+func phaseMarker(phase string) string {
+	for i, phaseLabel := range phaseLabels {
+		if phaseLabel.phase == phase {
+			return fmt.Sprintf("[%d/%d] %s", i+1, len(phaseLabels), phaseLabel.label)
+		}
+	}
+	return phase
+}
+
+// Phases returns a copy of the recorded phase timings.
+func (t *PhaseTimings) Phases() []PhaseTiming {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]PhaseTiming(nil), t.phases...)
+}
+
+// String formats the recorded phases as space separated phase=duration fields.
+func (t *PhaseTimings) String() string {
+	fields := []string{}
+	for _, phase := range t.Phases() {
+		fields = append(fields, fmt.Sprintf("%s=%s", phase.Phase, phase.Duration.Round(time.Millisecond)))
+	}
+	return strings.Join(fields, " ")
+}
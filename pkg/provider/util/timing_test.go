@@ -0,0 +1,101 @@
+package util
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPhaseTimings(t *testing.T) {
+	timings := NewPhaseTimings(nil)
+
+	timings.Track(PhaseAppCreate)()
+	timings.Track(PhaseVolumeCreate)()
+
+	phases := timings.Phases()
+	if len(phases) != 2 {
+		t.Fatalf("Expected 2 recorded phases but got %d", len(phases))
+	}
+	if phases[0].Phase != PhaseAppCreate || phases[1].Phase != PhaseVolumeCreate {
+		t.Errorf("Expected phases in finish order but got %v", phases)
+	}
+
+	if !regexp.MustCompile(`^app_create=\S+ volume_create=\S+$`).MatchString(timings.String()) {
+		t.Errorf("Unexpected timings summary %q", timings.String())
+	}
+}
+
+func TestPhaseTimingsNil(t *testing.T) {
+	var timings *PhaseTimings
+
+	timings.Track(PhaseAppCreate)()
+
+	if phases := timings.Phases(); phases != nil {
+		t.Errorf("Expected no phases on nil timings but got %v", phases)
+	}
+	if summary := timings.String(); summary != "" {
+		t.Errorf("Expected empty summary on nil timings but got %q", summary)
+	}
+}
+
+func TestPhaseTimingsProgress(t *testing.T) {
+	var progress strings.Builder
+	timings := NewPhaseTimings(&progress)
+
+	timings.Track(PhaseVolumeCreate)()
+
+	lines := strings.Split(strings.TrimSpace(progress.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected a start and a completion marker but got %q", progress.String())
+	}
+	if lines[0] != "[2/6] Provisioning volume..." {
+		t.Errorf("Unexpected start marker %q", lines[0])
+	}
+	if !regexp.MustCompile(`^\[2/6\] Provisioning volume done in \S+$`).MatchString(lines[1]) {
+		t.Errorf("Unexpected completion marker %q", lines[1])
+	}
+}
+
+func TestPhaseTimingsProgressFunc(t *testing.T) {
+	timings := NewPhaseTimings(nil)
+
+	var phases []string
+	timings.SetProgressFunc(func(phase string, elapsed time.Duration) {
+		phases = append(phases, phase)
+	})
+
+	timings.Track(PhaseDockerConnect)()
+	timings.Track(PhaseWorkspaceCreate)()
+
+	if expected := []string{PhaseDockerConnect, PhaseWorkspaceCreate}; !slices.Equal(phases, expected) {
+		t.Errorf("Expected phases %v but got %v", expected, phases)
+	}
+}
+
+func TestPhaseTimingsRecord(t *testing.T) {
+	var progress strings.Builder
+	timings := NewPhaseTimings(&progress)
+
+	var recorded []PhaseTiming
+	timings.SetProgressFunc(func(phase string, elapsed time.Duration) {
+		recorded = append(recorded, PhaseTiming{Phase: phase, Duration: elapsed})
+	})
+
+	timings.Record(PhaseImagePull, 1500*time.Millisecond)
+
+	expected := []PhaseTiming{{Phase: PhaseImagePull, Duration: 1500 * time.Millisecond}}
+	if phases := timings.Phases(); !slices.Equal(phases, expected) {
+		t.Errorf("Expected recorded phases %v but got %v", expected, phases)
+	}
+	if !slices.Equal(recorded, expected) {
+		t.Errorf("Expected the progress func to be called with %v but got %v", expected, recorded)
+	}
+	if progress.String() != "image_pull took 1.5s\n" {
+		t.Errorf("Unexpected progress %q", progress.String())
+	}
+
+	var nilTimings *PhaseTimings
+	nilTimings.Record(PhaseImagePull, time.Second)
+}
@@ -0,0 +1,40 @@
+package provider
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const readyWebhookTimeout = 10 * time.Second
+
+// readyWebhookPayload is the body posted to the ready webhook once a target's machine can be dialed.
+type readyWebhookPayload struct {
+	TargetId      string `json:"targetId"`
+	MachineId     string `json:"machineId"`
+	Region        string `json:"region"`
+	CorrelationId string `json:"correlationId"`
+}
+
+// notifyReadyWebhook posts the payload to the webhook url and fails on non-2xx responses.
+func notifyReadyWebhook(url string, payload readyWebhookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: readyWebhookTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("ready webhook returned status %d", resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,52 @@
+package provider
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNotifyReadyWebhook(t *testing.T) {
+	var received readyWebhookPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(server.Close)
+
+	payload := readyWebhookPayload{
+		TargetId:      "123",
+		MachineId:     "machine_1",
+		Region:        "lax",
+		CorrelationId: "c0ffee",
+	}
+
+	err := notifyReadyWebhook(server.URL, payload)
+	if err != nil {
+		t.Fatalf("Expected webhook to be notified but got error: %s", err)
+	}
+
+	if received != payload {
+		t.Errorf("Expected payload %+v but got %+v", payload, received)
+	}
+}
+
+func TestNotifyReadyWebhookFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(server.Close)
+
+	err := notifyReadyWebhook(server.URL, readyWebhookPayload{})
+	if err == nil {
+		t.Errorf("Expected error for failing webhook but got none")
+	}
+}
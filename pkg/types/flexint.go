@@ -0,0 +1,34 @@
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// FlexInt is an integer that can be unmarshaled from a JSON number or a string containing
+// a number, as sent for manifest default values.
+type FlexInt int
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (i *FlexInt) UnmarshalJSON(data []byte) error {
+	var value int
+	if err := json.Unmarshal(data, &value); err == nil {
+		*i = FlexInt(value)
+		return nil
+	}
+
+	var raw string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("expected a JSON number or a string containing a number: %w", err)
+	}
+
+	value, err := strconv.Atoi(strings.TrimSpace(raw))
+	if err != nil {
+		return fmt.Errorf("expected a string containing a number: %w", err)
+	}
+
+	*i = FlexInt(value)
+	return nil
+}
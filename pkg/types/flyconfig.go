@@ -0,0 +1,50 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// flyConfig is the subset of the fly CLI config file used by the provider.
+type flyConfig struct {
+	AccessToken string `yaml:"access_token"`
+}
+
+// flyConfigPath returns the standard location of the fly CLI config file.
+func flyConfigPath() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(homeDir, ".fly", "config.yml"), nil
+}
+
+// readFlyConfigToken reads the access token from the fly CLI config file.
+func readFlyConfigToken() (string, error) {
+	path, err := flyConfigPath()
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve fly config path: %w", err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read fly config: %w", err)
+	}
+
+	var config flyConfig
+	err = yaml.Unmarshal(content, &config)
+	if err != nil {
+		return "", fmt.Errorf("invalid fly config %s: %w", path, err)
+	}
+
+	if config.AccessToken == "" {
+		return "", errors.New("no access token found in fly config " + path)
+	}
+
+	return config.AccessToken, nil
+}
@@ -0,0 +1,70 @@
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// KeyValueMap is a map of string keys to string values that can be unmarshaled from a JSON object,
+// a string containing a JSON object or a string containing a comma or newline separated KEY=VALUE list.
+type KeyValueMap map[string]string
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (m *KeyValueMap) UnmarshalJSON(data []byte) error {
+	var values map[string]string
+	if err := json.Unmarshal(data, &values); err == nil {
+		*m = values
+		return nil
+	}
+
+	var raw string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("expected a JSON object or a KEY=VALUE list: %w", err)
+	}
+
+	values, err := parseKeyValueList(raw)
+	if err != nil {
+		return err
+	}
+
+	*m = values
+	return nil
+}
+
+// parseKeyValueList parses a JSON object or a comma or newline separated KEY=VALUE list.
+func parseKeyValueList(raw string) (map[string]string, error) {
+	values := map[string]string{}
+
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return values, nil
+	}
+
+	if strings.HasPrefix(raw, "{") {
+		if err := json.Unmarshal([]byte(raw), &values); err != nil {
+			return nil, fmt.Errorf("invalid JSON object: %w", err)
+		}
+		return values, nil
+	}
+
+	pairs := strings.FieldsFunc(raw, func(r rune) bool {
+		return r == ',' || r == '\n'
+	})
+	for _, pair := range pairs {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid KEY=VALUE pair %q", pair)
+		}
+
+		values[key] = value
+	}
+
+	return values, nil
+}
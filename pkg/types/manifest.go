@@ -0,0 +1,83 @@
+package types
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/daytonaio/daytona/pkg/models"
+)
+
+// ManifestNegotiator tailors the target config manifest to the version of the connecting Daytona server,
+// so options that an older server can't handle don't break it.
+type ManifestNegotiator interface {
+	// Manifest returns the manifest for the server version. The version is empty if it is not known.
+	Manifest(serverVersion string) *models.TargetConfigManifest
+}
+
+// FullManifest is the default negotiator, returning the full manifest for every server version.
+type FullManifest struct{}
+
+// Manifest implements the ManifestNegotiator interface.
+func (FullManifest) Manifest(serverVersion string) *models.TargetConfigManifest {
+	return GetTargetConfigManifest()
+}
+
+// SuggestionsMinVersion is a negotiator omitting the suggestions of the manifest properties for servers
+// older than the version, e.g. v0.30.0. Servers of an unknown or unparsable version get the full manifest.
+type SuggestionsMinVersion string
+
+// Manifest implements the ManifestNegotiator interface.
+func (v SuggestionsMinVersion) Manifest(serverVersion string) *models.TargetConfigManifest {
+	manifest := GetTargetConfigManifest()
+
+	if !versionOlder(serverVersion, string(v)) {
+		return manifest
+	}
+
+	for name, property := range *manifest {
+		property.Suggestions = nil
+		(*manifest)[name] = property
+	}
+	return manifest
+}
+
+// versionOlder reports whether version is older than minVersion. Versions that are not of the
+// form [v]major.minor.patch, such as development builds, are never older.
+func versionOlder(version, minVersion string) bool {
+	current, ok := parseVersion(version)
+	if !ok {
+		return false
+	}
+	min, ok := parseVersion(minVersion)
+	if !ok {
+		return false
+	}
+
+	for i := range current {
+		if current[i] != min[i] {
+			return current[i] < min[i]
+		}
+	}
+	return false
+}
+
+// parseVersion parses the major, minor and patch numbers of a version, ignoring pre-release suffixes.
+func parseVersion(version string) ([3]int, bool) {
+	var parsed [3]int
+
+	version = strings.TrimPrefix(strings.TrimSpace(version), "v")
+	version, _, _ = strings.Cut(version, "-")
+	parts := strings.Split(version, ".")
+	if len(parts) != 3 {
+		return parsed, false
+	}
+
+	for i, part := range parts {
+		number, err := strconv.Atoi(part)
+		if err != nil {
+			return parsed, false
+		}
+		parsed[i] = number
+	}
+	return parsed, true
+}
@@ -3,6 +3,61 @@ package types
 type TargetMetadata struct {
 	MachineId string
 	VolumeId  string
+	Region    string
+	// Zone is the fly zone of the target volume, empty when fly does not report it.
+	Zone string `json:",omitempty"`
+	// VolumeEncrypted reports whether the target volume is encrypted at rest, nil when the volume is not known.
+	VolumeEncrypted *bool `json:",omitempty"`
+	// HostStatus is the status of the host the machine is placed on, e.g. "ok" or "unreachable".
+	HostStatus string `json:",omitempty"`
+	// PrivateIP is the private IPv6 (6PN) address of the machine, empty until fly has assigned it.
+	PrivateIP string `json:",omitempty"`
 	IsRunning bool
 	Created   string
+	// Image is the image reference the machine runs, including the digest resolved by fly at create time.
+	Image string `json:",omitempty"`
+	// ImageDigest is the digest of the machine image.
+	ImageDigest string `json:",omitempty"`
+	// ConfigChecksum is the checksum of the machine config computed at create time.
+	ConfigChecksum string
+	// ConfigDrift is true when the live machine config no longer matches ConfigChecksum.
+	ConfigDrift bool
+}
+
+// WorkspaceFlyMetadata is the fly placement of a workspace, nested under the fly key of the workspace metadata.
+type WorkspaceFlyMetadata struct {
+	MachineId string
+	AppName   string
+	Region    string
+}
+
+// Target health indicators of TargetHealth.Status.
+const (
+	HealthGreen  = "green"
+	HealthYellow = "yellow"
+	HealthRed    = "red"
+)
+
+// Statuses of a HealthCheck.
+const (
+	HealthCheckOk      = "ok"
+	HealthCheckFailed  = "failed"
+	HealthCheckSkipped = "skipped"
+)
+
+// HealthCheck is the outcome of a single probe of a target's health.
+type HealthCheck struct {
+	Name   string
+	Status string
+	// Error describes why the check failed or was skipped.
+	Error string `json:",omitempty"`
+}
+
+// TargetHealth is the compact health status of a target.
+type TargetHealth struct {
+	// Status is green when all checks pass, red when the machine is not running and yellow otherwise.
+	Status string
+	// MachineState is the fly machine state, empty if the machine could not be fetched.
+	MachineState string `json:",omitempty"`
+	Checks       []HealthCheck
 }
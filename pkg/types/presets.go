@@ -0,0 +1,22 @@
+package types
+
+import "github.com/daytonaio/daytona/pkg/provider"
+
+// GetPresetTargetConfigs returns the preset target configs offered to users as starting templates.
+// Auth Token and Org Slug are left blank for the user to fill in.
+func GetPresetTargetConfigs() []provider.TargetConfig {
+	return []provider.TargetConfig{
+		{
+			Name:    "Small - shared-cpu-1x/10GB/lax",
+			Options: `{"Region":"lax","Size":"shared-cpu-1x","Disk Size":10}`,
+		},
+		{
+			Name:    "Medium - shared-cpu-4x/20GB",
+			Options: `{"Size":"shared-cpu-4x","Disk Size":20}`,
+		},
+		{
+			Name:    "GPU - a100-40gb/50GB/ord",
+			Options: `{"Region":"ord","Size":"a100-40gb","Disk Size":50}`,
+		},
+	}
+}
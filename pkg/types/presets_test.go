@@ -0,0 +1,41 @@
+package types
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestGetPresetTargetConfigs(t *testing.T) {
+	presets := GetPresetTargetConfigs()
+	if len(presets) == 0 {
+		t.Fatalf("Expected preset target configs but got none")
+	}
+
+	for _, preset := range presets {
+		t.Run(preset.Name, func(t *testing.T) {
+			var options map[string]any
+			if err := json.Unmarshal([]byte(preset.Options), &options); err != nil {
+				t.Fatalf("Expected preset options to be valid JSON but got error: %s", err)
+			}
+
+			if _, ok := options["Auth Token"]; ok {
+				t.Errorf("Expected preset to leave the auth token blank")
+			}
+			if _, ok := options["Org Slug"]; ok {
+				t.Errorf("Expected preset to leave the org slug blank")
+			}
+
+			// Fill in the fields left for the user
+			options["Auth Token"] = "token"
+			options["Org Slug"] = "org"
+			optionsJson, err := json.Marshal(options)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := ParseTargetOptions(string(optionsJson)); err != nil {
+				t.Errorf("Expected preset options to parse but got error: %s", err)
+			}
+		})
+	}
+}
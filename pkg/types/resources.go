@@ -0,0 +1,94 @@
+package types
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	fly "github.com/superfly/fly-go"
+)
+
+// Workspace labels overriding the Workspace Cpus and Workspace Memory options for a single workspace.
+const (
+	WorkspaceCpusLabel   = "daytona.fly.cpus"
+	WorkspaceMemoryLabel = "daytona.fly.memory"
+)
+
+// WorkspaceResources are the CPU and memory limits of a workspace container. Zero means unlimited.
+type WorkspaceResources struct {
+	Cpus     int
+	MemoryMb int
+}
+
+// IsLimited reports whether any limit is set.
+func (r WorkspaceResources) IsLimited() bool {
+	return r.Cpus > 0 || r.MemoryMb > 0
+}
+
+// WorkspaceResources returns the resource limits of a workspace container, the Workspace Cpus and
+// Workspace Memory options overridden by the workspace labels.
+func (o *TargetOptions) WorkspaceResources(labels map[string]string) (WorkspaceResources, error) {
+	resources := WorkspaceResources{Cpus: o.WorkspaceCpus, MemoryMb: o.WorkspaceMemory}
+
+	overrides := map[string]*int{
+		WorkspaceCpusLabel:   &resources.Cpus,
+		WorkspaceMemoryLabel: &resources.MemoryMb,
+	}
+	for label, limit := range overrides {
+		raw, ok := labels[label]
+		if !ok {
+			continue
+		}
+		value, err := strconv.Atoi(strings.TrimSpace(raw))
+		if err != nil {
+			return WorkspaceResources{}, fmt.Errorf("invalid %s label %q, must be a number", label, raw)
+		}
+		*limit = value
+	}
+
+	err := checkWorkspaceResources(o.MachineSize(), resources)
+	if err != nil {
+		return WorkspaceResources{}, err
+	}
+
+	return resources, nil
+}
+
+// checkWorkspaceResources checks that the limits are not negative and fit the machine size.
+func checkWorkspaceResources(size string, resources WorkspaceResources) error {
+	if resources.Cpus < 0 || resources.MemoryMb < 0 {
+		return fmt.Errorf("workspace cpus and memory must not be negative")
+	}
+
+	guest, ok := fly.MachinePresets[size]
+	if !ok {
+		return nil
+	}
+
+	if resources.Cpus > guest.CPUs {
+		return fmt.Errorf("workspace cpus (%d) exceed the %d CPUs of size %s", resources.Cpus, guest.CPUs, size)
+	}
+
+	if resources.MemoryMb > guest.MemoryMB {
+		return fmt.Errorf("workspace memory (%dMB) exceeds the %dMB of size %s", resources.MemoryMb, guest.MemoryMB, size)
+	}
+
+	return nil
+}
+
+// maxDiskSizes is the largest volume in GB fly accepts next to the machine sizes that cap it. Volumes of the
+// sizes not listed, including sizes this table doesn't know yet, may be up to MaxDiskSize.
+var maxDiskSizes = map[string]int{
+	"shared-cpu-1x": 100,
+	"shared-cpu-2x": 250,
+}
+
+// checkDiskSize checks that a volume of the disk size can be attached to a machine of the size.
+func checkDiskSize(size string, diskSize int) error {
+	maxDiskSize, ok := maxDiskSizes[size]
+	if !ok || diskSize <= maxDiskSize {
+		return nil
+	}
+
+	return fmt.Errorf("disk size %dGB exceeds the maximum of %dGB for size %s, choose a larger size or a smaller disk", diskSize, maxDiskSize, size)
+}
@@ -0,0 +1,98 @@
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ServiceHandlers are the fly proxy handlers a service port may use.
+var ServiceHandlers = []string{"http", "tls", "pg_tls", "proxy_proto"}
+
+// dockerDaemonPort is the port of the Docker daemon of the machine, which listens without TLS.
+const dockerDaemonPort = 2375
+
+// Service exposes an internal port of the machine on a public port of fly's edge.
+type Service struct {
+	InternalPort int      `json:"internal_port"`
+	Port         int      `json:"port"`
+	Handlers     []string `json:"handlers,omitempty"`
+}
+
+// ServiceList is a list of services that can be unmarshaled from a JSON array or a string containing a
+// comma separated list of INTERNAL:PUBLIC[:HANDLER+HANDLER] mappings, e.g. 8080:443:tls+http,3000:80:http.
+type ServiceList []Service
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (l *ServiceList) UnmarshalJSON(data []byte) error {
+	var services []Service
+	if err := json.Unmarshal(data, &services); err == nil {
+		*l = services
+		return nil
+	}
+
+	var raw string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("expected a JSON array or a comma separated list of services: %w", err)
+	}
+
+	services = []Service{}
+	for _, mapping := range strings.Split(raw, ",") {
+		mapping = strings.TrimSpace(mapping)
+		if mapping == "" {
+			continue
+		}
+
+		service, err := parseService(mapping)
+		if err != nil {
+			return err
+		}
+		services = append(services, service)
+	}
+
+	*l = services
+	return nil
+}
+
+// parseService parses an INTERNAL:PUBLIC[:HANDLER+HANDLER] mapping.
+func parseService(mapping string) (Service, error) {
+	parts := strings.Split(mapping, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return Service{}, fmt.Errorf("invalid service %q, must be INTERNAL:PUBLIC[:HANDLER+HANDLER]", mapping)
+	}
+
+	internalPort, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return Service{}, fmt.Errorf("invalid internal port in service %q", mapping)
+	}
+	port, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return Service{}, fmt.Errorf("invalid public port in service %q", mapping)
+	}
+
+	service := Service{InternalPort: internalPort, Port: port}
+	if len(parts) == 3 {
+		service.Handlers = strings.Split(parts[2], "+")
+	}
+	return service, nil
+}
+
+// validate checks the port ranges and handler names of the service.
+func (s Service) validate() error {
+	if s.InternalPort < 1 || s.InternalPort > 65535 || s.Port < 1 || s.Port > 65535 {
+		return fmt.Errorf("service ports must be between 1 and 65535, got %d:%d", s.InternalPort, s.Port)
+	}
+
+	if s.InternalPort == dockerDaemonPort {
+		return fmt.Errorf("the docker daemon port %d can't be exposed as a service", dockerDaemonPort)
+	}
+
+	for _, handler := range s.Handlers {
+		if !slices.Contains(ServiceHandlers, handler) {
+			return fmt.Errorf("invalid service handler %q, must be one of %v", handler, ServiceHandlers)
+		}
+	}
+	return nil
+}
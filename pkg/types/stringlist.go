@@ -0,0 +1,65 @@
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// StringList is a list of strings that can be unmarshaled from a JSON array or a string
+// containing a comma separated list.
+type StringList []string
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (l *StringList) UnmarshalJSON(data []byte) error {
+	var values []string
+	if err := json.Unmarshal(data, &values); err == nil {
+		*l = values
+		return nil
+	}
+
+	var raw string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("expected a JSON array or a comma separated list: %w", err)
+	}
+
+	values = []string{}
+	for _, value := range strings.Split(raw, ",") {
+		value = strings.TrimSpace(value)
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+
+	*l = values
+	return nil
+}
+
+// CommandList is a list of shell commands that can be unmarshaled from a JSON array or a string
+// containing one command per line. Commands may contain commas, so they are not split on them.
+type CommandList []string
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (l *CommandList) UnmarshalJSON(data []byte) error {
+	var values []string
+	if err := json.Unmarshal(data, &values); err == nil {
+		*l = values
+		return nil
+	}
+
+	var raw string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("expected a JSON array or a newline separated list: %w", err)
+	}
+
+	values = []string{}
+	for _, value := range strings.Split(raw, "\n") {
+		value = strings.TrimSpace(value)
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+
+	*l = values
+	return nil
+}
@@ -3,17 +3,182 @@ package types
 import (
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/daytonaio/daytona/pkg/models"
+	log "github.com/sirupsen/logrus"
 )
 
+// DefaultImage is the machine image used when the Image option is empty.
+const DefaultImage = "docker:dind"
+
+// DefaultDockerDataPath is the mount path of the data volume when the Docker Data Path option is empty.
+const DefaultDockerDataPath = "/var/lib/docker"
+
+// DefaultDiskSize is the disk size in GB used when the Disk Size option is empty.
+const DefaultDiskSize = 10
+
+// MaxDiskSize is the largest fly volume size in GB.
+const MaxDiskSize = 500
+
+// The range of the MTU option. Fly's private network carries IPv6, so the MTU never needs to be lower than
+// the IPv6 minimum, and Docker's default is the upper bound.
+const (
+	MinMTU = 1280
+	MaxMTU = 1500
+)
+
+// DefaultNamePrefix is the prefix of the fly app, machine and volume names when the Name Prefix option is empty.
+const DefaultNamePrefix = "daytona-"
+
+// DefaultAgentUser is the user the daytona agent runs as when the Agent User option is empty.
+const DefaultAgentUser = "daytona"
+
+const (
+	// CpuKindShared selects the shared-cpu-<n>x variant of the machine size.
+	CpuKindShared = "shared"
+	// CpuKindPerformance selects the performance-<n>x variant of the machine size.
+	CpuKindPerformance = "performance"
+)
+
+// DefaultSize is the machine size used when the Size option is empty.
+const DefaultSize = "shared-cpu-4x"
+
+// DefaultAppReadyTimeout is the default number of seconds to wait for the fly app to be ready.
+const DefaultAppReadyTimeout = 120
+
+// DefaultStopTimeout is the default number of seconds the containers of a target get to stop before its
+// machine is stopped.
+const DefaultStopTimeout = 30
+
+// DefaultProbeTimeout is the default number of seconds the machine script waits for
+// the volume mount and the network before running the init script.
+const DefaultProbeTimeout = 60
+
+// DefaultDockerStartTimeout is the default number of seconds the machine script waits for the Docker daemon
+// to become ready before giving up.
+const DefaultDockerStartTimeout = 120
+
+const (
+	// StartReadinessDial waits until the target's SSH port can be dialed.
+	StartReadinessDial = "dial"
+	// StartReadinessDocker additionally waits until the target's Docker daemon responds.
+	StartReadinessDocker = "docker"
+	// StartReadinessAgent additionally waits until the target's agent accepts SSH sessions.
+	StartReadinessAgent = "agent"
+)
+
+const (
+	// ConnectionModeTailnet reaches the target's Docker daemon over the Daytona tailnet.
+	ConnectionModeTailnet = "tailnet"
+	// ConnectionModePrivate reaches the target's Docker daemon over fly's private network at <app>.internal.
+	ConnectionModePrivate = "private"
+)
+
+// ConnectionModes lists the supported connection modes.
+var ConnectionModes = []string{ConnectionModeTailnet, ConnectionModePrivate}
+
+// StartReadinessLevels lists the start readiness levels in the order they are checked.
+var StartReadinessLevels = []string{StartReadinessDial, StartReadinessDocker, StartReadinessAgent}
+
+var secretKeyRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// labelKeyRegex matches the machine metadata keys accepted by fly.
+var labelKeyRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,62}$`)
+
+// labelValueRegex matches machine metadata values of printable ASCII characters.
+var labelValueRegex = regexp.MustCompile(`^[ -~]{0,255}$`)
+
+// imageRefRegex matches an image reference with an optional registry, tag and sha256 digest,
+// e.g. docker:dind or docker:dind@sha256:<digest>.
+var imageRefRegex = regexp.MustCompile(`^([a-z0-9.-]+(:[0-9]+)?/)?[a-z0-9][a-z0-9._/-]*(:[A-Za-z0-9_][A-Za-z0-9._-]{0,127})?(@sha256:[a-f0-9]{64})?$`)
+
+var appNameSuffixRegex = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// flyTokenPrefixes are the prefixes of the tokens issued by fly, e.g. "FlyV1 fm2_...".
+var flyTokenPrefixes = []string{"FlyV1 ", "fm1", "fm2", "fo1_"}
+
+// agentUserRegex matches portable Linux user names.
+var agentUserRegex = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+
+// namePrefixRegex matches name prefixes that keep the fly app name valid and leave room for the target id.
+var namePrefixRegex = regexp.MustCompile(`^[a-z][a-z0-9-]{0,19}$`)
+
+// dockerApiVersionRegex matches Docker API versions, e.g. 1.45.
+var dockerApiVersionRegex = regexp.MustCompile(`^1\.[0-9]+$`)
+
+// snapshotIdRegex matches fly volume snapshot ids, e.g. vs_abc123.
+var snapshotIdRegex = regexp.MustCompile(`^vs_[A-Za-z0-9]+$`)
+
+// volumeIdRegex matches fly volume ids, e.g. vol_abc123.
+var volumeIdRegex = regexp.MustCompile(`^vol_[A-Za-z0-9]+$`)
+
 type TargetOptions struct {
-	Region    string `json:"Region"`
-	Size      string `json:"Size"`
-	DiskSize  int    `json:"Disk Size"`
-	OrgSlug   string `json:"Org Slug"`
-	AuthToken string `json:"Auth Token,omitempty"`
+	Region                string      `json:"Region"`
+	RegionFallback        StringList  `json:"Region Fallback,omitempty"`
+	PrimaryRegion         string      `json:"Primary Region,omitempty"`
+	Size                  string      `json:"Size"`
+	CpuKind               string      `json:"Cpu Kind,omitempty"`
+	WorkspaceCpus         int         `json:"Workspace Cpus,omitempty"`
+	WorkspaceMemory       int         `json:"Workspace Memory,omitempty"`
+	DiskSize              FlexInt     `json:"Disk Size"`
+	Image                 string      `json:"Image,omitempty"`
+	DockerDataPath        string      `json:"Docker Data Path,omitempty"`
+	DockerHost            string      `json:"Docker Host,omitempty"`
+	DockerApiVersion      string      `json:"Docker Api Version,omitempty"`
+	DockerDaemonArgs      CommandList `json:"Docker Daemon Args,omitempty"`
+	MTU                   int         `json:"MTU,omitempty"`
+	NoPersistentDisk      bool        `json:"No Persistent Disk,omitempty"`
+	AutoDestroy           bool        `json:"Auto Destroy,omitempty"`
+	ExtraInitCommands     CommandList `json:"Extra Init Commands,omitempty"`
+	AgentUser             string      `json:"Agent User,omitempty"`
+	AgentHome             string      `json:"Agent Home,omitempty"`
+	AgentArgs             CommandList `json:"Agent Args,omitempty"`
+	PreallocateDockerData int         `json:"Preallocate Docker Data,omitempty"`
+	AutoExtendThreshold   int         `json:"Auto Extend Threshold Percent,omitempty"`
+	AutoExtendSizeLimitGb int         `json:"Auto Extend Size Limit,omitempty"`
+	SnapshotRetention     int         `json:"Snapshot Retention,omitempty"`
+	SnapshotId            string      `json:"Snapshot Id,omitempty"`
+	VolumeId              string      `json:"Volume Id,omitempty"`
+	EncryptVolume         *bool       `json:"Encrypt Volume,omitempty"`
+	NamePrefix            string      `json:"Name Prefix,omitempty"`
+	AppNameSuffix         string      `json:"App Name Suffix,omitempty"`
+	ReuseExistingApp      bool        `json:"Reuse Existing App,omitempty"`
+	ForceRecreate         bool        `json:"Force Recreate,omitempty"`
+	StartReadiness        string      `json:"Start Readiness,omitempty"`
+	ConnectionMode        string      `json:"Connection Mode,omitempty"`
+	MountProbeTimeout     int         `json:"Mount Probe Timeout,omitempty"`
+	NetworkProbeTimeout   int         `json:"Network Probe Timeout,omitempty"`
+	DockerStartTimeout    int         `json:"Docker Start Timeout,omitempty"`
+	CreateMaxAttempts     int         `json:"Create Max Attempts,omitempty"`
+	AppReadyTimeout       int         `json:"App Ready Timeout,omitempty"`
+	StopTimeout           int         `json:"Stop Timeout,omitempty"`
+	ExtraEnv              KeyValueMap `json:"Extra Env,omitempty"`
+	Secrets               KeyValueMap `json:"Secrets,omitempty"`
+	Labels                KeyValueMap `json:"Labels,omitempty"`
+	ReadyWebhookUrl       string      `json:"Ready Webhook Url,omitempty"`
+	DaytonaDownloadUrl    string      `json:"Daytona Download Url,omitempty"`
+	TTL                   string      `json:"TTL,omitempty"`
+	DryRun                bool        `json:"Dry Run,omitempty"`
+	PublicIP              *bool       `json:"Public IP,omitempty"`
+	Services              ServiceList `json:"Services,omitempty"`
+	OrgSlug               string      `json:"Org Slug"`
+	AuthToken             string      `json:"Auth Token,omitempty"`
+	ApiBaseUrl            string      `json:"Api Base Url,omitempty"`
+	FlapsBaseUrl          string      `json:"Flaps Base Url,omitempty"`
+	ProxyUrl              string      `json:"Proxy Url,omitempty"`
+	UseFlyConfigToken     bool        `json:"Use Fly Config Token,omitempty"`
+	// Transport is an optional HTTP transport used by the fly api and flaps clients.
+	// It can only be set programmatically, e.g. to add a proxy or custom TLS configuration.
+	Transport http.RoundTripper `json:"-"`
 }
 
 func GetTargetConfigManifest() *models.TargetConfigManifest {
@@ -23,17 +188,257 @@ func GetTargetConfigManifest() *models.TargetConfigManifest {
 			Description: "The region where the fly machine resides. If not specified, near region will be used.",
 			Suggestions: regions,
 		},
+		"Region Fallback": models.TargetConfigProperty{
+			Type: models.TargetConfigPropertyTypeString,
+			Description: "Comma separated list of regions, e.g. ord,iad, tried in order when the region " +
+				"has no capacity to launch the machine.",
+		},
+		"Primary Region": models.TargetConfigProperty{
+			Type: models.TargetConfigPropertyTypeString,
+			Description: "The primary region of the fly app, used for routing and exposed to the machine as " +
+				"PRIMARY_REGION. Defaults to the machine region.",
+			Suggestions: regions,
+		},
 		"Size": models.TargetConfigProperty{
 			Type:         models.TargetConfigPropertyTypeString,
-			DefaultValue: "shared-cpu-4x",
+			DefaultValue: DefaultSize,
 			Description: "The size of the fly machine. Default is shared-cpu-4x. List of available sizes " +
 				"https://fly.io/docs/about/pricing/#started-fly-machines",
+			Suggestions: sizes,
+		},
+		"Cpu Kind": models.TargetConfigProperty{
+			Type: models.TargetConfigPropertyTypeString,
+			Description: "Optional CPU kind, shared or performance, keeping the CPU count of the size. " +
+				"Ignored for sizes that imply a kind, such as GPU sizes.",
+			Suggestions: cpuKinds,
+		},
+		"Workspace Cpus": models.TargetConfigProperty{
+			Type: models.TargetConfigPropertyTypeInt,
+			Description: "Optional limit of the CPUs each workspace container may use, at most the CPUs of " +
+				"the machine size. Workspaces can override it with the " + WorkspaceCpusLabel + " label.",
+		},
+		"Workspace Memory": models.TargetConfigProperty{
+			Type: models.TargetConfigPropertyTypeInt,
+			Description: "Optional limit of the memory in MB each workspace container may use, at most the " +
+				"memory of the machine size. Workspaces can override it with the " + WorkspaceMemoryLabel + " label.",
 		},
 		"Disk Size": models.TargetConfigProperty{
 			Type:         models.TargetConfigPropertyTypeInt,
-			DefaultValue: "10",
+			DefaultValue: strconv.Itoa(DefaultDiskSize),
 			Description:  "The size of the disk in GB.",
 		},
+		"Image": models.TargetConfigProperty{
+			Type:         models.TargetConfigPropertyTypeString,
+			DefaultValue: DefaultImage,
+			Description: "The Docker-in-Docker image of the fly machine. Pin a digest, e.g. " +
+				"docker:dind@sha256:<digest>, for reproducible targets.",
+		},
+		"Docker Data Path": models.TargetConfigProperty{
+			Type:         models.TargetConfigPropertyTypeString,
+			DefaultValue: DefaultDockerDataPath,
+			Description: "Absolute path the data volume is mounted at. When changed, dockerd is started " +
+				"with --data-root set to this path.",
+		},
+		"Docker Host": models.TargetConfigProperty{
+			Type: models.TargetConfigPropertyTypeString,
+			Description: "Address of an external Docker daemon, e.g. tcp://docker.internal:2375. If set, no Docker " +
+				"daemon is started on the machine and both the agent and the provider use this host. " +
+				"Requires No Persistent Disk.",
+		},
+		"Docker Api Version": models.TargetConfigProperty{
+			Type: models.TargetConfigPropertyTypeString,
+			Description: "Docker API version used to talk to the Docker daemon of the target, e.g. 1.45. " +
+				"If empty, the version is negotiated with the daemon.",
+		},
+		"Docker Daemon Args": models.TargetConfigProperty{
+			Type: models.TargetConfigPropertyTypeString,
+			Description: "Flags passed to the Docker daemon of the machine, one per line in the --flag=value form, " +
+				"e.g. --registry-mirror=https://mirror.example.com. Use the MTU option to set the MTU.",
+		},
+		"MTU": models.TargetConfigProperty{
+			Type: models.TargetConfigPropertyTypeInt,
+			Description: "MTU of the Docker networks of the machine, between 1280 and 1500. Set it to 1280 if " +
+				"containers hang on network I/O. If empty, Docker's default is used.",
+		},
+		"No Persistent Disk": models.TargetConfigProperty{
+			Type: models.TargetConfigPropertyTypeBoolean,
+			Description: "If true, no volume is created and Docker data lives on the ephemeral root disk of the " +
+				"machine. All data is lost when the machine is replaced.",
+		},
+		"Auto Destroy": models.TargetConfigProperty{
+			Type: models.TargetConfigPropertyTypeBoolean,
+			Description: "If true, fly destroys the machine once it exits, including when the target is stopped, " +
+				"for one-shot targets such as CI runs. Requires No Persistent Disk.",
+		},
+		"Extra Init Commands": models.TargetConfigProperty{
+			Type: models.TargetConfigPropertyTypeString,
+			Description: "Shell commands, one per line, run as root once Docker is ready and before the " +
+				"daytona agent starts. The machine setup stops if a command fails.",
+		},
+		"Agent User": models.TargetConfigProperty{
+			Type:         models.TargetConfigPropertyTypeString,
+			DefaultValue: DefaultAgentUser,
+			Description:  "The user the daytona agent runs as. The user is created if the image does not have it yet.",
+		},
+		"Agent Home": models.TargetConfigProperty{
+			Type:        models.TargetConfigPropertyTypeString,
+			Description: "Absolute home directory of a newly created agent user. Defaults to /home/<agent user>.",
+		},
+		"Agent Args": models.TargetConfigProperty{
+			Type: models.TargetConfigPropertyTypeString,
+			Description: "Extra flags passed to the daytona agent after --target, one per line in the " +
+				"--flag=value form.",
+		},
+		"Preallocate Docker Data": models.TargetConfigProperty{
+			Type: models.TargetConfigPropertyTypeInt,
+			Description: "Space in GB to allocate and free again in the Docker data directory on first boot, so " +
+				"the volume blocks are allocated before the first build. Must be smaller than the disk size. " +
+				"Leave empty to skip preallocation.",
+		},
+		"Auto Extend Threshold Percent": models.TargetConfigProperty{
+			Type: models.TargetConfigPropertyTypeInt,
+			Description: "Disk usage percentage (1-99) at which fly automatically extends the volume. " +
+				"Leave empty to disable auto extend.",
+		},
+		"Auto Extend Size Limit": models.TargetConfigProperty{
+			Type:        models.TargetConfigPropertyTypeInt,
+			Description: "The maximum size in GB the volume can be automatically extended to.",
+		},
+		"Snapshot Retention": models.TargetConfigProperty{
+			Type:        models.TargetConfigPropertyTypeInt,
+			Description: "Number of days fly keeps the daily volume snapshots. Leave empty for the fly default.",
+		},
+		"Snapshot Id": models.TargetConfigProperty{
+			Type: models.TargetConfigPropertyTypeString,
+			Description: "Optional volume snapshot id, e.g. vs_abc123, to restore the data volume from. " +
+				"The snapshot must fit in the disk size.",
+		},
+		"Volume Id": models.TargetConfigProperty{
+			Type: models.TargetConfigPropertyTypeString,
+			Description: "Optional id of an existing, unattached volume in the target app, e.g. vol_abc123, to " +
+				"attach instead of creating a new one. It must be in the machine region and requires Reuse Existing App.",
+		},
+		"Encrypt Volume": models.TargetConfigProperty{
+			Type:         models.TargetConfigPropertyTypeBoolean,
+			DefaultValue: "true",
+			Description:  "If false, the data volume is created unencrypted. Fly encrypts volumes at rest by default.",
+		},
+		"Name Prefix": models.TargetConfigProperty{
+			Type:         models.TargetConfigPropertyTypeString,
+			DefaultValue: DefaultNamePrefix,
+			Description: "Prefix of the fly app, machine and volume names, e.g. to tell apart the targets of several " +
+				"Daytona instances in a shared org. Up to 20 lowercase letters, numbers and dashes, starting with a letter.",
+		},
+		"App Name Suffix": models.TargetConfigProperty{
+			Type: models.TargetConfigPropertyTypeString,
+			Description: "Optional suffix appended to the fly app name, e.g. daytona-<id>-staging. " +
+				"Only lowercase letters, numbers and dashes are allowed.",
+		},
+		"Reuse Existing App": models.TargetConfigProperty{
+			Type: models.TargetConfigPropertyTypeBoolean,
+			Description: "If true, an existing fly app with the target app name is reused instead of failing. " +
+				"A running machine of the target in the app is kept, while a machine of the target in any other state " +
+				"fails the create.",
+		},
+		"Force Recreate": models.TargetConfigProperty{
+			Type: models.TargetConfigPropertyTypeBoolean,
+			Description: "If true, an existing app of the target is deleted and the target created from scratch. " +
+				"By default a running machine of the target left by an earlier create is kept.",
+		},
+		"Start Readiness": models.TargetConfigProperty{
+			Type:         models.TargetConfigPropertyTypeString,
+			DefaultValue: StartReadinessDial,
+			Description: "How far starting a target waits before completing. dial waits for the SSH port, " +
+				"docker also waits for the Docker daemon and agent also waits for the agent to accept SSH sessions.",
+			Suggestions: StartReadinessLevels,
+		},
+		"Connection Mode": models.TargetConfigProperty{
+			Type:         models.TargetConfigPropertyTypeString,
+			DefaultValue: ConnectionModeTailnet,
+			Description: "How the provider reaches the target's Docker daemon. tailnet uses the Daytona tailnet, " +
+				"private uses fly's private network and requires the provider to run in the same fly org network.",
+			Suggestions: ConnectionModes,
+		},
+		"Mount Probe Timeout": models.TargetConfigProperty{
+			Type:         models.TargetConfigPropertyTypeInt,
+			DefaultValue: "60",
+			Description:  "Seconds the machine waits for the data volume mount before running the init script.",
+		},
+		"Network Probe Timeout": models.TargetConfigProperty{
+			Type:         models.TargetConfigPropertyTypeInt,
+			DefaultValue: "60",
+			Description:  "Seconds the machine waits for the fly internal DNS to resolve before running the init script.",
+		},
+		"Docker Start Timeout": models.TargetConfigProperty{
+			Type:         models.TargetConfigPropertyTypeInt,
+			DefaultValue: strconv.Itoa(DefaultDockerStartTimeout),
+			Description:  "Seconds the machine waits for Docker to become ready before giving up.",
+		},
+		"Create Max Attempts": models.TargetConfigProperty{
+			Type:         models.TargetConfigPropertyTypeInt,
+			DefaultValue: "1",
+			Description: "Number of times target creation is attempted when it fails with a transient error, " +
+				"such as missing capacity. Partially created resources are deleted between attempts.",
+		},
+		"App Ready Timeout": models.TargetConfigProperty{
+			Type:         models.TargetConfigPropertyTypeInt,
+			DefaultValue: "120",
+			Description:  "Seconds to wait for the fly app to be ready when creating or starting a target.",
+		},
+		"Stop Timeout": models.TargetConfigProperty{
+			Type:         models.TargetConfigPropertyTypeInt,
+			DefaultValue: strconv.Itoa(DefaultStopTimeout),
+			Description: "Seconds the Docker containers of the target get to stop cleanly when the target is " +
+				"stopped, before the machine is stopped regardless.",
+		},
+		"Extra Env": models.TargetConfigProperty{
+			Type: models.TargetConfigPropertyTypeString,
+			Description: "Additional environment variables set on the fly machine, as a JSON object or a " +
+				"comma separated KEY=VALUE list. Target environment variables take precedence on conflict.",
+		},
+		"Secrets": models.TargetConfigProperty{
+			Type:        models.TargetConfigPropertyTypeString,
+			InputMasked: true,
+			Description: "Sensitive values such as registry tokens, set as fly app secrets instead of plaintext " +
+				"machine env. Accepts the same formats as Extra Env.",
+		},
+		"Labels": models.TargetConfigProperty{
+			Type: models.TargetConfigPropertyTypeString,
+			Description: "Labels such as team or cost center added to the fly machine metadata, as a JSON " +
+				"object or a comma separated KEY=VALUE list.",
+		},
+		"Ready Webhook Url": models.TargetConfigProperty{
+			Type: models.TargetConfigPropertyTypeString,
+			Description: "Optional http(s) URL that receives a JSON POST with the target id, machine id, region " +
+				"and a correlation id once the target machine is ready.",
+		},
+		"Daytona Download Url": models.TargetConfigProperty{
+			Type: models.TargetConfigPropertyTypeString,
+			Description: "Optional http(s) URL of the daytona agent install script, e.g. on a self-hosted mirror. " +
+				"It overrides the download URL of the Daytona server, and receives the target API key " +
+				"as a Bearer token.",
+		},
+		"TTL": models.TargetConfigProperty{
+			Type: models.TargetConfigPropertyTypeString,
+			Description: "Optional time to live of the target, e.g. 24h. The expiry time is stored in the machine " +
+				"metadata so expired targets can be destroyed by a cleanup job.",
+		},
+		"Dry Run": models.TargetConfigProperty{
+			Type: models.TargetConfigPropertyTypeBoolean,
+			Description: "If true, creating a target only logs the app, volume and machine that would be created " +
+				"without creating them.",
+		},
+		"Public IP": models.TargetConfigProperty{
+			Type:         models.TargetConfigPropertyTypeBoolean,
+			DefaultValue: "true",
+			Description: "If false, any public IP addresses are released from the fly app and the machine is " +
+				"only reachable over the tailnet and fly private networking.",
+		},
+		"Services": models.TargetConfigProperty{
+			Type: models.TargetConfigPropertyTypeString,
+			Description: "Comma separated INTERNAL:PUBLIC[:HANDLER+HANDLER] port mappings, e.g. 8080:443:tls+http, " +
+				"exposing machine ports publicly on fly's edge. Handlers are " + strings.Join(ServiceHandlers, ", ") + ".",
+		},
 		"Org Slug": models.TargetConfigProperty{
 			Type:        models.TargetConfigPropertyTypeString,
 			Description: "The organization name to create the fly machine in.",
@@ -43,7 +448,101 @@ func GetTargetConfigManifest() *models.TargetConfigManifest {
 			InputMasked: true,
 			Description: "If empty, token will be fetched from the FLY_ACCESS_TOKEN environment variable.",
 		},
+		"Api Base Url": models.TargetConfigProperty{
+			Type: models.TargetConfigPropertyTypeString,
+			Description: "Base URL of the fly API, e.g. for an API proxy. If empty, it is read from the " +
+				"FLY_API_BASE_URL environment variable, defaulting to https://api.fly.io.",
+		},
+		"Flaps Base Url": models.TargetConfigProperty{
+			Type: models.TargetConfigPropertyTypeString,
+			Description: "Base URL of the fly machines API. If empty, the FLY_FLAPS_BASE_URL environment " +
+				"variable is used, defaulting to https://api.machines.dev.",
+		},
+		"Proxy Url": models.TargetConfigProperty{
+			Type: models.TargetConfigPropertyTypeString,
+			Description: "URL of the http(s) or socks5 proxy used for fly API requests. If empty, the HTTP_PROXY " +
+				"and HTTPS_PROXY environment variables are used.",
+		},
+		"Use Fly Config Token": models.TargetConfigProperty{
+			Type: models.TargetConfigPropertyTypeBoolean,
+			Description: "If true and no token is set in the options or environment, the token is read from " +
+				"the fly CLI config file at ~/.fly/config.yml.",
+		},
+	}
+}
+
+// VolumeEncrypted reports whether the data volume is encrypted at rest, which is fly's default.
+func (o *TargetOptions) VolumeEncrypted() bool {
+	return o.EncryptVolume == nil || *o.EncryptVolume
+}
+
+// PublicIPEnabled reports whether the target app may keep public IP addresses.
+// Defaults to true when the option is not set.
+func (o *TargetOptions) PublicIPEnabled() bool {
+	return o.PublicIP == nil || *o.PublicIP
+}
+
+// AppPrimaryRegion returns the primary region of the fly app, the Primary Region option
+// or the machine region if it is not set.
+func (o *TargetOptions) AppPrimaryRegion() string {
+	if o.PrimaryRegion != "" {
+		return o.PrimaryRegion
 	}
+	return o.Region
+}
+
+// MachineSize returns the fly machine size with the CPU kind applied, e.g. performance-4x for
+// shared-cpu-4x and the performance kind. Sizes without a shared and a performance variant are returned unchanged.
+func (o *TargetOptions) MachineSize() string {
+	var count string
+	switch {
+	case strings.HasPrefix(o.Size, "shared-cpu-"):
+		count = strings.TrimPrefix(o.Size, "shared-cpu-")
+	case strings.HasPrefix(o.Size, "performance-"):
+		count = strings.TrimPrefix(o.Size, "performance-")
+	default:
+		return o.Size
+	}
+
+	switch o.CpuKind {
+	case CpuKindShared:
+		return "shared-cpu-" + count
+	case CpuKindPerformance:
+		return "performance-" + count
+	default:
+		return o.Size
+	}
+}
+
+// ValidateSize checks that the size is supported and, combined with the cpu kind of the options,
+// is available and fits the workspace resource limits and the disk size.
+func (o *TargetOptions) ValidateSize(size string) error {
+	if !slices.Contains(sizes, size) {
+		return fmt.Errorf("invalid size %q, must be one of %v", size, sizes)
+	}
+
+	resized := *o
+	resized.Size = size
+
+	if o.CpuKind != "" {
+		if !slices.Contains(cpuKinds, o.CpuKind) {
+			return fmt.Errorf("invalid cpu kind %q, must be one of %v", o.CpuKind, cpuKinds)
+		}
+		if !slices.Contains(sizes, resized.MachineSize()) {
+			return fmt.Errorf("size %s is not available with cpu kind %s", size, o.CpuKind)
+		}
+	}
+
+	err := checkWorkspaceResources(resized.MachineSize(), WorkspaceResources{Cpus: o.WorkspaceCpus, MemoryMb: o.WorkspaceMemory})
+	if err != nil {
+		return err
+	}
+
+	// Targets without a persistent disk have no volume to attach
+	if o.NoPersistentDisk {
+		return nil
+	}
+	return checkDiskSize(resized.MachineSize(), int(o.DiskSize))
 }
 
 // ParseTargetOptions parses the target options from the JSON string.
@@ -62,6 +561,16 @@ func ParseTargetOptions(optionsJson string) (*TargetOptions, error) {
 		}
 	}
 
+	if targetOptions.AuthToken == "" && targetOptions.UseFlyConfigToken {
+		// Fall back to the token stored by the fly CLI
+		token, err := readFlyConfigToken()
+		if err != nil {
+			return nil, err
+		}
+		targetOptions.AuthToken = token
+	}
+
+	targetOptions.AuthToken = strings.TrimSpace(targetOptions.AuthToken)
 	if targetOptions.AuthToken == "" {
 		return nil, fmt.Errorf("auth token not set in env/target options")
 	}
@@ -70,5 +579,339 @@ func ParseTargetOptions(optionsJson string) (*TargetOptions, error) {
 		return nil, fmt.Errorf("org slug not set in target options")
 	}
 
+	if targetOptions.DiskSize == 0 {
+		targetOptions.DiskSize = DefaultDiskSize
+	}
+
+	if targetOptions.DiskSize < 0 {
+		return nil, fmt.Errorf("disk size must be positive")
+	}
+
+	if targetOptions.DiskSize > MaxDiskSize {
+		return nil, fmt.Errorf("disk size %dGB exceeds the maximum of %dGB", targetOptions.DiskSize, MaxDiskSize)
+	}
+
+	if targetOptions.Region != "" && !slices.Contains(regions, targetOptions.Region) {
+		return nil, fmt.Errorf("invalid region %q", targetOptions.Region)
+	}
+
+	if targetOptions.PrimaryRegion != "" && !slices.Contains(regions, targetOptions.PrimaryRegion) {
+		return nil, fmt.Errorf("invalid primary region %q", targetOptions.PrimaryRegion)
+	}
+
+	for _, region := range targetOptions.RegionFallback {
+		if !slices.Contains(regions, region) {
+			return nil, fmt.Errorf("invalid fallback region %q", region)
+		}
+		if region == targetOptions.Region {
+			return nil, fmt.Errorf("fallback region %q is the same as the machine region", region)
+		}
+	}
+
+	if targetOptions.Size == "" {
+		targetOptions.Size = DefaultSize
+	}
+
+	err = targetOptions.ValidateSize(targetOptions.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	if targetOptions.Image == "" {
+		targetOptions.Image = DefaultImage
+	}
+
+	if !imageRefRegex.MatchString(targetOptions.Image) {
+		return nil, fmt.Errorf("invalid image reference %q", targetOptions.Image)
+	}
+
+	if targetOptions.DockerDataPath == "" {
+		targetOptions.DockerDataPath = DefaultDockerDataPath
+	}
+
+	if !path.IsAbs(targetOptions.DockerDataPath) {
+		return nil, fmt.Errorf("docker data path %q must be an absolute path", targetOptions.DockerDataPath)
+	}
+
+	if targetOptions.AgentUser == "" {
+		targetOptions.AgentUser = DefaultAgentUser
+	}
+
+	if !agentUserRegex.MatchString(targetOptions.AgentUser) {
+		return nil, fmt.Errorf("invalid agent user %q, must be a lowercase user name of at most 32 characters", targetOptions.AgentUser)
+	}
+
+	if targetOptions.AgentHome != "" && !path.IsAbs(targetOptions.AgentHome) {
+		return nil, fmt.Errorf("agent home %q must be an absolute path", targetOptions.AgentHome)
+	}
+
+	for _, arg := range targetOptions.AgentArgs {
+		if strings.TrimSpace(arg) == "" {
+			return nil, fmt.Errorf("agent args must not be empty")
+		}
+		if !strings.HasPrefix(arg, "-") {
+			return nil, fmt.Errorf("agent arg %q must be a flag such as --log-level=debug", arg)
+		}
+	}
+
+	if targetOptions.NamePrefix != "" && !namePrefixRegex.MatchString(targetOptions.NamePrefix) {
+		return nil, fmt.Errorf("name prefix %q must be up to 20 lowercase letters, numbers and dashes, starting with a letter", targetOptions.NamePrefix)
+	}
+
+	if targetOptions.AppNameSuffix != "" && !appNameSuffixRegex.MatchString(targetOptions.AppNameSuffix) {
+		return nil, fmt.Errorf("app name suffix %q may only contain lowercase letters, numbers and dashes", targetOptions.AppNameSuffix)
+	}
+
+	if targetOptions.StartReadiness == "" {
+		targetOptions.StartReadiness = StartReadinessDial
+	}
+
+	if !slices.Contains(StartReadinessLevels, targetOptions.StartReadiness) {
+		return nil, fmt.Errorf("invalid start readiness %q, must be one of %v", targetOptions.StartReadiness, StartReadinessLevels)
+	}
+
+	if targetOptions.ConnectionMode == "" {
+		targetOptions.ConnectionMode = ConnectionModeTailnet
+	}
+
+	if !slices.Contains(ConnectionModes, targetOptions.ConnectionMode) {
+		return nil, fmt.Errorf("invalid connection mode %q, must be one of %v", targetOptions.ConnectionMode, ConnectionModes)
+	}
+
+	if targetOptions.AutoExtendThreshold < 0 || targetOptions.AutoExtendThreshold > 99 {
+		return nil, fmt.Errorf("auto extend threshold percent must be between 1 and 99")
+	}
+
+	if targetOptions.AutoExtendSizeLimitGb != 0 {
+		if targetOptions.AutoExtendThreshold == 0 {
+			return nil, fmt.Errorf("auto extend size limit requires auto extend threshold percent to be set")
+		}
+		if targetOptions.AutoExtendSizeLimitGb <= int(targetOptions.DiskSize) {
+			return nil, fmt.Errorf("auto extend size limit (%dGB) must be larger than the disk size (%dGB)", targetOptions.AutoExtendSizeLimitGb, targetOptions.DiskSize)
+		}
+	}
+
+	if targetOptions.SnapshotRetention < 0 {
+		return nil, fmt.Errorf("snapshot retention must not be negative")
+	}
+
+	if targetOptions.SnapshotId != "" && !snapshotIdRegex.MatchString(targetOptions.SnapshotId) {
+		return nil, fmt.Errorf("invalid snapshot id %q", targetOptions.SnapshotId)
+	}
+
+	if targetOptions.VolumeId != "" {
+		if !volumeIdRegex.MatchString(targetOptions.VolumeId) {
+			return nil, fmt.Errorf("invalid volume id %q", targetOptions.VolumeId)
+		}
+		if targetOptions.SnapshotId != "" {
+			return nil, fmt.Errorf("volume id and snapshot id can't both be set")
+		}
+		// Volumes can only be attached within their app, and every other target gets a new app
+		if !targetOptions.ReuseExistingApp {
+			return nil, fmt.Errorf("volume id requires reuse existing app")
+		}
+		// The existing volume can't follow the machine to a fallback region
+		if len(targetOptions.RegionFallback) > 0 {
+			return nil, fmt.Errorf("volume id can't be combined with region fallback")
+		}
+	}
+
+	if targetOptions.MountProbeTimeout < 0 || targetOptions.NetworkProbeTimeout < 0 {
+		return nil, fmt.Errorf("probe timeouts must not be negative")
+	}
+
+	if targetOptions.MountProbeTimeout == 0 {
+		targetOptions.MountProbeTimeout = DefaultProbeTimeout
+	}
+
+	if targetOptions.NetworkProbeTimeout == 0 {
+		targetOptions.NetworkProbeTimeout = DefaultProbeTimeout
+	}
+
+	if targetOptions.DockerStartTimeout < 0 {
+		return nil, fmt.Errorf("docker start timeout must not be negative")
+	}
+
+	for key := range targetOptions.Secrets {
+		if !secretKeyRegex.MatchString(key) {
+			return nil, fmt.Errorf("invalid secret key %q, must be a valid environment variable name", key)
+		}
+		if _, ok := targetOptions.ExtraEnv[key]; ok {
+			return nil, fmt.Errorf("secret key %q is also set in extra env", key)
+		}
+	}
+
+	for key, value := range targetOptions.Labels {
+		if !labelKeyRegex.MatchString(key) {
+			return nil, fmt.Errorf("invalid label key %q, must be up to 63 letters, numbers, dots, dashes and underscores", key)
+		}
+		if strings.HasPrefix(key, "fly_") {
+			return nil, fmt.Errorf("label key %q uses the fly_ prefix reserved by fly", key)
+		}
+		if !labelValueRegex.MatchString(value) {
+			return nil, fmt.Errorf("invalid value of label %q, must be up to 255 printable ASCII characters", key)
+		}
+	}
+
+	publicPorts := map[int]bool{}
+	for _, service := range targetOptions.Services {
+		err := service.validate()
+		if err != nil {
+			return nil, err
+		}
+		if publicPorts[service.Port] {
+			return nil, fmt.Errorf("public port %d is used by more than one service", service.Port)
+		}
+		publicPorts[service.Port] = true
+	}
+
+	if len(targetOptions.Services) > 0 && !targetOptions.PublicIPEnabled() {
+		return nil, fmt.Errorf("services require a public IP")
+	}
+
+	if targetOptions.DaytonaDownloadUrl != "" && !isHttpUrl(targetOptions.DaytonaDownloadUrl) {
+		return nil, fmt.Errorf("daytona download url %q must be an absolute http(s) URL", targetOptions.DaytonaDownloadUrl)
+	}
+
+	if targetOptions.ReadyWebhookUrl != "" && !isHttpUrl(targetOptions.ReadyWebhookUrl) {
+		return nil, fmt.Errorf("ready webhook url %q must be an absolute http(s) URL", targetOptions.ReadyWebhookUrl)
+	}
+
+	if targetOptions.TTL != "" {
+		ttl, err := time.ParseDuration(targetOptions.TTL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TTL %q, must be a duration such as 24h: %w", targetOptions.TTL, err)
+		}
+		if ttl <= 0 {
+			return nil, fmt.Errorf("TTL must be positive")
+		}
+	}
+
+	if targetOptions.ApiBaseUrl == "" {
+		targetOptions.ApiBaseUrl = os.Getenv("FLY_API_BASE_URL")
+	}
+
+	if targetOptions.ApiBaseUrl != "" && !isHttpUrl(targetOptions.ApiBaseUrl) {
+		return nil, fmt.Errorf("api base url %q must be an absolute http(s) URL", targetOptions.ApiBaseUrl)
+	}
+
+	if targetOptions.FlapsBaseUrl != "" && !isHttpUrl(targetOptions.FlapsBaseUrl) {
+		return nil, fmt.Errorf("flaps base url %q must be an absolute http(s) URL", targetOptions.FlapsBaseUrl)
+	}
+
+	if targetOptions.ProxyUrl != "" && !isProxyUrl(targetOptions.ProxyUrl) {
+		return nil, fmt.Errorf("proxy url %q must be an absolute http(s) or socks5 URL", targetOptions.ProxyUrl)
+	}
+
+	if targetOptions.AppReadyTimeout < 0 {
+		return nil, fmt.Errorf("app ready timeout must not be negative")
+	}
+
+	if targetOptions.StopTimeout < 0 {
+		return nil, fmt.Errorf("stop timeout must not be negative")
+	}
+
+	if targetOptions.CreateMaxAttempts < 0 {
+		return nil, fmt.Errorf("create max attempts must not be negative")
+	}
+
+	if targetOptions.PreallocateDockerData < 0 {
+		return nil, fmt.Errorf("preallocate docker data must not be negative")
+	}
+
+	if targetOptions.PreallocateDockerData > 0 && targetOptions.PreallocateDockerData >= int(targetOptions.DiskSize) {
+		return nil, fmt.Errorf("preallocate docker data (%dGB) must be smaller than the disk size (%dGB)", targetOptions.PreallocateDockerData, targetOptions.DiskSize)
+	}
+
+	if targetOptions.DockerHost != "" {
+		parsed, err := url.Parse(targetOptions.DockerHost)
+		if err != nil || parsed.Scheme != "tcp" || parsed.Host == "" {
+			return nil, fmt.Errorf("docker host %q must be a tcp://host:port address", targetOptions.DockerHost)
+		}
+		// The machine has no Docker data to keep, so a data volume would only add cost
+		if !targetOptions.NoPersistentDisk {
+			return nil, fmt.Errorf("docker host requires no persistent disk")
+		}
+		if targetOptions.PreallocateDockerData > 0 || targetOptions.DockerDataPath != DefaultDockerDataPath {
+			return nil, fmt.Errorf("docker data options can't be used with an external docker host")
+		}
+		if len(targetOptions.DockerDaemonArgs) > 0 || targetOptions.MTU != 0 {
+			return nil, fmt.Errorf("docker daemon args and mtu can't be used with an external docker host")
+		}
+	}
+
+	for _, arg := range targetOptions.DockerDaemonArgs {
+		if strings.TrimSpace(arg) == "" {
+			return nil, fmt.Errorf("docker daemon args must not be empty")
+		}
+		if !strings.HasPrefix(arg, "-") {
+			return nil, fmt.Errorf("docker daemon arg %q must be a flag such as --mtu=1280", arg)
+		}
+		// dockerd refuses to start when a flag is set twice
+		if targetOptions.MTU != 0 && (arg == "--mtu" || strings.HasPrefix(arg, "--mtu=")) {
+			return nil, fmt.Errorf("the mtu must be set either with the mtu option or the docker daemon args")
+		}
+	}
+
+	if targetOptions.MTU != 0 && (targetOptions.MTU < MinMTU || targetOptions.MTU > MaxMTU) {
+		return nil, fmt.Errorf("mtu %d must be between %d and %d", targetOptions.MTU, MinMTU, MaxMTU)
+	}
+
+	if targetOptions.DockerApiVersion != "" && !dockerApiVersionRegex.MatchString(targetOptions.DockerApiVersion) {
+		return nil, fmt.Errorf("invalid docker api version %q, must be a version such as 1.45", targetOptions.DockerApiVersion)
+	}
+
+	for _, command := range targetOptions.ExtraInitCommands {
+		if strings.TrimSpace(command) == "" {
+			return nil, fmt.Errorf("extra init commands must not be empty")
+		}
+	}
+
+	if targetOptions.NoPersistentDisk {
+		if targetOptions.PreallocateDockerData > 0 || targetOptions.AutoExtendThreshold > 0 || targetOptions.SnapshotRetention > 0 || targetOptions.SnapshotId != "" || targetOptions.EncryptVolume != nil || targetOptions.VolumeId != "" {
+			return nil, fmt.Errorf("preallocation, auto extend, snapshot, encryption and volume id options require a persistent disk")
+		}
+	}
+
+	// Recreating deletes the existing app, which may not belong to the target when it is reused
+	if targetOptions.ForceRecreate && targetOptions.ReuseExistingApp {
+		return nil, fmt.Errorf("force recreate can't be combined with reuse existing app")
+	}
+
+	// The volume of a machine that destroyed itself would be left behind until the target is destroyed
+	if targetOptions.AutoDestroy && !targetOptions.NoPersistentDisk {
+		return nil, fmt.Errorf("auto destroy requires no persistent disk")
+	}
+
 	return &targetOptions, nil
 }
+
+// isHttpUrl reports whether the raw string is an absolute http or https URL.
+func isHttpUrl(raw string) bool {
+	parsed, err := url.Parse(raw)
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
+
+func isProxyUrl(raw string) bool {
+	parsed, err := url.Parse(raw)
+	return err == nil && slices.Contains([]string{"http", "https", "socks5"}, parsed.Scheme) && parsed.Host != ""
+}
+
+// WarnIfUnprefixedToken logs a warning if the token does not start with the prefix of a token issued by fly.
+// Legacy personal access tokens have no prefix, so this is only a hint for confusing 401s later on. It is
+// called once per create or requirements check rather than on every parse of the target options.
+func WarnIfUnprefixedToken(token string) {
+	if !hasFlyTokenPrefix(token) {
+		log.Warnf("The fly auth token does not start with any of %q, it may be invalid", flyTokenPrefixes)
+	}
+}
+
+// hasFlyTokenPrefix reports whether the token starts with the prefix of a token issued by fly.
+func hasFlyTokenPrefix(token string) bool {
+	for _, prefix := range flyTokenPrefixes {
+		if strings.HasPrefix(token, prefix) {
+			return true
+		}
+	}
+	return false
+}
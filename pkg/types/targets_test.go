@@ -1,6 +1,10 @@
 package types
 
 import (
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -10,7 +14,7 @@ func TestGetTargetConfigManifest(t *testing.T) {
 		t.Fatalf("Expected target config manifest but got nil")
 	}
 
-	fields := [5]string{"Region", "Size", "Disk Size", "Org Slug", "Auth Token"}
+	fields := []string{"Region", "Region Fallback", "Primary Region", "Size", "Cpu Kind", "Workspace Cpus", "Workspace Memory", "Disk Size", "Image", "Docker Data Path", "Docker Host", "Docker Api Version", "Docker Daemon Args", "MTU", "No Persistent Disk", "Auto Destroy", "Extra Init Commands", "Agent User", "Agent Home", "Agent Args", "Preallocate Docker Data", "Auto Extend Threshold Percent", "Auto Extend Size Limit", "Snapshot Retention", "Snapshot Id", "Volume Id", "Encrypt Volume", "Name Prefix", "App Name Suffix", "Reuse Existing App", "Force Recreate", "Start Readiness", "Connection Mode", "Mount Probe Timeout", "Network Probe Timeout", "Docker Start Timeout", "Create Max Attempts", "App Ready Timeout", "Stop Timeout", "Extra Env", "Secrets", "Labels", "Ready Webhook Url", "Daytona Download Url", "TTL", "Dry Run", "Public IP", "Services", "Org Slug", "Auth Token", "Api Base Url", "Flaps Base Url", "Proxy Url", "Use Fly Config Token"}
 	for _, field := range fields {
 		if _, ok := (*targetConfigManifest)[field]; !ok {
 			t.Errorf("Expected field %s in target config manifest but it was not found", field)
@@ -49,6 +53,714 @@ func TestParseTargetOptions(t *testing.T) {
 			setAccessTokenEnv: false,
 			isValid:           false,
 		},
+		{
+			name:              "Preallocation within disk size",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Disk Size":10,"Preallocate Docker Data":5}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "Preallocation exceeds disk size",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Disk Size":10,"Preallocate Docker Data":20}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Preallocation of the whole disk",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Disk Size":10,"Preallocate Docker Data":10}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Negative preallocation",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Preallocate Docker Data":-1}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Valid app name suffix",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","App Name Suffix":"staging-1"}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "Invalid app name suffix",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","App Name Suffix":"Staging_1"}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Valid start readiness",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Start Readiness":"docker"}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "Invalid start readiness",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Start Readiness":"ping"}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Extra env as KEY=VALUE list",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Extra Env":"HTTP_PROXY=http://proxy:8080,FOO=bar"}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "Extra env as JSON object",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Extra Env":{"FOO":"bar"}}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "Invalid extra env",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Extra Env":"FOO"}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Valid auto extend",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Disk Size":10,"Auto Extend Threshold Percent":80,"Auto Extend Size Limit":50}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "Auto extend threshold out of range",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Auto Extend Threshold Percent":100}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Auto extend size limit below disk size",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Disk Size":10,"Auto Extend Threshold Percent":80,"Auto Extend Size Limit":5}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Public IP disabled",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Public IP":false}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "Invalid public IP",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Public IP":"no"}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Negative probe timeout",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Network Probe Timeout":-1}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Valid docker start timeout",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Docker Start Timeout":300}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "Negative docker start timeout",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Docker Start Timeout":-1}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Valid ready webhook url",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Ready Webhook Url":"https://example.com/ready"}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "Invalid ready webhook url",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Ready Webhook Url":"example.com/ready"}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Valid size",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Size":"performance-2x"}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "Invalid size",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Size":"shared-cpu-5x"}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Empty size uses default",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Size":""}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "Valid secrets",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Secrets":"REGISTRY_TOKEN=secret"}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "Invalid secret key",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Secrets":{"1TOKEN":"secret"}}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Secret key also in extra env",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Secrets":{"TOKEN":"secret"},"Extra Env":{"TOKEN":"plain"}}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Negative create max attempts",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Create Max Attempts":-1}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Negative app ready timeout",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","App Ready Timeout":-1}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Digest pinned image",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Image":"docker:dind@sha256:` + strings.Repeat("a", 64) + `"}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "Image from registry with port",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Image":"registry.example.com:5000/team/dind:27"}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "Invalid image digest",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Image":"docker:dind@sha256:abc"}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Valid region fallback",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Region":"lax","Region Fallback":"ord, iad"}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "Invalid region fallback",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Region Fallback":"ord,Iad1"}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Region fallback repeats primary region",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Region":"lax","Region Fallback":"lax"}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Valid api base urls",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Api Base Url":"https://fly-proxy.internal","Flaps Base Url":"https://machines-proxy.internal/fly"}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "Invalid api base url",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Api Base Url":"fly-proxy.internal"}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Invalid flaps base url",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Flaps Base Url":"ftp://machines-proxy.internal"}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Valid TTL",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","TTL":"36h"}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "Invalid TTL",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","TTL":"2 days"}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Negative TTL",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","TTL":"-1h"}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Custom docker data path",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Docker Data Path":"/data/docker"}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "Relative docker data path",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Docker Data Path":"data/docker"}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Snapshot retention",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Snapshot Retention":14}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "Negative snapshot retention",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Snapshot Retention":-1}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Snapshot id",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Snapshot Id":"vs_Ab12"}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "Invalid snapshot id",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Snapshot Id":"vol_Ab12"}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Blank auth token",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"   "}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Private connection mode",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Connection Mode":"private"}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "Invalid connection mode",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Connection Mode":"flycast"}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Custom agent user",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Agent User":"dev_1","Agent Home":"/workspace"}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "Invalid agent user",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Agent User":"Dev User"}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Relative agent home",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Agent Home":"home/dev"}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Performance cpu kind",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Size":"shared-cpu-2x","Cpu Kind":"performance"}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "Invalid cpu kind",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Cpu Kind":"dedicated"}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Cpu kind without matching size",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Size":"performance-16x","Cpu Kind":"shared"}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "No persistent disk",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","No Persistent Disk":true}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "No persistent disk with snapshot",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","No Persistent Disk":true,"Snapshot Id":"vs_1"}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Socks proxy url",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Proxy Url":"socks5://proxy.corp:1080"}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "Invalid proxy url",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Proxy Url":"proxy.corp:3128"}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Extra init commands",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Extra Init Commands":"apk add nfs-utils\nmount -t nfs -o ro,nolock nfs.internal:/data /data"}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "Empty extra init command",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Extra Init Commands":["apk add nfs-utils"," "]}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "External docker host",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Docker Host":"tcp://docker.internal:2375","No Persistent Disk":true}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "External docker host with persistent disk",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Docker Host":"tcp://docker.internal:2375"}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Invalid docker host",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Docker Host":"docker.internal:2375"}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Daytona download url",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Daytona Download Url":"https://mirror.corp/daytona/get-server"}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "Invalid daytona download url",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Daytona Download Url":"mirror.corp/daytona"}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Name prefix",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Name Prefix":"acme-dt-"}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "Invalid name prefix",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Name Prefix":"Acme_"}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Workspace resources",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Workspace Cpus":2,"Workspace Memory":512}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "Workspace cpus exceed machine size",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Size":"shared-cpu-2x","Workspace Cpus":4}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Workspace memory exceeds machine size",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Workspace Memory":2048}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Negative workspace memory",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Workspace Memory":-1}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Primary region",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Region":"lax","Primary Region":"ord"}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "Invalid primary region",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Primary Region":"Chicago"}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Invalid region",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Region":"lax1"}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Unknown region",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Region":"abc"}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Unknown primary region",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Region":"lax","Primary Region":"xyz"}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Labels",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Labels":"team=platform,cost-center=cc-42"}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "Invalid label key",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Labels":{"cost center":"cc-42"}}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Reserved label key",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Labels":{"fly_process_group":"app"}}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Invalid label value",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Labels":{"team":"platform\n"}}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Docker api version",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Docker Api Version":"1.45"}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "Invalid docker api version",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Docker Api Version":"v27.2"}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Services list",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Services":"8080:443:tls+http, 3000:80:http"}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "Services array",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Services":[{"internal_port":5432,"port":5432}]}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "Service port out of range",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Services":"8080:70000"}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Invalid service handler",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Services":"8080:443:https"}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Docker daemon service",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Services":"2375:2375"}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Duplicate service public port",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Services":"8080:443:tls,3000:443:tls"}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Services without public IP",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Services":"8080:443:tls","Public IP":false}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Unencrypted volume",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Encrypt Volume":false}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "Invalid encrypt volume",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Encrypt Volume":"no"}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Encrypt volume without persistent disk",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","No Persistent Disk":true,"Encrypt Volume":true}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Auto destroy without persistent disk",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","No Persistent Disk":true,"Auto Destroy":true}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "Auto destroy with persistent disk",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Auto Destroy":true}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Force recreate",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Force Recreate":true}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "Force recreate with reuse existing app",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Force Recreate":true,"Reuse Existing App":true}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Docker daemon args",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Docker Daemon Args":["--mtu=1280","--default-address-pool=base=10.10.0.0/16,size=24"]}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "Docker daemon args as lines",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Docker Daemon Args":"--mtu=1280\n--registry-mirror=https://mirror.example.com"}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "Empty docker daemon arg",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Docker Daemon Args":["--mtu=1280"," "]}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Docker daemon arg without flag",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Docker Daemon Args":["1280"]}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Docker daemon args with docker host",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Docker Host":"tcp://docker.internal:2375","No Persistent Disk":true,"Docker Daemon Args":["--mtu=1280"]}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "MTU",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","MTU":1280}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "MTU below minimum",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","MTU":576}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "MTU above maximum",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","MTU":9000}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "MTU also set in docker daemon args",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","MTU":1280,"Docker Daemon Args":["--mtu=1400"]}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Agent args",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Agent Args":["--log-level=debug","--name=it's \"mine\""]}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "Empty agent arg",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Agent Args":[""]}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Agent arg without flag",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Agent Args":["; rm -rf /"]}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Volume id",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Volume Id":"vol_abc123","Reuse Existing App":true}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "Volume id without reuse existing app",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Volume Id":"vol_abc123"}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Invalid volume id",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Volume Id":"abc123","Reuse Existing App":true}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Volume id with snapshot id",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Volume Id":"vol_abc123","Reuse Existing App":true,"Snapshot Id":"vs_abc123"}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Volume id with region fallback",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Region":"lax","Volume Id":"vol_abc123","Reuse Existing App":true,"Region Fallback":"ord"}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Volume id without persistent disk",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Volume Id":"vol_abc123","Reuse Existing App":true,"No Persistent Disk":true}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
+		{
+			name:              "Stop timeout",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Stop Timeout":60}`,
+			setAccessTokenEnv: false,
+			isValid:           true,
+		},
+		{
+			name:              "Negative stop timeout",
+			jsonInput:         `{"Org Slug":"org","Auth Token":"token","Stop Timeout":-1}`,
+			setAccessTokenEnv: false,
+			isValid:           false,
+		},
 		{
 			name:              "Empty input",
 			jsonInput:         `{}`,
@@ -72,3 +784,255 @@ func TestParseTargetOptions(t *testing.T) {
 		})
 	}
 }
+
+func TestParseTargetOptionsExtraEnv(t *testing.T) {
+	cases := []struct {
+		name     string
+		extraEnv string
+		expected map[string]string
+	}{
+		{
+			name:     "JSON object",
+			extraEnv: `{"FOO":"bar","BAZ":"qux"}`,
+			expected: map[string]string{"FOO": "bar", "BAZ": "qux"},
+		},
+		{
+			name:     "JSON object string",
+			extraEnv: `"{\"FOO\":\"bar\"}"`,
+			expected: map[string]string{"FOO": "bar"},
+		},
+		{
+			name:     "KEY=VALUE list",
+			extraEnv: `"FOO=bar, BAZ=a=b\nEMPTY="`,
+			expected: map[string]string{"FOO": "bar", "BAZ": "a=b", "EMPTY": ""},
+		},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			targetOptions, err := ParseTargetOptions(`{"Org Slug":"org","Auth Token":"token","Extra Env":` + testCase.extraEnv + `}`)
+			if err != nil {
+				t.Fatalf("Expected valid target options but got error: %s", err)
+			}
+
+			if !maps.Equal(map[string]string(targetOptions.ExtraEnv), testCase.expected) {
+				t.Errorf("Expected extra env %v but got %v", testCase.expected, targetOptions.ExtraEnv)
+			}
+		})
+	}
+}
+
+func TestParseTargetOptionsFlyConfigToken(t *testing.T) {
+	cases := []struct {
+		name          string
+		config        string
+		expectedToken string
+		isValid       bool
+	}{
+		{"Token in config", "access_token: config-token\n", "config-token", true},
+		{"Missing access token", "last_login: today\n", "", false},
+		{"Invalid yaml", "access_token: [\n", "", false},
+		{"Missing config file", "", "", false},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			homeDir := t.TempDir()
+			t.Setenv("HOME", homeDir)
+			t.Setenv("FLY_ACCESS_TOKEN", "")
+
+			if testCase.config != "" {
+				if err := os.MkdirAll(filepath.Join(homeDir, ".fly"), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(homeDir, ".fly", "config.yml"), []byte(testCase.config), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			targetOptions, err := ParseTargetOptions(`{"Org Slug":"org","Use Fly Config Token":true}`)
+			if !testCase.isValid {
+				if err == nil {
+					t.Errorf("Expected error for invalid fly config but got none")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Expected valid target options but got error: %s", err)
+			}
+			if targetOptions.AuthToken != testCase.expectedToken {
+				t.Errorf("Expected auth token %q but got %q", testCase.expectedToken, targetOptions.AuthToken)
+			}
+		})
+	}
+}
+
+func TestParseTargetOptionsApiBaseUrlEnv(t *testing.T) {
+	t.Setenv("FLY_API_BASE_URL", "https://fly-proxy.internal")
+
+	targetOptions, err := ParseTargetOptions(`{"Org Slug":"org","Auth Token":"token"}`)
+	if err != nil {
+		t.Fatalf("Expected valid target options but got error: %s", err)
+	}
+	if targetOptions.ApiBaseUrl != "https://fly-proxy.internal" {
+		t.Errorf("Expected api base url from env but got %q", targetOptions.ApiBaseUrl)
+	}
+
+	targetOptions, err = ParseTargetOptions(`{"Org Slug":"org","Auth Token":"token","Api Base Url":"https://other.internal"}`)
+	if err != nil {
+		t.Fatalf("Expected valid target options but got error: %s", err)
+	}
+	if targetOptions.ApiBaseUrl != "https://other.internal" {
+		t.Errorf("Expected api base url option to take precedence but got %q", targetOptions.ApiBaseUrl)
+	}
+}
+
+func TestParseTargetOptionsDiskSize(t *testing.T) {
+	cases := []struct {
+		name     string
+		input    string
+		expected FlexInt
+		isValid  bool
+	}{
+		{"Numeric disk size", `{"Org Slug":"org","Auth Token":"token","Disk Size":20}`, 20, true},
+		{"String disk size", `{"Org Slug":"org","Auth Token":"token","Disk Size":"20"}`, 20, true},
+		{"Missing disk size", `{"Org Slug":"org","Auth Token":"token"}`, DefaultDiskSize, true},
+		{"Empty string disk size", `{"Org Slug":"org","Auth Token":"token","Disk Size":""}`, 0, false},
+		{"Non-numeric disk size", `{"Org Slug":"org","Auth Token":"token","Disk Size":"ten"}`, 0, false},
+		{"Negative disk size", `{"Org Slug":"org","Auth Token":"token","Disk Size":-5}`, 0, false},
+		{"Disk size above maximum", `{"Org Slug":"org","Auth Token":"token","Disk Size":501}`, 0, false},
+		{"Disk size above maximum of size", `{"Org Slug":"org","Auth Token":"token","Size":"shared-cpu-1x","Disk Size":500}`, 0, false},
+		{"Disk size above maximum of cpu kind size", `{"Org Slug":"org","Auth Token":"token","Size":"shared-cpu-2x","Cpu Kind":"shared","Disk Size":300}`, 0, false},
+		{"Disk size within maximum of size", `{"Org Slug":"org","Auth Token":"token","Size":"shared-cpu-1x","Disk Size":100}`, 100, true},
+		{"Large disk on large size", `{"Org Slug":"org","Auth Token":"token","Size":"performance-8x","Disk Size":500}`, 500, true},
+		{"Large disk without persistent disk", `{"Org Slug":"org","Auth Token":"token","Size":"shared-cpu-1x","Disk Size":500,"No Persistent Disk":true}`, 500, true},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			targetOptions, err := ParseTargetOptions(testCase.input)
+			if !testCase.isValid {
+				if err == nil {
+					t.Errorf("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected valid target options but got error: %s", err)
+			}
+			if targetOptions.DiskSize != testCase.expected {
+				t.Errorf("Expected disk size %d but got %d", testCase.expected, targetOptions.DiskSize)
+			}
+		})
+	}
+}
+
+func TestHasFlyTokenPrefix(t *testing.T) {
+	cases := []struct {
+		token    string
+		expected bool
+	}{
+		{"FlyV1 fm2_abc,fm2_def", true},
+		{"fm2_abc", true},
+		{"fo1_abc", true},
+		{"Bearer abc", false},
+		{"abc", false},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.token, func(t *testing.T) {
+			if hasFlyTokenPrefix(testCase.token) != testCase.expected {
+				t.Errorf("Expected prefix check of %q to be %t", testCase.token, testCase.expected)
+			}
+		})
+	}
+}
+
+func TestMachineSize(t *testing.T) {
+	cases := []struct {
+		size     string
+		cpuKind  string
+		expected string
+	}{
+		{"shared-cpu-4x", "", "shared-cpu-4x"},
+		{"shared-cpu-4x", CpuKindPerformance, "performance-4x"},
+		{"performance-2x", CpuKindShared, "shared-cpu-2x"},
+		{"performance-2x", CpuKindPerformance, "performance-2x"},
+		{"a100-40gb", CpuKindShared, "a100-40gb"},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.size+"/"+testCase.cpuKind, func(t *testing.T) {
+			opts := TargetOptions{Size: testCase.size, CpuKind: testCase.cpuKind}
+			if size := opts.MachineSize(); size != testCase.expected {
+				t.Errorf("Expected machine size %s but got %s", testCase.expected, size)
+			}
+		})
+	}
+}
+
+func TestWorkspaceResources(t *testing.T) {
+	opts := TargetOptions{Size: "performance-2x", WorkspaceCpus: 1, WorkspaceMemory: 1024}
+
+	cases := []struct {
+		name     string
+		labels   map[string]string
+		expected WorkspaceResources
+		isValid  bool
+	}{
+		{"Target defaults", nil, WorkspaceResources{Cpus: 1, MemoryMb: 1024}, true},
+		{"Label overrides", map[string]string{WorkspaceCpusLabel: "2", WorkspaceMemoryLabel: "4096"}, WorkspaceResources{Cpus: 2, MemoryMb: 4096}, true},
+		{"Label removes limit", map[string]string{WorkspaceMemoryLabel: "0"}, WorkspaceResources{Cpus: 1}, true},
+		{"Label exceeds machine size", map[string]string{WorkspaceMemoryLabel: "8192"}, WorkspaceResources{}, false},
+		{"Invalid label", map[string]string{WorkspaceCpusLabel: "two"}, WorkspaceResources{}, false},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			resources, err := opts.WorkspaceResources(testCase.labels)
+			if testCase.isValid && err != nil {
+				t.Fatalf("Expected no error but got %v", err)
+			}
+			if !testCase.isValid && err == nil {
+				t.Fatalf("Expected an error but got none")
+			}
+			if resources != testCase.expected {
+				t.Errorf("Expected resources %+v but got %+v", testCase.expected, resources)
+			}
+		})
+	}
+}
+
+func TestSuggestionsMinVersion(t *testing.T) {
+	negotiator := SuggestionsMinVersion("v0.30.0")
+
+	cases := []struct {
+		serverVersion string
+		trimmed       bool
+	}{
+		{"v0.29.1", true},
+		{"0.9.0", true},
+		{"v0.30.0", false},
+		{"v0.52.0-rc1", false},
+		{"dev", false},
+		{"", false},
+	}
+
+	for _, testCase := range cases {
+		t.Run(testCase.serverVersion, func(t *testing.T) {
+			manifest := *negotiator.Manifest(testCase.serverVersion)
+			if len(manifest) != len(*GetTargetConfigManifest()) {
+				t.Fatalf("Expected all properties in the manifest but got %d", len(manifest))
+			}
+
+			suggestions := manifest["Size"].Suggestions
+			if testCase.trimmed && suggestions != nil {
+				t.Errorf("Expected no suggestions for server %s but got %v", testCase.serverVersion, suggestions)
+			}
+			if !testCase.trimmed && len(suggestions) == 0 {
+				t.Errorf("Expected the size suggestions for server %s", testCase.serverVersion)
+			}
+		})
+	}
+}